@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// AdminStore is the part of the datastore the admin endpoints need.
+type AdminStore interface {
+	Stats() datastore.Stats
+	Compact() error
+}
+
+// Admin serves the /admin/ endpoints used to inspect and maintain the
+// datastore.
+type Admin struct {
+	db AdminStore
+}
+
+func NewAdmin(db AdminStore) *Admin {
+	return &Admin{db: db}
+}
+
+func (a *Admin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/admin/stats":
+		if req.Method != http.MethodGet {
+			rw.Header().Set("Allow", http.MethodGet)
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(a.db.Stats())
+	case "/admin/compact":
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := a.db.Compact(); err != nil {
+			log.Printf("Manual compaction failed: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(a.db.Stats())
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func newMemDb(t *testing.T) *datastore.Db {
+	t.Helper()
+	db, err := datastore.NewDb("db", 1000, datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestAdmin_Stats(t *testing.T) {
+	db := newMemDb(t)
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	a := NewAdmin(db)
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var stats datastore.Stats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 2 || stats.SegmentCount != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	rec = httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/stats", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
+
+func TestAdmin_Compact(t *testing.T) {
+	db, err := datastore.NewDb("db", 45, datastore.WithFS(datastore.NewMemFS()), datastore.WithCompactionPolicy(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		db.Put(key, "value")
+	}
+	if count := db.Stats().SegmentCount; count != 3 {
+		t.Fatalf("Expected 3 segments before compaction, got %d", count)
+	}
+
+	rec := httptest.NewRecorder()
+	NewAdmin(db).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/compact", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var stats datastore.Stats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.SegmentCount != 2 || stats.Merges != 1 {
+		t.Errorf("Unexpected stats after compaction %+v", stats)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Token grants its holder rights on the keys that start with one of
+// Prefixes. Keys of named buckets are matched as <bucket>/<key>, so the
+// prefix "users/" covers the users bucket and "" covers every key.
+type Token struct {
+	// ID names the token in logs, which never show Secret.
+	ID       string   `json:"id"`
+	Secret   string   `json:"secret"`
+	Prefixes []string `json:"prefixes"`
+	// Rights are "read", "write" or both.
+	Rights []string `json:"rights"`
+}
+
+const (
+	readRight  = "read"
+	writeRight = "write"
+)
+
+func (t *Token) allows(right, key string) bool {
+	granted := false
+	for _, r := range t.Rights {
+		granted = granted || r == right
+	}
+	if !granted {
+		return false
+	}
+	for _, prefix := range t.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL authenticates HTTP requests by the bearer token in their Authorization
+// header and RESP connections by AUTH. The Handler and RespServer then check
+// every key a request touches against the scope of the token.
+type ACL struct {
+	tokens  []Token
+	digests [][sha256.Size]byte
+}
+
+// LoadACL reads a JSON array of Token from path.
+func LoadACL(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	acl, err := NewACL(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return acl, nil
+}
+
+func NewACL(tokens []Token) (*ACL, error) {
+	acl := &ACL{}
+	ids := make(map[string]bool)
+	secrets := make(map[string]bool)
+	for _, t := range tokens {
+		switch {
+		case t.ID == "":
+			return nil, fmt.Errorf("token without an id")
+		case ids[t.ID]:
+			return nil, fmt.Errorf("token %s defined twice", t.ID)
+		case t.Secret == "":
+			return nil, fmt.Errorf("token %s has no secret", t.ID)
+		case secrets[t.Secret]:
+			return nil, fmt.Errorf("token %s reuses the secret of another token", t.ID)
+		case len(t.Prefixes) == 0:
+			return nil, fmt.Errorf("token %s has no prefixes, use \"\" for every key", t.ID)
+		case len(t.Rights) == 0:
+			return nil, fmt.Errorf("token %s has no rights", t.ID)
+		}
+		for _, r := range t.Rights {
+			if r != readRight && r != writeRight {
+				return nil, fmt.Errorf("token %s: unknown right %q", t.ID, r)
+			}
+		}
+		ids[t.ID], secrets[t.Secret] = true, true
+		acl.tokens = append(acl.tokens, t)
+		acl.digests = append(acl.digests, sha256.Sum256([]byte(t.Secret)))
+	}
+	return acl, nil
+}
+
+// lookup finds the token with secret. It compares digests in constant time,
+// so the timing tells nothing about the secrets.
+func (a *ACL) lookup(secret string) *Token {
+	digest := sha256.Sum256([]byte(secret))
+	var found *Token
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare(digest[:], a.digests[i][:]) == 1 {
+			found = &a.tokens[i]
+		}
+	}
+	return found
+}
+
+type tokenKey struct{}
+
+// Authenticate answers 401 to requests without a known token and passes the
+// others to h with the token in their context.
+func (a *ACL) Authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scheme, secret, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || secret == "" {
+			log.Printf("auth: denied %s %s: no bearer token", req.Method, req.URL.Path)
+			unauthorized(rw, "a bearer token is required")
+			return
+		}
+		token := a.lookup(secret)
+		if token == nil {
+			log.Printf("auth: denied %s %s: unknown token", req.Method, req.URL.Path)
+			unauthorized(rw, "unknown token")
+			return
+		}
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), tokenKey{}, token)))
+	})
+}
+
+// Require is Authenticate for endpoints that reach every key, such as
+// /replication/ and /admin/: the token needs right on the empty prefix.
+func (a *ACL) Require(right string, h http.Handler) http.Handler {
+	return a.Authenticate(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token := req.Context().Value(tokenKey{}).(*Token)
+		if !token.allows(right, "") {
+			log.Printf("auth: token %s denied %s of %s", token.ID, right, req.URL.Path)
+			writeErrorCode(rw, http.StatusForbidden, codeForbidden, fmt.Sprintf("%s access to every key is required", right))
+			return
+		}
+		h.ServeHTTP(rw, req)
+	}))
+}
+
+func unauthorized(rw http.ResponseWriter, message string) {
+	rw.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+	writeErrorCode(rw, http.StatusUnauthorized, codeUnauthorized, message)
+}
+
+// authorize checks that the token of req grants right on keys, which are
+// keys or prefixes of scans, and answers 403 otherwise. Requests that did not
+// go through Authenticate are always allowed.
+func (h *Handler) authorize(rw http.ResponseWriter, req *http.Request, right string, keys ...string) bool {
+	token, ok := req.Context().Value(tokenKey{}).(*Token)
+	if !ok {
+		return true
+	}
+	scoped := make([]string, len(keys))
+	for i, key := range keys {
+		scoped[i] = h.scopeKey(key)
+		if !token.allows(right, scoped[i]) {
+			log.Printf("auth: token %s denied %s of %q", token.ID, right, scoped[i])
+			writeErrorCode(rw, http.StatusForbidden, codeForbidden, fmt.Sprintf("no %s access to %q", right, scoped[i]))
+			return false
+		}
+	}
+	log.Printf("auth: token %s allowed %s of %q", token.ID, right, scoped)
+	return true
+}
+
+// scopeKey is key as matched against token prefixes.
+func (h *Handler) scopeKey(key string) string {
+	if h.bucket == "" {
+		return key
+	}
+	return h.bucket + "/" + key
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// writeTokens writes the tokens of the auth tests to a file and returns its
+// path.
+func writeTokens(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, []byte(`[
+		{"id": "admin", "secret": "s3cret-admin", "prefixes": [""], "rights": ["read", "write"]},
+		{"id": "users", "secret": "s3cret-users", "prefixes": ["user:", "users/"], "rights": ["read", "write"]},
+		{"id": "reader", "secret": "s3cret-reader", "prefixes": ["user:"], "rights": ["read"]}
+	]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuth(t *testing.T) {
+	acl, err := LoadACL(writeTokens(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	store := datastore.NewMemStore()
+	h := acl.Authenticate(NewHandler(store))
+	do := func(secret, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		secret, method, path, body string
+		status                     int
+	}{
+		{"", http.MethodGet, "/db/user:1", "", http.StatusUnauthorized},
+		{"wrong", http.MethodGet, "/db/user:1", "", http.StatusUnauthorized},
+		{"s3cret-users", http.MethodPut, "/db/user:1", `{"value":"ann"}`, http.StatusNoContent},
+		{"s3cret-users", http.MethodPut, "/db/users/1", `{"value":"bob"}`, http.StatusNoContent},
+		{"s3cret-users", http.MethodPut, "/db/order:1", `{"value":"x"}`, http.StatusForbidden},
+		{"s3cret-users", http.MethodPost, "/db/counter:incr", `{}`, http.StatusForbidden},
+		{"s3cret-users", http.MethodDelete, "/db/users/", "", http.StatusNoContent},
+		{"s3cret-users", http.MethodDelete, "/db/orders/", "", http.StatusForbidden},
+		{"s3cret-reader", http.MethodGet, "/db/user:1", "", http.StatusOK},
+		{"s3cret-reader", http.MethodHead, "/db/user:1", "", http.StatusOK},
+		{"s3cret-reader", http.MethodDelete, "/db/user:1", "", http.StatusForbidden},
+		{"s3cret-reader", http.MethodGet, "/db/users/1", "", http.StatusForbidden},
+		{"s3cret-reader", http.MethodGet, "/db/_scan?prefix=user:", "", http.StatusOK},
+		{"s3cret-reader", http.MethodGet, "/db/_scan", "", http.StatusForbidden},
+		{"s3cret-reader", http.MethodGet, "/db/_watch", "", http.StatusForbidden},
+		{"s3cret-reader", http.MethodPost, "/db/_mget", `{"keys":["user:1","user:2"]}`, http.StatusOK},
+		{"s3cret-reader", http.MethodPost, "/db/_mget", `{"keys":["user:1","order:1"]}`, http.StatusForbidden},
+		{"s3cret-reader", http.MethodPost, "/db/_mdelete", `{"keys":["user:1"]}`, http.StatusForbidden},
+		{"s3cret-admin", http.MethodPost, "/db/_mdelete", `{"keys":["user:1","order:1"]}`, http.StatusNoContent},
+	} {
+		rec := do(tc.secret, tc.method, tc.path, tc.body)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s with %q: expected %d, got %d: %s", tc.method, tc.path, tc.secret, tc.status, rec.Code, rec.Body)
+			continue
+		}
+		switch tc.status {
+		case http.StatusUnauthorized:
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s: no WWW-Authenticate header", tc.method, tc.path)
+			}
+			if code := errorCode(t, rec); code != codeUnauthorized {
+				t.Errorf("%s %s: expected code %s, got %s", tc.method, tc.path, codeUnauthorized, code)
+			}
+		case http.StatusForbidden:
+			if code := errorCode(t, rec); code != codeForbidden {
+				t.Errorf("%s %s: expected code %s, got %s", tc.method, tc.path, codeForbidden, code)
+			}
+		}
+	}
+
+	if strings.Contains(logs.String(), "s3cret") {
+		t.Errorf("Secrets leaked into the log:\n%s", logs.String())
+	}
+	for _, line := range []string{"token users denied write", "token reader allowed read", "unknown token", "no bearer token"} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("Expected %q in the log:\n%s", line, logs.String())
+		}
+	}
+
+	t.Run("Invalid Files", func(t *testing.T) {
+		for _, tokens := range [][]Token{
+			{{Secret: "s", Prefixes: []string{""}, Rights: []string{"read"}}},
+			{{ID: "a", Prefixes: []string{""}, Rights: []string{"read"}}},
+			{{ID: "a", Secret: "s", Rights: []string{"read"}}},
+			{{ID: "a", Secret: "s", Prefixes: []string{""}}},
+			{{ID: "a", Secret: "s", Prefixes: []string{""}, Rights: []string{"admin"}}},
+			{
+				{ID: "a", Secret: "s", Prefixes: []string{""}, Rights: []string{"read"}},
+				{ID: "a", Secret: "t", Prefixes: []string{""}, Rights: []string{"read"}},
+			},
+			{
+				{ID: "a", Secret: "s", Prefixes: []string{""}, Rights: []string{"read"}},
+				{ID: "b", Secret: "s", Prefixes: []string{""}, Rights: []string{"read"}},
+			},
+		} {
+			if _, err := NewACL(tokens); err == nil {
+				t.Errorf("Expected %+v to be rejected", tokens)
+			}
+		}
+	})
+}
+
+// TestAuth_Service checks that -tokens guards the HTTP endpoints beyond /db/
+// that expose or change data.
+func TestAuth_Service(t *testing.T) {
+	cfg, err := parseConfig([]string{"-addr", "127.0.0.1:0", "-data-dir", t.TempDir(), "-tokens", writeTokens(t)}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.shutdown(time.Second)
+	base := "http://" + svc.server.Addr()
+	svc.db.Put("user:1", "ann")
+
+	do := func(secret, method, path string) int {
+		req, _ := http.NewRequest(method, base+path, nil)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, tc := range []struct {
+		secret, method, path string
+		status               int
+	}{
+		{"", http.MethodGet, "/replication/snapshot", http.StatusUnauthorized},
+		{"", http.MethodGet, "/replication/stream?since=0", http.StatusUnauthorized},
+		{"", http.MethodPost, "/admin/compact", http.StatusUnauthorized},
+		{"", http.MethodGet, "/admin/stats", http.StatusUnauthorized},
+		{"s3cret-reader", http.MethodGet, "/replication/snapshot", http.StatusForbidden},
+		{"s3cret-users", http.MethodPost, "/admin/compact", http.StatusForbidden},
+		{"s3cret-admin", http.MethodGet, "/replication/snapshot", http.StatusOK},
+	} {
+		if status := do(tc.secret, tc.method, tc.path); status != tc.status {
+			t.Errorf("%s %s with %q: expected %d, got %d", tc.method, tc.path, tc.secret, tc.status, status)
+		}
+	}
+
+	t.Run("Follower", func(t *testing.T) {
+		db := newMemDb(t)
+		f := NewFollower(base, db)
+		f.Token = "s3cret-admin"
+		if err := f.loadSnapshot(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := db.Get("user:1"); value != "ann" {
+			t.Errorf("Snapshot not loaded with the token, got %q", value)
+		}
+	})
+}
+
+func TestRespServer_Auth(t *testing.T) {
+	acl, err := LoadACL(writeTokens(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newMemDb(t)
+	s := NewRespServer(db)
+	s.ACL = acl
+	c := dialResp(t, serveResp(t, s))
+
+	c.expect(respError("NOAUTH Authentication required."), "GET", "user:1")
+	c.expect(respError("NOAUTH Authentication required."), "SET", "user:1", "v")
+	c.expect(respError("WRONGPASS invalid username-password pair or user is disabled."), "AUTH", "wrong")
+	c.expect(respError("WRONGPASS invalid username-password pair or user is disabled."), "AUTH", "admin", "s3cret-reader")
+	c.expect("OK", "AUTH", "reader", "s3cret-reader")
+	c.expect(nil, "GET", "user:1")
+	c.expect(respError("NOPERM this user has no permissions to access one of the keys used as arguments"), "SET", "user:1", "v")
+	c.expect(respError("NOPERM this user has no permissions to access one of the keys used as arguments"), "MGET", "user:1", "order:1")
+	c.expect(respError("NOPERM this user has no permissions to access one of the keys used as arguments"), "SCAN", "0")
+	c.expect([]interface{}{"0", []interface{}{}}, "SCAN", "0", "MATCH", "user:*")
+	c.expect("OK", "AUTH", "s3cret-users")
+	c.expect("OK", "SET", "user:1", "v")
+
+	other := dialResp(t, serveResp(t, NewRespServer(db)))
+	if got, ok := other.do("AUTH", "s3cret-admin").(respError); !ok || !strings.HasPrefix(string(got), "ERR AUTH") {
+		t.Errorf("Expected AUTH to fail without an ACL, got %#v", got)
+	}
+}
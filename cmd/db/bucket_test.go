@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestBuckets(t *testing.T) {
+	store := datastore.NewMemStore()
+	h := NewHandler(store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	for _, path := range []string{"/db/kentiki", "/db/team1/kentiki", "/db/team2/kentiki"} {
+		if rec := do(http.MethodPost, path, `{"value":"`+path+`"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 for %s, got %d", path, rec.Code)
+		}
+	}
+	for _, path := range []string{"/db/kentiki", "/db/team1/kentiki", "/db/team2/kentiki"} {
+		rec := do(http.MethodGet, path, "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), path) {
+			t.Errorf("Unexpected response for %s: %d %s", path, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(http.MethodGet, "/db/default/kentiki", ""); !strings.Contains(rec.Body.String(), `"/db/kentiki"`) {
+		t.Errorf("Expected flat keys in the default bucket, got %s", rec.Body)
+	}
+
+	if rec := do(http.MethodDelete, "/db/team1/", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a drop, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/db/team1/kentiki", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the dropped key to be gone, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/db/team2/kentiki", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the other bucket to survive, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodGet, "/db/%00team2%00kentiki", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a NUL in the key, got %d", rec.Code)
+	}
+}
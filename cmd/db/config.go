@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// envPrefix starts the environment variable of every flag: -data-dir can be
+// set with DB_DATA_DIR. A flag given on the command line wins.
+const envPrefix = "DB_"
+
+// Config is the configuration of the db process.
+type Config struct {
+	Addr string
+	// DataDir is empty for a fresh temporary directory.
+	DataDir     string
+	SegmentSize int64
+	// MaxValueSize limits the request bodies of the /db/ API, and so the
+	// size of values.
+	MaxValueSize int64
+	// Compaction is nil when merges only run on POST /admin/compact.
+	Compaction datastore.CompactionPolicy
+	SyncWrites bool
+	// SyncInterval is the period of background syncs, 0 for none.
+	SyncInterval time.Duration
+	// Backpressure slows down and stalls writes that run ahead of
+	// compaction. Its hard limit is 0 without a compaction policy, as
+	// nothing would merge the segments and lift the stall.
+	Backpressure datastore.Backpressure
+	Follow       string
+	// FollowToken is the bearer token sent to the leader.
+	FollowToken  string
+	RespPort     int
+	MemcachePort int
+	// Tokens is the file LoadACL reads, empty to serve without auth.
+	Tokens string
+	// ShutdownTimeout bounds how long a shutdown waits for running requests.
+	ShutdownTimeout time.Duration
+
+	// effective lists every setting as name=value.
+	effective []string
+}
+
+// String describes the effective configuration.
+func (c *Config) String() string {
+	return strings.Join(c.effective, " ")
+}
+
+// parseConfig reads the configuration from command line args, taking the
+// flags missing there from getenv, and validates it.
+func parseConfig(args []string, getenv func(string) string) (*Config, error) {
+	flags := flag.NewFlagSet("db", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: db [flags]\n\nEvery flag can also be set with the %s<FLAG> environment variable, e.g. %s.\n\n", envPrefix, envName("data-dir"))
+		flags.PrintDefaults()
+	}
+
+	var (
+		c                                              Config
+		segmentSize, maxValueSize, compaction, syncing string
+	)
+	flags.StringVar(&c.Addr, "addr", ":8083", "HTTP listen address")
+	flags.StringVar(&c.DataDir, "data-dir", "", "datastore directory, a new temporary one if empty")
+	flags.StringVar(&segmentSize, "segment-size", "10M", "segment size in bytes, with an optional K, M or G suffix")
+	flags.StringVar(&maxValueSize, "max-value-size", "64M", "largest /db/ request body and so value in bytes, with an optional K, M or G suffix")
+	flags.StringVar(&compaction, "compaction", "count:3", "compaction policy: count:<segments>, dead-ratio:<ratio>, size-tiered:<segments> or none")
+	flags.StringVar(&syncing, "sync", "none", "syncing of writes to disk: none, always or a sync interval such as 1s")
+	flags.IntVar(&c.Backpressure.SoftLimit, "backpressure-soft-limit", 8, "sealed segments at which writes are delayed, 0 to never delay them")
+	flags.IntVar(&c.Backpressure.HardLimit, "backpressure-hard-limit", 16, "sealed segments at which writes fail until compaction catches up, 0 to never stall them; must be 0 with -compaction none")
+	flags.DurationVar(&c.Backpressure.Delay, "backpressure-delay", 10*time.Millisecond, "delay of a write for every sealed segment at or above the soft limit")
+	flags.StringVar(&c.Follow, "follow", "", "leader URL to replicate from; the server is read-only while following and resumes from the version kept in the data directory")
+	flags.StringVar(&c.FollowToken, "follow-token", "", "bearer token for the leader, which needs read access to every key")
+	flags.IntVar(&c.RespPort, "resp-port", 0, "port of the Redis protocol listener, 0 to disable it")
+	flags.IntVar(&c.MemcachePort, "memcached-port", 0, "port of the memcached text protocol listener, 0 to disable it")
+	flags.StringVar(&c.Tokens, "tokens", "", "JSON file with the bearer tokens of the HTTP and Redis protocol APIs, no auth if empty")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 5*time.Second, "how long a shutdown waits for running requests")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if v := getenv(envName(f.Name)); v != "" && !given[f.Name] && err == nil {
+			if setErr := flags.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+			}
+			given[f.Name] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return nil, fmt.Errorf("-addr: %w", err)
+	}
+	if c.SegmentSize, err = parseSize(segmentSize); err != nil {
+		return nil, fmt.Errorf("-segment-size: %w", err)
+	}
+	if c.MaxValueSize, err = parseSize(maxValueSize); err != nil {
+		return nil, fmt.Errorf("-max-value-size: %w", err)
+	}
+	if c.Compaction, err = parseCompaction(compaction); err != nil {
+		return nil, fmt.Errorf("-compaction: %w", err)
+	}
+	switch syncing {
+	case "none":
+	case "always":
+		c.SyncWrites = true
+	default:
+		if c.SyncInterval, err = time.ParseDuration(syncing); err != nil || c.SyncInterval <= 0 {
+			return nil, fmt.Errorf("-sync: expected none, always or a positive interval, got %q", syncing)
+		}
+	}
+	if c.Backpressure.SoftLimit < 0 {
+		return nil, fmt.Errorf("-backpressure-soft-limit: must not be negative")
+	}
+	if c.Backpressure.HardLimit < 0 {
+		return nil, fmt.Errorf("-backpressure-hard-limit: must not be negative")
+	}
+	if c.Backpressure.Delay < 0 {
+		return nil, fmt.Errorf("-backpressure-delay: must not be negative")
+	}
+	if c.Compaction == nil && c.Backpressure.HardLimit > 0 {
+		if given["backpressure-hard-limit"] {
+			return nil, fmt.Errorf("-backpressure-hard-limit: writes would stall for good with -compaction none")
+		}
+		// Merges only run on request, so stalled writes would never resume.
+		c.Backpressure.HardLimit = 0
+	}
+	if c.RespPort < 0 || c.RespPort > 65535 {
+		return nil, fmt.Errorf("-resp-port: %d is not a port", c.RespPort)
+	}
+	if c.MemcachePort < 0 || c.MemcachePort > 65535 {
+		return nil, fmt.Errorf("-memcached-port: %d is not a port", c.MemcachePort)
+	}
+	if c.Tokens != "" && c.MemcachePort != 0 {
+		return nil, fmt.Errorf("-memcached-port: the memcached protocol has no authentication, it cannot be enabled with -tokens")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("-shutdown-timeout: must be positive")
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		c.effective = append(c.effective, f.Name+"="+f.Value.String())
+	})
+	return &c, nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseSize parses a positive number of bytes with an optional binary K, M or
+// G suffix.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	digits := s
+	if multiplier > 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/multiplier {
+		return 0, fmt.Errorf("expected a positive size, got %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// parseCompaction parses a policy given as name:parameter.
+func parseCompaction(s string) (datastore.CompactionPolicy, error) {
+	if s == "none" {
+		return nil, nil
+	}
+	name, param, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("expected <policy>:<parameter> or none, got %q", s)
+	}
+	switch name {
+	case "count":
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 2 {
+			return nil, fmt.Errorf("segment count must be an integer of at least 2, got %q", param)
+		}
+		return datastore.SegmentCountPolicy{Threshold: n}, nil
+	case "dead-ratio":
+		ratio, err := strconv.ParseFloat(param, 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return nil, fmt.Errorf("dead ratio must be in (0, 1], got %q", param)
+		}
+		return datastore.DeadRatioPolicy{Ratio: ratio}, nil
+	case "size-tiered":
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 2 {
+			return nil, fmt.Errorf("segment count must be an integer of at least 2, got %q", param)
+		}
+		return datastore.SizeTieredPolicy{MinThreshold: n}, nil
+	}
+	return nil, fmt.Errorf("unknown policy %q", name)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestParseConfig(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		c, err := parseConfig(nil, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Addr != ":8083" || c.DataDir != "" || c.SegmentSize != 10<<20 || c.MaxValueSize != 64<<20 || c.SyncWrites || c.SyncInterval != 0 {
+			t.Errorf("Unexpected defaults %+v", c)
+		}
+		if c.Compaction != (datastore.SegmentCountPolicy{Threshold: 3}) {
+			t.Errorf("Unexpected default policy %#v", c.Compaction)
+		}
+		if c.Backpressure != (datastore.Backpressure{SoftLimit: 8, HardLimit: 16, Delay: 10 * time.Millisecond}) {
+			t.Errorf("Unexpected default backpressure %+v", c.Backpressure)
+		}
+	})
+
+	t.Run("Flags And Environment", func(t *testing.T) {
+		c, err := parseConfig(
+			[]string{"-addr", "localhost:9000", "-compaction", "none"},
+			env(map[string]string{
+				"DB_ADDR":                    ":1",
+				"DB_DATA_DIR":                "/var/lib/db",
+				"DB_SEGMENT_SIZE":            "64K",
+				"DB_MAX_VALUE_SIZE":          "1G",
+				"DB_COMPACTION":              "dead-ratio:0.5",
+				"DB_SYNC":                    "250ms",
+				"DB_BACKPRESSURE_SOFT_LIMIT": "4",
+				"DB_BACKPRESSURE_DELAY":      "1ms",
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Addr != "localhost:9000" {
+			t.Errorf("Expected the flag to win over DB_ADDR, got %q", c.Addr)
+		}
+		if c.Compaction != nil {
+			t.Errorf("Expected no compaction policy, got %#v", c.Compaction)
+		}
+		if c.Backpressure != (datastore.Backpressure{SoftLimit: 4, Delay: time.Millisecond}) {
+			t.Errorf("Expected backpressure without a hard limit, got %+v", c.Backpressure)
+		}
+		if c.DataDir != "/var/lib/db" || c.SegmentSize != 64<<10 || c.MaxValueSize != 1<<30 || c.SyncInterval != 250*time.Millisecond {
+			t.Errorf("Environment not applied: %+v", c)
+		}
+		for _, setting := range []string{"addr=localhost:9000", "data-dir=/var/lib/db", "segment-size=64K", "sync=250ms", "backpressure-hard-limit=0"} {
+			if !strings.Contains(c.String(), setting) {
+				t.Errorf("Expected %q in %q", setting, c.String())
+			}
+		}
+	})
+
+	t.Run("Policies", func(t *testing.T) {
+		for value, expected := range map[string]datastore.CompactionPolicy{
+			"count:5":        datastore.SegmentCountPolicy{Threshold: 5},
+			"dead-ratio:0.3": datastore.DeadRatioPolicy{Ratio: 0.3},
+			"size-tiered:4":  datastore.SizeTieredPolicy{MinThreshold: 4},
+		} {
+			c, err := parseConfig([]string{"-compaction", value, "-sync", "always"}, env(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Compaction != expected || !c.SyncWrites {
+				t.Errorf("%s: unexpected config %+v", value, c)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, tc := range []struct {
+			args []string
+			env  map[string]string
+		}{
+			{args: []string{"-addr", "8083"}},
+			{args: []string{"-segment-size", "0"}},
+			{args: []string{"-segment-size", "10X"}},
+			{args: []string{"-max-value-size", "0"}},
+			{args: []string{"-compaction", "count"}},
+			{args: []string{"-compaction", "count:1"}},
+			{args: []string{"-compaction", "dead-ratio:2"}},
+			{args: []string{"-compaction", "lru:3"}},
+			{args: []string{"-sync", "sometimes"}},
+			{args: []string{"-sync", "-1s"}},
+			{args: []string{"-backpressure-soft-limit", "-1"}},
+			{args: []string{"-backpressure-delay", "-1ms"}},
+			{args: []string{"-compaction", "none", "-backpressure-hard-limit", "16"}},
+			{args: []string{"-compaction", "none"}, env: map[string]string{"DB_BACKPRESSURE_HARD_LIMIT": "4"}},
+			{args: []string{"-resp-port", "70000"}},
+			{args: []string{"-memcached-port", "-1"}},
+			{args: []string{"-memcached-port", "11211", "-tokens", "tokens.json"}},
+			{args: []string{"extra"}},
+			{env: map[string]string{"DB_RESP_PORT": "redis"}},
+			{env: map[string]string{"DB_SEGMENT_SIZE": "-5"}},
+		} {
+			if _, err := parseConfig(tc.args, env(tc.env)); err == nil {
+				t.Errorf("Expected %v %v to be rejected", tc.args, tc.env)
+			}
+		}
+	})
+}
@@ -1,83 +1,233 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/roman-mazur/design-practice-2-template/datastore"
 	"github.com/roman-mazur/design-practice-2-template/httptools"
 	"github.com/roman-mazur/design-practice-2-template/signal"
 )
 
-var port = flag.Int("port", 8083, "server port")
+func main() {
+	cfg, err := parseConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log.Printf("Configuration: %s", cfg)
 
-type Request struct {
-	Value string `json:"value"`
+	svc, err := start(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signal.WaitForTerminationSignal()
+	if err := svc.shutdown(cfg.ShutdownTimeout); err != nil {
+		log.Fatalf("Unclean shutdown: %s", err)
+	}
+	log.Println("Shut down cleanly")
 }
 
-type Response struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+// bulkTimeout is how long a client has to send a request, and /db/ and
+// /replication/ handlers to write a response, which can carry values of
+// -max-value-size.
+const bulkTimeout = time.Minute
+
+// service is a running db process.
+type service struct {
+	db       *datastore.Db
+	server   httptools.Server
+	resp     *RespServer
+	memcache *MemcacheServer
+	// stop ends the background work: following a leader and periodic syncs.
+	stop       context.CancelFunc
+	background sync.WaitGroup
 }
 
-func main() {
-	flag.Parse()
+func start(cfg *Config) (*service, error) {
+	var acl *ACL
+	if cfg.Tokens != "" {
+		var err error
+		if acl, err = LoadACL(cfg.Tokens); err != nil {
+			return nil, err
+		}
+	}
 
-	dir, err := ioutil.TempDir("", "temp-dir")
-	if err != nil {
-		log.Fatal(err)
+	dir := cfg.DataDir
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "temp-dir"); err != nil {
+			return nil, err
+		}
+		log.Printf("Storing data in the temporary directory %s", dir)
 	}
-	db, err := datastore.NewDb(dir, 250)
+	db, err := datastore.NewDb(dir, cfg.SegmentSize,
+		datastore.WithCompactionPolicy(cfg.Compaction),
+		datastore.WithSyncWrites(cfg.SyncWrites),
+		datastore.WithBackpressure(cfg.Backpressure))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer db.Close()
 
-	h := http.NewServeMux()
-
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		key := req.URL.Path[4:]
+	ctx, stop := context.WithCancel(context.Background())
+	s := &service{db: db, stop: stop}
+	if cfg.SyncInterval > 0 {
+		s.goBackground(func() { syncPeriodically(ctx, db, cfg.SyncInterval) })
+	}
 
-		switch req.Method {
-		case http.MethodGet:
-			value, err := db.Get(key)
-			if err != nil {
-				rw.WriteHeader(http.StatusNotFound)
-				return
-			}
+	var store versionedStore = db
+	metrics := NewMetrics(db)
+	h := http.NewServeMux()
+	// guard requires right on every key when tokens are configured.
+	guard := func(right string, handler http.Handler) http.Handler {
+		if acl == nil {
+			return handler
+		}
+		return acl.Require(right, handler)
+	}
+	h.Handle("/admin/", guard(writeRight, NewAdmin(db)))
+	h.Handle("/metrics", metrics)
+	h.Handle("/openapi.json", spec)
+	var source *ReplicationSource
+	if cfg.Follow != "" {
+		follower := NewFollower(cfg.Follow, db)
+		follower.Token = cfg.FollowToken
+		follower.MaxValueSize = cfg.MaxValueSize
+		follower.StateFile = filepath.Join(dir, followStateFile)
+		s.goBackground(func() { follower.Run(ctx) })
+		store = readOnlyStore{db}
+		h.Handle("/replication/", guard(readRight, follower))
+	} else {
+		source = NewReplicationSource(db)
+		h.Handle("/replication/", httptools.WriteTimeout(guard(readRight, source), bulkTimeout))
+	}
+	handler := NewHandler(store)
+	handler.MaxBodySize = cfg.MaxValueSize
+	// Values and snapshots can be large, watch and replication streams clear
+	// the write deadline.
+	if acl != nil {
+		h.Handle("/db/", httptools.WriteTimeout(acl.Authenticate(handler), bulkTimeout))
+	} else {
+		h.Handle("/db/", httptools.WriteTimeout(handler, bulkTimeout))
+	}
 
-			resp := Response{
-				Key:   key,
-				Value: value,
+	if cfg.RespPort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.RespPort))
+		if err != nil {
+			stop()
+			db.Close()
+			return nil, err
+		}
+		s.resp = NewRespServer(store)
+		s.resp.ACL = acl
+		go func() {
+			log.Printf("Serving the Redis protocol on %s", l.Addr())
+			if err := s.resp.Serve(l); err != nil {
+				log.Fatalf("RESP server finished: %s", err)
 			}
-			rw.Header().Set("Content-Type", "application/json")
-			rw.WriteHeader(http.StatusOK)
-			_ = json.NewEncoder(rw).Encode(resp)
-
-		case http.MethodPost:
-			var body Request
-			err := json.NewDecoder(req.Body).Decode(&body)
-			if err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				return
+		}()
+	}
+	if cfg.MemcachePort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.MemcachePort))
+		if err != nil {
+			if s.resp != nil {
+				s.resp.Close()
 			}
-
-			err = db.Put(key, body.Value)
-			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
+			stop()
+			db.Close()
+			return nil, err
+		}
+		s.memcache = NewMemcacheServer(store)
+		go func() {
+			log.Printf("Serving the memcached protocol on %s", l.Addr())
+			if err := s.memcache.Serve(l); err != nil {
+				log.Fatalf("memcached server finished: %s", err)
 			}
-			rw.WriteHeader(http.StatusCreated)
+		}()
+	}
 
-		default:
-			rw.WriteHeader(http.StatusBadRequest)
+	s.server = httptools.CreateServerAddr(cfg.Addr, metrics.Instrument(h),
+		// Only /db/ takes bodies of up to a value, the other endpoints none.
+		httptools.WithMaxBodySize(cfg.MaxValueSize),
+		httptools.WithReadTimeout(bulkTimeout),
+		httptools.WithWriteTimeout(10*time.Second))
+	s.server.RegisterOnShutdown(func() {
+		handler.CloseStreams()
+		if source != nil {
+			source.CloseStreams()
 		}
 	})
+	s.server.Start()
+	return s, nil
+}
 
-	server := httptools.CreateServer(*port, h)
-	server.Start()
-	signal.WaitForTerminationSignal()
+func (s *service) goBackground(f func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+}
+
+// shutdown stops the service without losing acknowledged writes. It stops
+// accepting connections, gives running requests up to timeout to finish,
+// stops the background work and closes the datastore, which waits for a
+// running merge and syncs the active segment.
+func (s *service) shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	log.Println("Draining running requests...")
+	if s.resp != nil {
+		if err := s.resp.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing the RESP listener: %w", err))
+		}
+	}
+	if s.memcache != nil {
+		if err := s.memcache.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing the memcached listener: %w", err))
+		}
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("draining HTTP requests: %w", err))
+	}
+
+	s.stop()
+	s.background.Wait()
+
+	log.Println("Closing the datastore...")
+	if err := s.db.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing the datastore: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// syncPeriodically bounds how many acknowledged writes a crash can lose when
+// writes are not synced one by one.
+func syncPeriodically(ctx context.Context, db *datastore.Db, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.Sync(); err != nil {
+				log.Printf("Failed to sync the datastore: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// expiries deletes keys of the RESP and memcached listeners once their time
+// to live runs out. An expiry remembers the version of the write that set it
+// and deletes the key only if it has not been written since, so a later write
+// through any frontend keeps the key. Expiries are kept in memory, so a
+// restart forgets them.
+//
+// expiries has its own lock: the store is never called with it held.
+type expiries struct {
+	store versionedStore
+	ctx   context.Context
+
+	lock    sync.Mutex
+	pending map[string]*expiry
+}
+
+// expiry is the pending expiry of a key written at version.
+type expiry struct {
+	timer   *time.Timer
+	version uint64
+}
+
+func newExpiries(ctx context.Context, store versionedStore) *expiries {
+	return &expiries{store: store, ctx: ctx, pending: make(map[string]*expiry)}
+}
+
+// set makes key expire after ttl. It is called after a write of value to
+// key, which the expiry is tied to; if key holds another value already, the
+// write has been replaced and nothing expires.
+func (e *expiries) set(key, value string, ttl time.Duration) {
+	version, ok := e.version(key, value)
+	if !ok {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if old, found := e.pending[key]; found {
+		if old.version > version {
+			// A newer write set its expiry first.
+			return
+		}
+		old.timer.Stop()
+	}
+	x := &expiry{version: version}
+	x.timer = time.AfterFunc(ttl, func() { e.expire(key, x) })
+	e.pending[key] = x
+}
+
+// renew moves the pending expiry of key to a write of value that keeps it,
+// such as an increment.
+func (e *expiries) renew(key, value string) {
+	e.lock.Lock()
+	_, found := e.pending[key]
+	e.lock.Unlock()
+	if !found {
+		return
+	}
+	version, ok := e.version(key, value)
+	if !ok {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if x, found := e.pending[key]; found && x.version < version {
+		x.version = version
+	}
+}
+
+// version returns the version of key if it holds value.
+func (e *expiries) version(key, value string) (uint64, bool) {
+	current, version, err := e.store.GetVersion(e.ctx, key)
+	if err != nil && err != datastore.ErrNotFound && e.ctx.Err() == nil {
+		log.Printf("Failed to read the version of %q for its expiry: %s", key, err)
+	}
+	return version, err == nil && current == value
+}
+
+func (e *expiries) expire(key string, x *expiry) {
+	e.lock.Lock()
+	if e.pending[key] != x {
+		// Replaced or stopped.
+		e.lock.Unlock()
+		return
+	}
+	delete(e.pending, key)
+	version := x.version
+	e.lock.Unlock()
+
+	err := e.store.CompareAndDelete(e.ctx, key, version)
+	switch {
+	case err == nil, err == datastore.ErrVersionMismatch, err == datastore.ErrNotFound:
+	case e.ctx.Err() == nil:
+		log.Printf("Failed to expire %q: %s", key, err)
+	}
+}
+
+// stop cancels the pending expiries.
+func (e *expiries) stop() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for key, x := range e.pending {
+		x.timer.Stop()
+		delete(e.pending, key)
+	}
+}
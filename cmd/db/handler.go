@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/httptools"
+	"github.com/roman-mazur/design-practice-2-template/openapi"
+)
+
+type Request struct {
+	Value string `json:"value"`
+	// Delta is the amount added by the increment operation, 1 if omitted.
+	Delta *int64 `json:"delta,omitempty"`
+}
+
+type Response struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// octetStream is the media type for raw values. JSON strings cannot carry
+// arbitrary bytes, so binary clients send and accept values in this form.
+const octetStream = "application/octet-stream"
+
+// retryAfterStall is the Retry-After value, in seconds, sent while writes are
+// stalled by compaction.
+const retryAfterStall = "1"
+
+// Handler serves the /db/<key> API on top of any datastore.Store.
+type Handler struct {
+	// MaxBodySize limits the size of request bodies, and so of values, with
+	// 413 for larger ones. 0 is no limit.
+	MaxBodySize int64
+
+	store datastore.Store
+	// bucket is the name of the bucket store is, empty for the default one.
+	bucket  string
+	streams *streams
+}
+
+func NewHandler(store datastore.Store) *Handler {
+	return &Handler{store: store, streams: newStreams()}
+}
+
+// CloseStreams ends the open watch streams, which never finish on their own,
+// so that a server shutdown does not wait for them.
+func (h *Handler) CloseStreams() {
+	h.streams.close()
+}
+
+// ErrorResponse is the body of every error response of the /db/ API. Code is
+// one of the code* constants and is meant for programs, Message for people.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists the fields of a request that do not match the API
+	// description.
+	Fields []openapi.FieldError `json:"fields,omitempty"`
+}
+
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidKey       = "invalid_key"
+	codeInvalidBucket    = "invalid_bucket"
+	codeNotFound         = "not_found"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeTooLarge         = "too_large"
+	codeRequestTimeout   = "request_timeout"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeNotInteger       = "not_integer"
+	codeOverflow         = "overflow"
+	codeReadOnly         = "read_only"
+	codeWatchExpired     = "watch_expired"
+	codeNotImplemented   = "not_implemented"
+	codeWriteStall       = "write_stall"
+	codeUnavailable      = "unavailable"
+	codeInternal         = "internal"
+)
+
+// keyMethods are the methods accepted on a single key.
+var keyMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete}
+
+// ServeHTTP serves keys of the default bucket at /db/<key> and keys of a named
+// bucket at /db/<bucket>/<key>. DELETE /db/<bucket>/ drops the whole bucket.
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if h.MaxBodySize > 0 {
+		if req.ContentLength > h.MaxBodySize {
+			writeError(rw, &http.MaxBytesError{Limit: h.MaxBodySize})
+			return
+		}
+		req.Body = http.MaxBytesReader(rw, req.Body, h.MaxBodySize)
+	}
+
+	key := strings.TrimPrefix(req.URL.Path, "/db/")
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		h.serve(rw, req, key)
+		return
+	}
+	name := key[:i]
+	bucket, err := datastore.NewBucket(h.store, name)
+	if err != nil {
+		writeErrorCode(rw, http.StatusBadRequest, codeInvalidBucket, err.Error())
+		return
+	}
+	key = key[i+1:]
+	if key == "" {
+		if req.Method != http.MethodDelete {
+			methodNotAllowed(rw, http.MethodDelete)
+			return
+		}
+		// Dropping a bucket writes every key in it.
+		if !h.authorize(rw, req, writeRight, name+"/") {
+			return
+		}
+		if err := bucket.Drop(); err != nil {
+			writeError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	(&Handler{store: bucket, bucket: name, streams: h.streams, MaxBodySize: h.MaxBodySize}).serve(rw, req, key)
+}
+
+func (h *Handler) serve(rw http.ResponseWriter, req *http.Request, key string) {
+	switch key {
+	case watchPath, scanPath:
+		if req.Method != http.MethodGet {
+			methodNotAllowed(rw, http.MethodGet)
+		} else if key == watchPath {
+			h.watch(rw, req)
+		} else {
+			h.scan(rw, req)
+		}
+		return
+	case mgetPath, mdeletePath:
+		if req.Method != http.MethodPost {
+			methodNotAllowed(rw, http.MethodPost)
+		} else if key == mgetPath {
+			h.getMany(rw, req)
+		} else {
+			h.deleteMany(rw, req)
+		}
+		return
+	}
+
+	// Operations are only requested with POST, other methods take colons in
+	// keys literally.
+	name, op, isOp := key, "", false
+	if req.Method == http.MethodPost {
+		name, op, isOp = splitOperation(key)
+	}
+	if err := checkKey(name); err != nil {
+		writeErrorCode(rw, http.StatusBadRequest, codeInvalidKey, err.Error())
+		return
+	}
+	right := writeRight
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		right = readRight
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+	default:
+		methodNotAllowed(rw, keyMethods...)
+		return
+	}
+	if !h.authorize(rw, req, right, name) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(rw, req, key)
+	case http.MethodPost:
+		if isOp {
+			h.update(rw, req, name, op)
+		} else {
+			h.put(rw, req, key, http.StatusCreated)
+		}
+	case http.MethodPut:
+		h.put(rw, req, key, http.StatusNoContent)
+	case http.MethodDelete:
+		h.delete(rw, req, key)
+	}
+}
+
+// reservedKeys are the paths of the batch, listing and watch requests, which
+// no key can take.
+var reservedKeys = map[string]bool{scanPath: true, watchPath: true, mgetPath: true, mdeletePath: true}
+
+// checkKey rejects keys the /db/ API cannot address. Slashes separate bucket
+// names from keys in paths and NUL bytes do so inside the store, HTTP
+// clients resolve . and .. segments and reserved keys name requests. The
+// dbclient package refuses the same keys.
+func checkKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("key is empty")
+	case strings.Contains(key, "/"):
+		return fmt.Errorf("key %q contains a slash", key)
+	case strings.Contains(key, "\x00"):
+		return fmt.Errorf("key %q contains a NUL byte", key)
+	case key == "." || key == "..":
+		return fmt.Errorf("key %q is a dot segment", key)
+	case reservedKeys[key]:
+		return fmt.Errorf("key %q is reserved", key)
+	}
+	return nil
+}
+
+// get also serves HEAD, which gets the headers of the same response. Raw
+// values of stores that are datastore.Streamer are streamed.
+func (h *Handler) get(rw http.ResponseWriter, req *http.Request, key string) {
+	if s, ok := h.store.(datastore.Streamer); ok && accepts(req, octetStream) {
+		h.stream(rw, req, s, key)
+		return
+	}
+
+	value, err := h.store.GetContext(req.Context(), key)
+	if err == datastore.ErrNotFound {
+		writeErrorCode(rw, http.StatusNotFound, codeNotFound, fmt.Sprintf("key %q not found", key))
+		return
+	} else if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	var body []byte
+	if accepts(req, octetStream) {
+		rw.Header().Set("Content-Type", octetStream)
+		body = []byte(value)
+	} else {
+		rw.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(Response{Key: key, Value: value})
+		body = append(body, '\n')
+	}
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		_, _ = rw.Write(body)
+	}
+}
+
+func (h *Handler) stream(rw http.ResponseWriter, req *http.Request, s datastore.Streamer, key string) {
+	value, size, err := s.GetReader(req.Context(), key)
+	if err == datastore.ErrNotFound {
+		writeErrorCode(rw, http.StatusNotFound, codeNotFound, fmt.Sprintf("key %q not found", key))
+		return
+	} else if err != nil {
+		writeError(rw, err)
+		return
+	}
+	defer value.Close()
+
+	rw.Header().Set("Content-Type", octetStream)
+	rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		_, _ = io.Copy(rw, value)
+	}
+}
+
+// put stores the request body at key, a JSON Request or raw bytes, and
+// answers with status: 201 for POST and 204 for PUT. Raw bodies, with a
+// Content-Length or chunked, are streamed to stores that are
+// datastore.Streamer.
+func (h *Handler) put(rw http.ResponseWriter, req *http.Request, key string, status int) {
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != octetStream {
+		var body Request
+		if !decode(rw, req, "putKey", &body) {
+			return
+		}
+		err = h.store.PutContext(req.Context(), key, body.Value)
+	} else if s, ok := h.store.(datastore.Streamer); ok {
+		err = s.PutReader(req.Context(), key, req.Body)
+	} else {
+		var data []byte
+		if data, err = io.ReadAll(req.Body); err == nil {
+			err = h.store.PutContext(req.Context(), key, string(data))
+		}
+	}
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(status)
+}
+
+// delete succeeds for missing keys too, deleting is idempotent.
+func (h *Handler) delete(rw http.ResponseWriter, req *http.Request, key string) {
+	if err := h.store.DeleteContext(req.Context(), key); err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// methodNotAllowed responds with 405 and the methods that are allowed.
+func methodNotAllowed(rw http.ResponseWriter, allowed ...string) {
+	rw.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeErrorCode(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, "allowed methods: "+strings.Join(allowed, ", "))
+}
+
+// writeErrorCode responds with status and an ErrorResponse body.
+func writeErrorCode(rw http.ResponseWriter, status int, code, message string) {
+	writeErrorResponse(rw, status, ErrorResponse{Code: code, Message: message})
+}
+
+func writeErrorResponse(rw http.ResponseWriter, status int, resp ErrorResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+// writeError responds with the status and code matching a failed store
+// operation.
+func writeError(rw http.ResponseWriter, err error) {
+	switch {
+	case isContextError(err):
+		writeErrorCode(rw, http.StatusServiceUnavailable, codeUnavailable, err.Error())
+	case errors.Is(err, datastore.ErrWriteStall):
+		rw.Header().Set("Retry-After", retryAfterStall)
+		writeErrorCode(rw, http.StatusServiceUnavailable, codeWriteStall, err.Error())
+	case errors.Is(err, datastore.ErrNotInteger):
+		writeErrorCode(rw, http.StatusConflict, codeNotInteger, err.Error())
+	case errors.Is(err, datastore.ErrOverflow):
+		writeErrorCode(rw, http.StatusConflict, codeOverflow, err.Error())
+	case errors.Is(err, ErrReadOnly):
+		writeErrorCode(rw, http.StatusForbidden, codeReadOnly, err.Error())
+	case errors.Is(err, datastore.ErrInvalidKey):
+		writeErrorCode(rw, http.StatusBadRequest, codeInvalidKey, err.Error())
+	case errors.Is(err, datastore.ErrValueTooLarge) || httptools.BodyErrorStatus(err) == http.StatusRequestEntityTooLarge:
+		writeErrorCode(rw, http.StatusRequestEntityTooLarge, codeTooLarge, err.Error())
+	case httptools.BodyErrorStatus(err) == http.StatusRequestTimeout:
+		writeErrorCode(rw, http.StatusRequestTimeout, codeRequestTimeout, err.Error())
+	default:
+		writeErrorCode(rw, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+// accepts reports whether the Accept header of req lists mediaType.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if t, _, err := mime.ParseMediaType(part); err == nil && t == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isContextError reports whether err comes from the request context. The
+// client has usually gone away by then, so the status only matters when a
+// server-side deadline ran out.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+type failingStore struct {
+	datastore.Store
+	err error
+}
+
+func (s failingStore) PutContext(context.Context, string, string) error { return s.err }
+
+func (s failingStore) GetContext(context.Context, string) (string, error) { return "", s.err }
+
+// errorCode decodes the ErrorResponse of a failed request.
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Bad error body: %s", err)
+	}
+	return resp.Code
+}
+
+func TestHandler(t *testing.T) {
+	store := datastore.NewMemStore()
+	h := NewHandler(store)
+
+	t.Run("Get Missing", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/missing", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", rec.Code)
+		}
+		if code := errorCode(t, rec); code != codeNotFound {
+			t.Errorf("Expected code %s, got %s", codeNotFound, code)
+		}
+	})
+
+	t.Run("Post Get", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/key1", strings.NewReader(`{"value":"value1"}`)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", rec.Code)
+		}
+		if value, _ := store.Get("key1"); value != "value1" {
+			t.Errorf("Unexpected stored value %q", value)
+		}
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/key1", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rec.Code)
+		}
+		var resp Response
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Key != "key1" || resp.Value != "value1" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("Octet Stream", func(t *testing.T) {
+		value := "\x00\xff\xc3\x28 raw"
+		req := httptest.NewRequest(http.MethodPost, "/db/binary", strings.NewReader(value))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", rec.Code)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/db/binary", nil)
+		req.Header.Set("Accept", "text/plain, application/octet-stream;q=0.9")
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/octet-stream" {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		if rec.Body.String() != value {
+			t.Errorf("Expected %q, got %q", value, rec.Body.String())
+		}
+	})
+
+	t.Run("Bad Body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/key1", strings.NewReader("{")))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Store Failure", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		NewHandler(failingStore{store, fmt.Errorf("disk is on fire")}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/key1", strings.NewReader(`{"value":"v"}`)))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Write Stall", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		NewHandler(failingStore{store, datastore.ErrWriteStall}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/key1", strings.NewReader(`{"value":"v"}`)))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503, got %d", rec.Code)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Error("Expected a Retry-After header")
+		}
+	})
+
+	t.Run("Cancelled Request", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/db/cancelled", strings.NewReader(`{"value":"v"}`)).WithContext(ctx)
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503, got %d", rec.Code)
+		}
+		if _, err := store.Get("cancelled"); err != datastore.ErrNotFound {
+			t.Errorf("Expected the cancelled write to be dropped, got %v", err)
+		}
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/key1", nil).WithContext(ctx))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 for a cancelled read, got %d", rec.Code)
+		}
+	})
+	t.Run("Put Head Delete", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/db/put", strings.NewReader(`{"value":"v1"}`)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", rec.Code)
+		}
+		if value, _ := store.Get("put"); value != "v1" {
+			t.Errorf("Unexpected stored value %q", value)
+		}
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/db/put", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rec.Code)
+		}
+		if rec.Header().Get("Content-Length") != "27" || rec.Body.Len() != 0 {
+			t.Errorf("Unexpected HEAD response: Content-Length %q, body %q", rec.Header().Get("Content-Length"), rec.Body.String())
+		}
+
+		for i := 0; i < 2; i++ {
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/db/put", nil))
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("Expected 204, got %d", rec.Code)
+			}
+		}
+		if _, err := store.Get("put"); err != datastore.ErrNotFound {
+			t.Errorf("Expected the key to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("Method Not Allowed", func(t *testing.T) {
+		for _, tc := range []struct {
+			method, path, allow string
+		}{
+			{http.MethodPatch, "/db/key1", "GET, HEAD, POST, PUT, DELETE"},
+			{http.MethodPost, "/db/_scan", "GET"},
+			{http.MethodDelete, "/db/_watch", "GET"},
+			{http.MethodGet, "/db/_mget", "POST"},
+			{http.MethodPut, "/db/team/_mdelete", "POST"},
+			{http.MethodGet, "/db/team/", "DELETE"},
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: expected 405, got %d", tc.method, tc.path, rec.Code)
+				continue
+			}
+			if allow := rec.Header().Get("Allow"); allow != tc.allow {
+				t.Errorf("%s %s: expected Allow %q, got %q", tc.method, tc.path, tc.allow, allow)
+			}
+			if code := errorCode(t, rec); code != codeMethodNotAllowed {
+				t.Errorf("%s %s: unexpected code %s", tc.method, tc.path, code)
+			}
+		}
+	})
+
+	t.Run("Invalid Keys", func(t *testing.T) {
+		for _, tc := range []struct {
+			method, path, body, code string
+		}{
+			{http.MethodGet, "/db/", "", codeInvalidKey},
+			{http.MethodPut, "/db/team/a/b", `{"value":"v"}`, codeInvalidKey},
+			{http.MethodPost, "/db/:increment", "", codeInvalidKey},
+			{http.MethodGet, "/db/key%00", "", codeInvalidKey},
+			{http.MethodPost, "/db/_mget", `{"keys":["ok",""]}`, codeInvalidKey},
+			{http.MethodPost, "/db/_mdelete", `{"keys":["a/b"]}`, codeInvalidKey},
+			{http.MethodPost, "/db/_scan:append", `{"value":"v"}`, codeInvalidKey},
+			{http.MethodPost, "/db/team/_watch:increment", "", codeInvalidKey},
+			{http.MethodPost, "/db/_mget", `{"keys":["_mdelete"]}`, codeInvalidKey},
+			{http.MethodPost, "/db/_mdelete", `{"keys":[".."]}`, codeInvalidKey},
+			{http.MethodGet, "/db/te%00am/key", "", codeInvalidBucket},
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s %s: expected 400, got %d", tc.method, tc.path, rec.Code)
+				continue
+			}
+			if code := errorCode(t, rec); code != tc.code {
+				t.Errorf("%s %s: expected code %s, got %s", tc.method, tc.path, tc.code, code)
+			}
+		}
+	})
+
+	t.Run("Get Failure", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		NewHandler(failingStore{store, fmt.Errorf("disk is on fire")}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/key1", nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500, got %d", rec.Code)
+		}
+		if code := errorCode(t, rec); code != codeInternal {
+			t.Errorf("Expected code %s, got %s", codeInternal, code)
+		}
+	})
+}
+
+func TestHandler_Streaming(t *testing.T) {
+	db := newMemDb(t)
+	h := NewHandler(db)
+	h.MaxBodySize = 1000
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	do := func(method, key string, body io.Reader, contentType string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/db/"+key, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Accept", octetStream)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	// chunked hides the length of the body, so it is sent chunked.
+	chunked := func(s string) io.Reader {
+		return io.MultiReader(strings.NewReader(s))
+	}
+	checkValue := func(key, expected string) {
+		t.Helper()
+		resp := do(http.MethodGet, key, nil, "")
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(data) != expected {
+			t.Errorf("Expected %d bytes at %s, got %d: %d bytes", len(expected), key, resp.StatusCode, len(data))
+		}
+		if length := resp.Header.Get("Content-Length"); length != fmt.Sprint(len(expected)) {
+			t.Errorf("Expected Content-Length %d, got %q", len(expected), length)
+		}
+	}
+	tooLarge := func(resp *http.Response) {
+		t.Helper()
+		var body ErrorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || body.Code != codeTooLarge {
+			t.Errorf("Expected 413 %s, got %d %+v", codeTooLarge, resp.StatusCode, body)
+		}
+	}
+
+	value := strings.Repeat("\x00\xff", 400)
+	t.Run("Content Length", func(t *testing.T) {
+		if resp := do(http.MethodPut, "sized", strings.NewReader(value), octetStream); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", resp.StatusCode)
+		}
+		checkValue("sized", value)
+
+		resp := do(http.MethodHead, "sized", nil, "")
+		if resp.Header.Get("Content-Length") != "800" {
+			t.Errorf("Unexpected HEAD Content-Length %q", resp.Header.Get("Content-Length"))
+		}
+	})
+
+	t.Run("Chunked", func(t *testing.T) {
+		if resp := do(http.MethodPost, "chunked", chunked(value), octetStream); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", resp.StatusCode)
+		}
+		checkValue("chunked", value)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		large := strings.Repeat("x", 1001)
+		tooLarge(do(http.MethodPut, "sized", strings.NewReader(large), octetStream))
+		tooLarge(do(http.MethodPut, "chunked", chunked(large), octetStream))
+		tooLarge(do(http.MethodPut, "json", strings.NewReader(`{"value":"`+large+`"}`), "application/json"))
+		checkValue("sized", value)
+		checkValue("chunked", value)
+
+		// Exactly at the limit is fine.
+		if resp := do(http.MethodPut, "sized", chunked(large[1:]), octetStream); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected a value at the limit to be stored, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Read Only", func(t *testing.T) {
+		h := NewHandler(readOnlyStore{db})
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/db/sized", strings.NewReader("v"))
+		req.Header.Set("Content-Type", octetStream)
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/db/chunked", nil)
+		req.Header.Set("Accept", octetStream)
+		h.ServeHTTP(rec, req)
+		if rec.Body.String() != value {
+			t.Errorf("Unexpected streamed value of %d bytes", rec.Body.Len())
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// connServer accepts connections and keeps track of them, so that a shutdown
+// can close them all. The RESP and memcached listeners build on it.
+type connServer struct {
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	serving  sync.WaitGroup
+}
+
+func newConnServer() connServer {
+	return connServer{conns: make(map[net.Conn]bool)}
+}
+
+// serve accepts connections on l and runs handle for each of them until shut
+// is called, which makes it return nil. The connection is closed once handle
+// returns.
+func (s *connServer) serve(l net.Listener, handle func(conn net.Conn)) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = true
+		s.serving.Add(1)
+		s.lock.Unlock()
+		go func() {
+			defer func() {
+				conn.Close()
+				s.lock.Lock()
+				delete(s.conns, conn)
+				s.lock.Unlock()
+				s.serving.Done()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// shut stops accepting connections and closes the open ones. It must be
+// called with lock held.
+func (s *connServer) shut() error {
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
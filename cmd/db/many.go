@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Batch operations live under reserved keys: POST /db/_mget and
+// POST /db/_mdelete.
+const (
+	mgetPath    = "_mget"
+	mdeletePath = "_mdelete"
+)
+
+type ManyRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type ManyResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+func (h *Handler) getMany(rw http.ResponseWriter, req *http.Request) {
+	var body ManyRequest
+	if !decode(rw, req, "getMany", &body) {
+		return
+	}
+	if !checkKeys(rw, body.Keys) || !h.authorize(rw, req, readRight, body.Keys...) {
+		return
+	}
+
+	values, missing, err := h.store.GetManyContext(req.Context(), body.Keys)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(ManyResponse{Values: values, Missing: missing})
+}
+
+func (h *Handler) deleteMany(rw http.ResponseWriter, req *http.Request) {
+	var body ManyRequest
+	if !decode(rw, req, "deleteMany", &body) {
+		return
+	}
+	if !checkKeys(rw, body.Keys) || !h.authorize(rw, req, writeRight, body.Keys...) {
+		return
+	}
+
+	if err := h.store.DeleteManyContext(req.Context(), body.Keys); err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// checkKeys rejects a batch with a key the /db/ API cannot address.
+func checkKeys(rw http.ResponseWriter, keys []string) bool {
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			writeErrorCode(rw, http.StatusBadRequest, codeInvalidKey, err.Error())
+			return false
+		}
+	}
+	return true
+}
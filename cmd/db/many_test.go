@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestMany(t *testing.T) {
+	store := datastore.NewMemStore()
+	store.Put("key1", "value1")
+	store.Put("key2", "value2")
+	h := NewHandler(store)
+
+	mget := func(t *testing.T, body string) ManyResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_mget", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rec.Code)
+		}
+		var resp ManyResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := mget(t, `{"keys":["key1","key2","missing"]}`)
+	if expected := map[string]string{"key1": "value1", "key2": "value2"}; !reflect.DeepEqual(resp.Values, expected) {
+		t.Errorf("Unexpected values %v", resp.Values)
+	}
+	if expected := []string{"missing"}; !reflect.DeepEqual(resp.Missing, expected) {
+		t.Errorf("Unexpected missing keys %v", resp.Missing)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_mdelete", strings.NewReader(`{"keys":["key1","missing"]}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+	resp = mget(t, `{"keys":["key1","key2"]}`)
+	if expected := map[string]string{"key2": "value2"}; !reflect.DeepEqual(resp.Values, expected) {
+		t.Errorf("Unexpected values after delete %v", resp.Values)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_mget", strings.NewReader(`{"keys":`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad body, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const (
+	// maxItemSize is the largest value a memcached client can store, the
+	// default item size limit of memcached.
+	maxItemSize = 1 << 20
+	// maxKeyLength is the memcached key length limit.
+	maxKeyLength = 250
+	// relativeExptimeLimit is the largest exptime taken as a number of
+	// seconds; larger ones are Unix times.
+	relativeExptimeLimit = 60 * 60 * 24 * 30
+)
+
+// versionedStore is a Store that can compare-and-swap, as the memcached cas
+// command needs.
+type versionedStore interface {
+	datastore.Store
+	datastore.Versioner
+}
+
+// MemcacheServer speaks the memcached text protocol on top of a store:
+// get, gets, set, add, replace, cas, delete, incr, decr, version and quit.
+// cas unique values are datastore versions. Flags are accepted but not
+// stored, so items always come back with flags 0. Expiry is kept in memory
+// and tied to the version of the write that set it, see expiries. The text
+// protocol has no authentication, so the listener cannot be enabled together
+// with -tokens.
+type MemcacheServer struct {
+	connServer
+	store    versionedStore
+	ctx      context.Context
+	cancel   context.CancelFunc
+	expiries *expiries
+}
+
+func NewMemcacheServer(store versionedStore) *MemcacheServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MemcacheServer{
+		connServer: newConnServer(),
+		store:      store,
+		ctx:        ctx,
+		cancel:     cancel,
+		expiries:   newExpiries(ctx, store),
+	}
+}
+
+// Serve accepts connections on l until Close is called, which makes it
+// return nil.
+func (s *MemcacheServer) Serve(l net.Listener) error {
+	return s.serve(l, s.serveConn)
+}
+
+// Close stops accepting connections, closes the open ones and cancels the
+// pending expiries. It returns once the commands that were running are done.
+func (s *MemcacheServer) Close() error {
+	s.lock.Lock()
+	s.cancel()
+	err := s.shut()
+	s.lock.Unlock()
+	s.expiries.stop()
+
+	s.serving.Wait()
+	return err
+}
+
+// memcacheConn is the state of one client connection.
+type memcacheConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+	// noreply is set for a command that ends with noreply, whose replies
+	// are then dropped.
+	noreply bool
+}
+
+func (c *memcacheConn) reply(s string) {
+	if !c.noreply {
+		c.w.WriteString(s + "\r\n")
+	}
+}
+
+func (c *memcacheConn) clientError(msg string) { c.reply("CLIENT_ERROR " + msg) }
+
+func (c *memcacheConn) storeError(err error) {
+	c.reply("SERVER_ERROR " + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error()))
+}
+
+func (s *MemcacheServer) serveConn(conn net.Conn) {
+	c := &memcacheConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	for {
+		line, err := readLine(c.r)
+		if errors.Is(err, errProtocol) {
+			c.w.WriteString("CLIENT_ERROR line too long\r\n")
+			c.w.Flush()
+			return
+		} else if err != nil {
+			if err != io.EOF && s.ctx.Err() == nil {
+				log.Printf("memcached connection %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		args := strings.Fields(line)
+		// Retrievals have no noreply form.
+		c.noreply = len(args) > 2 && args[0] != "get" && args[0] != "gets" && args[len(args)-1] == "noreply"
+		if c.noreply {
+			args = args[:len(args)-1]
+		}
+		if err := s.exec(c, args); err != nil {
+			if errors.Is(err, errProtocol) {
+				c.w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+				c.w.Flush()
+			}
+			return
+		}
+		// Pipelined commands are answered together.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// exec runs a command. An error means the connection has to be closed.
+func (s *MemcacheServer) exec(c *memcacheConn, args []string) error {
+	if len(args) == 0 {
+		c.reply("ERROR")
+		return nil
+	}
+	name := args[0]
+	switch name {
+	case "get", "gets":
+		if len(args) < 2 {
+			c.reply("ERROR")
+			return nil
+		}
+		if !checkMemcacheKeys(c, args[1:]) {
+			return nil
+		}
+		s.get(c, args[1:], name == "gets")
+	case "set", "add", "replace", "cas":
+		return s.storage(c, name, args)
+	case "delete":
+		// A zero time is still accepted for old clients.
+		if (len(args) != 2 && !(len(args) == 3 && args[2] == "0")) || !checkMemcacheKeys(c, args[1:2]) {
+			c.reply("ERROR")
+			return nil
+		}
+		s.delete(c, args[1])
+	case "incr", "decr":
+		if len(args) != 3 {
+			c.reply("ERROR")
+			return nil
+		}
+		if !checkMemcacheKeys(c, args[1:2]) {
+			return nil
+		}
+		s.incr(c, args[1], args[2], name == "decr")
+	case "version":
+		c.reply("VERSION db")
+	case "quit":
+		return io.EOF
+	default:
+		c.reply("ERROR")
+	}
+	return nil
+}
+
+// checkMemcacheKeys rejects keys memcached would not take. NUL bytes, which
+// separate bucket names from keys inside the store, are control characters.
+func checkMemcacheKeys(c *memcacheConn, keys []string) bool {
+	for _, key := range keys {
+		if len(key) > maxKeyLength {
+			c.clientError("bad command line format")
+			return false
+		}
+		for i := 0; i < len(key); i++ {
+			if key[i] < ' ' || key[i] == 0x7f {
+				c.clientError("bad command line format")
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *MemcacheServer) get(c *memcacheConn, keys []string, withCas bool) {
+	for _, key := range keys {
+		value, version, err := s.store.GetVersion(s.ctx, key)
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			c.storeError(err)
+			return
+		}
+		if withCas {
+			c.reply(fmt.Sprintf("VALUE %s 0 %d %d", key, len(value), version))
+		} else {
+			c.reply(fmt.Sprintf("VALUE %s 0 %d", key, len(value)))
+		}
+		c.reply(value)
+	}
+	c.reply("END")
+}
+
+// storage implements the storage commands:
+//
+//	<command> <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//
+// followed by a data block of <bytes> bytes.
+func (s *MemcacheServer) storage(c *memcacheConn, name string, args []string) error {
+	expected := 5
+	if name == "cas" {
+		expected = 6
+	}
+	if len(args) != expected {
+		c.reply("ERROR")
+		return nil
+	}
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 {
+		c.clientError("bad command line format")
+		return nil
+	}
+	// The data block follows even if the command line is bad.
+	if size > maxItemSize {
+		if _, err := io.CopyN(io.Discard, c.r, int64(size)+2); err != nil {
+			return err
+		}
+		c.reply("SERVER_ERROR object too large for cache")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		return errProtocol
+	}
+	value := string(data[:size])
+
+	key := args[1]
+	_, flagsErr := strconv.ParseUint(args[2], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[3], 10, 64)
+	var version uint64
+	if name == "cas" {
+		version, err = strconv.ParseUint(args[5], 10, 64)
+	}
+	if flagsErr != nil || exptimeErr != nil || err != nil {
+		c.clientError("bad command line format")
+		return nil
+	}
+	if !checkMemcacheKeys(c, args[1:2]) {
+		return nil
+	}
+
+	switch name {
+	case "set":
+		err = s.store.PutContext(s.ctx, key, value)
+	case "add":
+		var loaded bool
+		if _, loaded, err = s.store.GetOrSetContext(s.ctx, key, value); err == nil && loaded {
+			c.reply("NOT_STORED")
+			return nil
+		}
+	case "replace":
+		err = s.swap(key, func(string) (string, error) { return value, nil })
+		if err == datastore.ErrNotFound {
+			c.reply("NOT_STORED")
+			return nil
+		}
+	case "cas":
+		err = s.store.CompareAndSwap(s.ctx, key, value, version)
+		switch err {
+		case datastore.ErrVersionMismatch:
+			c.reply("EXISTS")
+			return nil
+		case datastore.ErrNotFound:
+			c.reply("NOT_FOUND")
+			return nil
+		}
+	}
+	if err != nil {
+		c.storeError(err)
+		return nil
+	}
+	if err := s.expire(key, value, exptime); err != nil {
+		c.storeError(err)
+		return nil
+	}
+	c.reply("STORED")
+	return nil
+}
+
+// swap replaces the value of an existing key with the result of fn, retrying
+// when another write gets in between.
+func (s *MemcacheServer) swap(key string, fn func(value string) (string, error)) error {
+	for {
+		value, version, err := s.store.GetVersion(s.ctx, key)
+		if err != nil {
+			return err
+		}
+		if value, err = fn(value); err != nil {
+			return err
+		}
+		if err := s.store.CompareAndSwap(s.ctx, key, value, version); err != datastore.ErrVersionMismatch {
+			return err
+		}
+	}
+}
+
+// expire sets the expiry of a key that was just stored with value. A zero
+// exptime keeps the key, a negative one or a Unix time in the past deletes it
+// right away. The write outdates any earlier expiry.
+func (s *MemcacheServer) expire(key, value string, exptime int64) error {
+	if exptime == 0 {
+		return nil
+	}
+	var ttl time.Duration
+	if exptime > relativeExptimeLimit {
+		ttl = time.Until(time.Unix(exptime, 0))
+	} else if exptime > 0 {
+		ttl = time.Duration(exptime) * time.Second
+	}
+	if ttl <= 0 {
+		return s.store.DeleteContext(s.ctx, key)
+	}
+	s.expiries.set(key, value, ttl)
+	return nil
+}
+
+func (s *MemcacheServer) delete(c *memcacheConn, key string) {
+	if _, err := s.store.GetContext(s.ctx, key); err == datastore.ErrNotFound {
+		c.reply("NOT_FOUND")
+		return
+	} else if err != nil {
+		c.storeError(err)
+		return
+	}
+	if err := s.store.DeleteContext(s.ctx, key); err != nil {
+		c.storeError(err)
+		return
+	}
+	c.reply("DELETED")
+}
+
+// errNotNumeric is the incr and decr error for values that are not unsigned
+// 64-bit integers.
+var errNotNumeric = errors.New("cannot increment or decrement non-numeric value")
+
+// incr implements incr and decr with memcached semantics: values are
+// unsigned 64-bit integers, incr wraps around and decr stops at 0. Unlike
+// stores, they keep the expiry of the key.
+func (s *MemcacheServer) incr(c *memcacheConn, key, deltaArg string, decr bool) {
+	delta, err := strconv.ParseUint(deltaArg, 10, 64)
+	if err != nil {
+		c.clientError("invalid numeric delta argument")
+		return
+	}
+
+	var result uint64
+	err = s.swap(key, func(value string) (string, error) {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "", errNotNumeric
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = n
+		return strconv.FormatUint(n, 10), nil
+	})
+	switch {
+	case err == datastore.ErrNotFound:
+		c.reply("NOT_FOUND")
+	case err == errNotNumeric:
+		c.clientError(err.Error())
+	case err != nil:
+		c.storeError(err)
+	default:
+		s.expiries.renew(key, strconv.FormatUint(result, 10))
+		c.reply(strconv.FormatUint(result, 10))
+	}
+}
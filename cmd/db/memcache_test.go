@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// memcacheClient sends raw memcached text protocol requests.
+type memcacheClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startMemcache(t *testing.T, store versionedStore) *memcacheClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemcacheServer(store)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve failed: %s", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &memcacheClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *memcacheClient) readLine() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Cannot read a reply: %s", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// expect sends request and checks the next reply lines.
+func (c *memcacheClient) expect(request string, expected ...string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, request); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, line := range expected {
+		if got := c.readLine(); got != line {
+			c.t.Errorf("%q: expected %q, got %q", request, line, got)
+		}
+	}
+}
+
+// cas returns the cas unique of key.
+func (c *memcacheClient) cas(key string) string {
+	c.t.Helper()
+	io.WriteString(c.conn, "gets "+key+"\r\n")
+	fields := strings.Fields(c.readLine())
+	if len(fields) != 5 || fields[0] != "VALUE" {
+		c.t.Fatalf("Unexpected gets reply %q", fields)
+	}
+	c.readLine()
+	c.expect("", "END")
+	return fields[4]
+}
+
+func TestMemcacheServer(t *testing.T) {
+	db := newMemDb(t)
+	c := startMemcache(t, db)
+
+	t.Run("Get Set", func(t *testing.T) {
+		c.expect("get k1\r\n", "END")
+		c.expect("set k1 0 0 2\r\nv1\r\n", "STORED")
+		c.expect("set bin 5 0 4\r\n\x00\r\n\xff\r\n", "STORED")
+		c.expect("get k1 missing bin\r\n", "VALUE k1 0 2", "v1", "VALUE bin 0 4", "\x00", "\xff", "END")
+		if value, _ := db.Get("k1"); value != "v1" {
+			t.Errorf("Value not stored in the db: %q", value)
+		}
+		_, version, _ := db.GetVersion(context.Background(), "k1")
+		c.expect("gets k1\r\n", fmt.Sprintf("VALUE k1 0 2 %d", version), "v1", "END")
+	})
+
+	t.Run("Add Replace", func(t *testing.T) {
+		c.expect("add k1 0 0 1\r\nx\r\n", "NOT_STORED")
+		c.expect("add new 0 0 1\r\nx\r\n", "STORED")
+		c.expect("replace missing 0 0 1\r\ny\r\n", "NOT_STORED")
+		c.expect("replace new 0 0 1\r\ny\r\n", "STORED")
+		c.expect("get new\r\n", "VALUE new 0 1", "y", "END")
+	})
+
+	t.Run("Cas", func(t *testing.T) {
+		unique := c.cas("k1")
+		c.expect("cas k1 0 0 2 "+unique+"\r\nv2\r\n", "STORED")
+		c.expect("cas k1 0 0 2 "+unique+"\r\nv3\r\n", "EXISTS")
+		c.expect("cas missing 0 0 2 "+unique+"\r\nv3\r\n", "NOT_FOUND")
+
+		// Writes from other frontends change the cas unique too.
+		unique = c.cas("k1")
+		db.Put("k1", "http")
+		c.expect("cas k1 0 0 2 "+unique+"\r\nv4\r\n", "EXISTS")
+		c.expect("get k1\r\n", "VALUE k1 0 4", "http", "END")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		c.expect("delete new\r\n", "DELETED")
+		c.expect("delete new\r\n", "NOT_FOUND")
+		c.expect("delete k1 0\r\n", "DELETED")
+	})
+
+	t.Run("Incr Decr", func(t *testing.T) {
+		c.expect("incr counter 1\r\n", "NOT_FOUND")
+		c.expect("set counter 0 0 2\r\n10\r\n", "STORED")
+		c.expect("incr counter 5\r\n", "15")
+		c.expect("decr counter 20\r\n", "0")
+		c.expect("set counter 0 0 20\r\n18446744073709551615\r\n", "STORED")
+		c.expect("incr counter 2\r\n", "1")
+		c.expect("incr bin 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+		c.expect("incr counter x\r\n", "CLIENT_ERROR invalid numeric delta argument")
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		c.expect("set temp 0 1 1\r\nv\r\n", "STORED")
+		c.expect("set kept 0 1 1\r\nv\r\n", "STORED")
+		c.expect("set kept 0 0 1\r\nw\r\n", "STORED")
+		// A write through another frontend outdates the expiry too.
+		c.expect("set other 0 1 1\r\nv\r\n", "STORED")
+		db.Put("other", "http")
+		c.expect("set n 0 1 1\r\n1\r\n", "STORED")
+		c.expect("incr n 1\r\n", "2")
+		c.expect("set gone 0 -1 1\r\nv\r\n", "STORED")
+		c.expect("get gone\r\n", "END")
+		c.expect(fmt.Sprintf("set past 0 %d 1\r\nv\r\n", time.Now().Add(-time.Hour).Unix()), "STORED")
+		c.expect("get past\r\n", "END")
+		eventually(t, "temp to expire", func() bool {
+			_, err := db.Get("temp")
+			return err == datastore.ErrNotFound
+		})
+		eventually(t, "the incremented value to expire", func() bool {
+			_, err := db.Get("n")
+			return err == datastore.ErrNotFound
+		})
+		c.expect("get kept other\r\n", "VALUE kept 0 1", "w", "VALUE other 0 4", "http", "END")
+	})
+
+	t.Run("Noreply and Pipelining", func(t *testing.T) {
+		c.expect("set quiet 0 0 1 noreply\r\nq\r\nincr missing 1 noreply\r\ndelete nothing noreply\r\nget quiet\r\nversion\r\n",
+			"VALUE quiet 0 1", "q", "END", "VERSION db")
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		c.expect("flush_all\r\n", "ERROR")
+		c.expect("get\r\n", "ERROR")
+		c.expect("set k 0 0\r\n", "ERROR")
+		c.expect("set k x 0 1\r\nv\r\n", "CLIENT_ERROR bad command line format")
+		c.expect("set "+strings.Repeat("k", 251)+" 0 0 1\r\nv\r\n", "CLIENT_ERROR bad command line format")
+		c.expect("get k\x01\r\n", "CLIENT_ERROR bad command line format")
+		c.expect(fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", maxItemSize+1, strings.Repeat("b", maxItemSize+1)), "SERVER_ERROR object too large for cache")
+		c.expect("get big\r\n", "END")
+
+		c.expect("set k 0 0 1\r\ntoo long\r\n", "CLIENT_ERROR bad data chunk")
+		if _, err := c.r.ReadByte(); err != io.EOF {
+			t.Errorf("Expected the connection to be closed, got %v", err)
+		}
+	})
+}
+
+func TestMemcacheServer_ReadOnly(t *testing.T) {
+	db := newMemDb(t)
+	db.Put("key", "1")
+	c := startMemcache(t, readOnlyStore{db})
+	c.expect("get key\r\n", "VALUE key 0 1", "1", "END")
+	c.expect("set key 0 0 1\r\nv\r\n", "SERVER_ERROR "+ErrReadOnly.Error())
+	c.expect("incr key 1\r\n", "SERVER_ERROR "+ErrReadOnly.Error())
+	if _, err := strconv.ParseUint(c.cas("key"), 10, 64); err != nil {
+		t.Errorf("Expected a numeric cas unique: %s", err)
+	}
+}
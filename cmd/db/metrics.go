@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/metrics"
+)
+
+// StatsStore is the part of the datastore the metrics read.
+type StatsStore interface {
+	Stats() datastore.Stats
+}
+
+// Metrics serves GET /metrics in the Prometheus text format: the HTTP
+// requests seen by Instrument and the datastore state taken from Stats on
+// every scrape.
+type Metrics struct {
+	registry *metrics.Registry
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+}
+
+func NewMetrics(db StatsStore) *Metrics {
+	r := metrics.NewRegistry()
+	m := &Metrics{
+		registry: r,
+		requests: r.NewCounterVec("db_http_requests_total", "HTTP requests by method and status.", "method", "status"),
+		latency:  r.NewHistogramVec("db_http_request_duration_seconds", "HTTP request latency by method and status.", metrics.DefaultBuckets, "method", "status"),
+	}
+	r.Collect(func(w *metrics.Writer) { writeStats(w, db.Stats()) })
+	return m
+}
+
+func writeStats(w *metrics.Writer, s datastore.Stats) {
+	w.Gauge("db_keys", "Live keys.", float64(s.Keys))
+	w.Gauge("db_segments", "Segment files, the active one included.", float64(s.SegmentCount))
+	w.Gauge("db_stored_bytes", "Size of all segment files.", float64(s.TotalBytes))
+	w.Gauge("db_dead_bytes", "Bytes a merge would reclaim.", float64(s.DeadBytes))
+	w.Counter("db_gets_total", "Keys looked up by reads, by whether they were found.", float64(s.GetHits), "result", "hit")
+	w.Counter("db_gets_total", "", float64(s.GetMisses), "result", "miss")
+	w.Counter("db_written_bytes_total", "Bytes appended by writes, merges not included.", float64(s.BytesWritten))
+	w.Counter("db_compactions_total", "Merge runs, failed ones included.", float64(s.Merges))
+	w.Counter("db_compaction_errors_total", "Failed merge runs.", float64(s.MergeErrors))
+	w.Counter("db_compaction_duration_seconds_total", "Time spent merging.", s.MergeDuration.Seconds())
+	w.Gauge("db_last_compaction_duration_seconds", "Duration of the last merge run.", s.LastMergeDuration.Seconds())
+	w.Counter("db_delayed_writes_total", "Writes slowed down by backpressure.", float64(s.DelayedWrites))
+	w.Counter("db_stalled_writes_total", "Writes that waited for a merge.", float64(s.StalledWrites))
+
+	names := make([]string, 0, len(s.Buckets))
+	for name := range s.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.Gauge("db_bucket_keys", "Live keys by bucket.", float64(s.Buckets[name].Keys), "bucket", name)
+	}
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	m.registry.ServeHTTP(rw, req)
+}
+
+// Instrument records the count and latency of the requests served by h.
+func (m *Metrics) Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+		rec := &statusRecorder{ResponseWriter: rw}
+		h.ServeHTTP(rec, req)
+
+		method := req.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+		default:
+			// Arbitrary methods would make arbitrary many series.
+			method = "other"
+		}
+		status := strconv.Itoa(rec.status())
+		m.requests.Inc(method, status)
+		m.latency.Observe(time.Since(started).Seconds(), method, status)
+	})
+}
+
+// statusRecorder remembers the response status. Unwrap keeps
+// http.ResponseController working for streaming handlers.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestMetrics(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m := NewMetrics(db)
+	mux := http.NewServeMux()
+	mux.Handle("/db/", NewHandler(db))
+	mux.Handle("/metrics", m)
+	h := m.Instrument(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	do(http.MethodPost, "/db/key", `{"value":"value"}`)
+	do(http.MethodGet, "/db/key", "")
+	do(http.MethodGet, "/db/missing", "")
+	do("PATCH", "/db/key", "")
+
+	rec := do(http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`db_http_requests_total{method="POST",status="201"} 1`,
+		`db_http_requests_total{method="GET",status="200"} 1`,
+		`db_http_requests_total{method="GET",status="404"} 1`,
+		`db_http_requests_total{method="other",status="405"} 1`,
+		`db_http_request_duration_seconds_count{method="GET",status="404"} 1`,
+		`db_keys 1`,
+		`db_segments 1`,
+		`db_gets_total{result="hit"} 1`,
+		`db_gets_total{result="miss"} 1`,
+		`db_compactions_total 0`,
+		"# TYPE db_http_request_duration_seconds histogram",
+		"# TYPE db_written_bytes_total counter",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/roman-mazur/design-practice-2-template/httptools"
+	"github.com/roman-mazur/design-practice-2-template/openapi"
+)
+
+// spec describes the /db/ API and is served at /openapi.json. The handlers
+// check request bodies and query parameters against it.
+var spec = newSpec()
+
+func newSpec() *openapi.Document {
+	zero := 0.0
+	str := func(description string) *openapi.Schema {
+		return &openapi.Schema{Type: "string", Description: description}
+	}
+	errorResponse := &openapi.Response{Description: "The request failed.", Content: openapi.JSON(openapi.Ref("Error"))}
+	responses := func(ok map[string]*openapi.Response, errorStatuses ...string) map[string]*openapi.Response {
+		for _, status := range append([]string{"400", "401", "403", "500", "503"}, errorStatuses...) {
+			ok[status] = errorResponse
+		}
+		return ok
+	}
+	entry := &openapi.Response{Description: "The key and its value.", Content: openapi.JSON(openapi.Ref("Entry"))}
+	value := &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+		"application/json": {Schema: openapi.Ref("Value")},
+		octetStream:        {Schema: &openapi.Schema{Type: "string", Format: "binary"}},
+	}}
+	update := &openapi.RequestBody{Content: openapi.JSON(openapi.Ref("Update"))}
+	many := &openapi.RequestBody{Required: true, Content: openapi.JSON(openapi.Ref("ManyRequest"))}
+	query := func(name, description string, schema *openapi.Schema) openapi.Parameter {
+		return openapi.Parameter{Name: name, In: "query", Description: description, Schema: schema}
+	}
+
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:   "db",
+			Version: "1",
+			Description: "Key-value API of the datastore. Keys live in the default bucket at /db/{key} " +
+				"or in a named bucket at /db/{bucket}/{key}; both take the same requests.",
+		},
+		Paths: make(map[string]*openapi.PathItem),
+		Components: openapi.Components{Schemas: map[string]*openapi.Schema{
+			"Value": {
+				Type:       "object",
+				Properties: map[string]*openapi.Schema{"value": str("")},
+				Required:   []string{"value"},
+				Closed:     true,
+				Example:    map[string]string{"value": "41"},
+			},
+			"Update": {
+				Type:        "object",
+				Description: "delta is added by increment, 1 if omitted; value is appended by append and stored by getOrSet if the key is missing.",
+				Properties: map[string]*openapi.Schema{
+					"value": str(""),
+					"delta": {Type: "integer", Format: "int64"},
+				},
+				Closed:  true,
+				Example: map[string]int{"delta": 1},
+			},
+			"Entry": {
+				Type:       "object",
+				Properties: map[string]*openapi.Schema{"key": str(""), "value": str("")},
+				Required:   []string{"key", "value"},
+			},
+			"ManyRequest": {
+				Type:       "object",
+				Properties: map[string]*openapi.Schema{"keys": {Type: "array", Items: str("")}},
+				Required:   []string{"keys"},
+				Closed:     true,
+				Example:    map[string][]string{"keys": {"counter", "missing"}},
+			},
+			"ManyResponse": {
+				Type: "object",
+				Properties: map[string]*openapi.Schema{
+					"values":  {Type: "object", AdditionalProperties: str("")},
+					"missing": {Type: "array", Items: str("")},
+				},
+				Required: []string{"values", "missing"},
+			},
+			"ScanResponse": {
+				Type:       "object",
+				Properties: map[string]*openapi.Schema{"entries": {Type: "array", Items: openapi.Ref("Entry")}},
+				Required:   []string{"entries"},
+			},
+			"Error": {
+				Type: "object",
+				Properties: map[string]*openapi.Schema{
+					"code":    str("Stable error code, such as not_found, meant for programs."),
+					"message": str(""),
+					"fields": {Type: "array", Items: &openapi.Schema{
+						Type:       "object",
+						Properties: map[string]*openapi.Schema{"field": str(""), "message": str("")},
+						Required:   []string{"field", "message"},
+					}},
+				},
+				Required: []string{"code", "message"},
+			},
+		}},
+	}
+
+	for _, variant := range []struct{ path, suffix string }{{"/db", ""}, {"/db/{bucket}", "InBucket"}} {
+		var params []openapi.Parameter
+		if variant.suffix != "" {
+			params = append(params, openapi.Parameter{Name: "bucket", In: "path", Required: true, Schema: &openapi.Schema{Type: "string", Example: "team"}})
+		}
+		keyParams := append(params[:len(params):len(params)],
+			openapi.Parameter{Name: "key", In: "path", Required: true, Schema: &openapi.Schema{Type: "string", Example: "counter"}})
+		op := func(id, summary string, params []openapi.Parameter, body *openapi.RequestBody, responses map[string]*openapi.Response) *openapi.Operation {
+			if body != nil {
+				responses["408"], responses["413"] = errorResponse, errorResponse
+			}
+			return &openapi.Operation{OperationID: id + variant.suffix, Summary: summary, Parameters: params, RequestBody: body, Responses: responses}
+		}
+		p := variant.path
+
+		doc.Paths[p+"/{key}"] = &openapi.PathItem{
+			Get: op("getKey", "Get the value of a key, raw if application/octet-stream is accepted.", keyParams, nil, responses(map[string]*openapi.Response{
+				"200": {Description: "The value.", Content: map[string]openapi.MediaType{
+					"application/json": {Schema: openapi.Ref("Entry")},
+					octetStream:        {Schema: &openapi.Schema{Type: "string", Format: "binary"}},
+				}},
+			}, "404")),
+			Head: op("headKey", "Get the headers of getKey.", keyParams, nil, responses(map[string]*openapi.Response{
+				"200": {Description: "The key exists."},
+			}, "404")),
+			Post: op("postKey", "Store a value, streaming raw application/octet-stream bodies.", keyParams, value, responses(map[string]*openapi.Response{
+				"201": {Description: "Stored."},
+			})),
+			Put: op("putKey", "Store a value, streaming raw application/octet-stream bodies.", keyParams, value, responses(map[string]*openapi.Response{
+				"204": {Description: "Stored."},
+			})),
+			Delete: op("deleteKey", "Delete a key; deleting a missing key succeeds.", keyParams, nil, responses(map[string]*openapi.Response{
+				"204": {Description: "Deleted."},
+			})),
+		}
+		doc.Paths[p+"/{key}:"+opIncrement] = &openapi.PathItem{
+			Post: op(opIncrement, "Add delta to an integer value, a missing key counts as 0.", keyParams, update, responses(map[string]*openapi.Response{
+				"200": entry,
+			}, "409")),
+		}
+		doc.Paths[p+"/{key}:"+opAppend] = &openapi.PathItem{
+			Post: op(opAppend, "Append value to the value of a key.", keyParams, update, responses(map[string]*openapi.Response{
+				"200": entry,
+			})),
+		}
+		doc.Paths[p+"/{key}:"+opGetOrSet] = &openapi.PathItem{
+			Post: op(opGetOrSet, "Get the value of a key, storing value first if the key is missing.", keyParams, update, responses(map[string]*openapi.Response{
+				"200": entry,
+				"201": {Description: "The key was missing and value was stored.", Content: openapi.JSON(openapi.Ref("Entry"))},
+			})),
+		}
+		doc.Paths[p+"/"+scanPath] = &openapi.PathItem{
+			Get: op("scan", "List keys in ascending order.", append(params[:len(params):len(params)],
+				query("prefix", "Only list keys with this prefix.", str("")),
+				query("after", "Only list keys after this one, to page through results.", str("")),
+				query("limit", "Maximum number of entries, 0 for no limit.", &openapi.Schema{Type: "integer", Minimum: &zero}),
+			), nil, responses(map[string]*openapi.Response{
+				"200": {Description: "The entries.", Content: openapi.JSON(openapi.Ref("ScanResponse"))},
+			})),
+		}
+		doc.Paths[p+"/"+watchPath] = &openapi.PathItem{
+			Get: op("watch", "Stream changes as Server-Sent Events; clients resume with Last-Event-ID. Puts of large or binary values come without the value and with valueOmitted set.", append(params[:len(params):len(params)],
+				query("prefix", "Only stream changes of keys with this prefix.", str("")),
+				query("since", "Stream changes after this version.", &openapi.Schema{Type: "integer", Format: "int64", Minimum: &zero}),
+			), nil, responses(map[string]*openapi.Response{
+				"200": {Description: "The change stream.", Content: map[string]openapi.MediaType{"text/event-stream": {Schema: str("")}}},
+			}, "410", "501")),
+		}
+		doc.Paths[p+"/"+mgetPath] = &openapi.PathItem{
+			Post: op("getMany", "Get the values of several keys.", params, many, responses(map[string]*openapi.Response{
+				"200": {Description: "The values and the missing keys.", Content: openapi.JSON(openapi.Ref("ManyResponse"))},
+			})),
+		}
+		doc.Paths[p+"/"+mdeletePath] = &openapi.PathItem{
+			Post: op("deleteMany", "Delete several keys.", params, many, responses(map[string]*openapi.Response{
+				"204": {Description: "Deleted."},
+			})),
+		}
+		if variant.suffix != "" {
+			doc.Paths[p+"/"] = &openapi.PathItem{
+				Delete: op("dropBucket", "Delete every key of a bucket.", params, nil, responses(map[string]*openapi.Response{
+					"204": {Description: "Dropped."},
+				})),
+			}
+		}
+	}
+	return doc
+}
+
+// decode checks the JSON body of req against the request body of operation
+// and decodes it into v. It answers 400 with the offending fields otherwise.
+func decode(rw http.ResponseWriter, req *http.Request, operation string, v interface{}) bool {
+	data, err := io.ReadAll(req.Body)
+	if httptools.BodyErrorStatus(err) != 0 {
+		// Too large or too slow.
+		writeError(rw, err)
+		return false
+	} else if err != nil {
+		writeErrorCode(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return false
+	}
+	if err := spec.ValidateBody(spec.Operation(operation), data); err != nil {
+		writeValidationError(rw, err)
+		return false
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, v); err != nil {
+			writeErrorCode(rw, http.StatusBadRequest, codeBadRequest, "invalid JSON body: "+err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// checkQuery checks the query parameters of req against operation.
+func checkQuery(rw http.ResponseWriter, req *http.Request, operation string) bool {
+	if err := spec.ValidateQuery(spec.Operation(operation), req.URL.Query()); err != nil {
+		writeValidationError(rw, err)
+		return false
+	}
+	return true
+}
+
+func writeValidationError(rw http.ResponseWriter, err error) {
+	resp := ErrorResponse{Code: codeBadRequest, Message: err.Error()}
+	var invalid *openapi.ValidationError
+	if errors.As(err, &invalid) {
+		resp.Fields = invalid.Fields
+	}
+	writeErrorResponse(rw, http.StatusBadRequest, resp)
+}
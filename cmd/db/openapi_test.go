@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/openapi"
+)
+
+// schema resolves a reference to a component schema of spec.
+func schema(s *openapi.Schema) *openapi.Schema {
+	if s != nil && s.Ref != "" {
+		return spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// examplePath fills the path parameters of op with their examples.
+func examplePath(path string, op *openapi.Operation) string {
+	for _, p := range op.Parameters {
+		if p.In == "path" {
+			path = strings.Replace(path, "{"+p.Name+"}", fmt.Sprint(p.Schema.Example), 1)
+		}
+	}
+	return path
+}
+
+// TestSpec fails when the handlers and the API description disagree.
+func TestSpec(t *testing.T) {
+	var paths []string
+	for path := range spec.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	t.Run("Operations", func(t *testing.T) {
+		for _, path := range paths {
+			for method, op := range spec.Paths[path].Operations() {
+				store := datastore.NewMemStore()
+				team, _ := datastore.NewBucket(store, "team")
+				if err := store.Put("counter", "41"); err != nil {
+					t.Fatal(err)
+				}
+				if err := team.Put("counter", "41"); err != nil {
+					t.Fatal(err)
+				}
+
+				var body []byte
+				if op.RequestBody != nil {
+					body, _ = json.Marshal(schema(op.RequestBody.Content["application/json"].Schema).Example)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				req := httptest.NewRequest(method, examplePath(path, op), bytes.NewReader(body)).WithContext(ctx)
+				rec := httptest.NewRecorder()
+				NewHandler(store).ServeHTTP(rec, req)
+				cancel()
+
+				response := op.Responses[strconv.Itoa(rec.Code)]
+				if response == nil || rec.Code >= 300 {
+					t.Errorf("%s %s: expected a documented success, got %d: %s", method, req.URL.Path, rec.Code, rec.Body)
+					continue
+				}
+				if media, ok := response.Content["application/json"]; ok && method != http.MethodHead {
+					if err := spec.Validate(media.Schema, rec.Body.Bytes()); err != nil {
+						t.Errorf("%s %s: response does not match the spec: %s", method, req.URL.Path, err)
+					}
+				} else if rec.Body.Len() > 0 && !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+					t.Errorf("%s %s: undocumented response body %q", method, req.URL.Path, rec.Body)
+				}
+
+				if op.RequestBody == nil {
+					continue
+				}
+				rec = httptest.NewRecorder()
+				NewHandler(store).ServeHTTP(rec, httptest.NewRequest(method, examplePath(path, op), strings.NewReader(`{"unknown":1}`)))
+				var resp ErrorResponse
+				_ = json.NewDecoder(rec.Body).Decode(&resp)
+				if rec.Code != http.StatusBadRequest || op.Responses["400"] == nil || len(resp.Fields) == 0 {
+					t.Errorf("%s %s: expected a documented 400 with fields for a bad body, got %d %+v", method, req.URL.Path, rec.Code, resp)
+				}
+			}
+		}
+	})
+
+	t.Run("Methods", func(t *testing.T) {
+		for _, path := range paths {
+			if strings.Contains(path, "}:") {
+				// Other methods of /db/{key}:<op> address the key with the colon.
+				continue
+			}
+			ops := spec.Paths[path].Operations()
+			var op *openapi.Operation
+			for _, op = range ops {
+				// Any operation has the path parameters.
+				break
+			}
+			for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete} {
+				if ops[method] != nil {
+					continue
+				}
+				rec := httptest.NewRecorder()
+				NewHandler(datastore.NewMemStore()).ServeHTTP(rec, httptest.NewRequest(method, examplePath(path, op), nil))
+				if rec.Code != http.StatusMethodNotAllowed {
+					t.Errorf("%s %s is not documented but answered %d", method, path, rec.Code)
+				}
+			}
+		}
+	})
+
+	t.Run("Types", func(t *testing.T) {
+		for name, value := range map[string]interface{}{
+			"Value":        Request{},
+			"Update":       Request{},
+			"Entry":        Response{},
+			"ManyRequest":  ManyRequest{},
+			"ManyResponse": ManyResponse{},
+			"ScanResponse": ScanResponse{},
+			"Error":        ErrorResponse{},
+		} {
+			fields := jsonFields(reflect.TypeOf(value))
+			properties := spec.Components.Schemas[name].Properties
+			for property := range properties {
+				if !fields[property] {
+					t.Errorf("%s.%s is not a field of %T", name, property, value)
+				}
+			}
+			for field := range fields {
+				if properties[field] == nil && name != "Value" {
+					t.Errorf("%T.%s is not in the %s schema", value, field, name)
+				}
+			}
+		}
+	})
+}
+
+// jsonFields lists the JSON names of the fields of a struct type.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+	return fields
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// A follower copies the leader through two endpoints:
+//
+//	GET /replication/snapshot            every key with the version it reflects
+//	GET /replication/stream?since=<v>    Server-Sent Events with every later write
+//	GET /replication/value?key=<k>       the raw value of a key
+//
+// Puts of large or binary values reach the stream without the value, and
+// snapshots leave out values over snapshotValueLimit; the follower copies them
+// through /replication/value instead.
+//
+// Keys are sent in their stored form, so buckets are copied too. Keys and
+// values are []byte, which JSON carries as base64, so binary data survives.
+const (
+	snapshotPath = "/replication/snapshot"
+	streamPath   = "/replication/stream"
+	statusPath   = "/replication/status"
+	valuePath    = "/replication/value"
+)
+
+// snapshotValueLimit is the largest value a snapshot carries, which keeps
+// the entries small enough to be read one at a time.
+const snapshotValueLimit = 64 << 10
+
+// heartbeatInterval is how often the leader reports its version on an idle
+// stream.
+const heartbeatInterval = time.Second
+
+// ReplicationEntry is a key in a snapshot.
+type ReplicationEntry struct {
+	Key          []byte `json:"key"`
+	Value        []byte `json:"value,omitempty"`
+	ValueOmitted bool   `json:"valueOmitted,omitempty"`
+}
+
+// Snapshot is the document served at snapshotPath. It is as large as the
+// data set, so both sides handle it one entry at a time.
+type Snapshot struct {
+	Version uint64             `json:"version"`
+	Entries []ReplicationEntry `json:"entries"`
+}
+
+// ReplicationEvent is a write, or a heartbeat carrying the leader version.
+type ReplicationEvent struct {
+	Op           datastore.ChangeOp `json:"op,omitempty"`
+	Version      uint64             `json:"version"`
+	Key          []byte             `json:"key,omitempty"`
+	Value        []byte             `json:"value,omitempty"`
+	ValueOmitted bool               `json:"valueOmitted,omitempty"`
+}
+
+// ReplicationSourceStore is the part of the datastore a leader needs.
+type ReplicationSourceStore interface {
+	datastore.Streamer
+	Snapshot(fn func(key string) bool) (uint64, error)
+	WatchAll(ctx context.Context, since uint64) (<-chan datastore.Change, error)
+	Version() uint64
+}
+
+// ReplicationSource serves the /replication/ endpoints of a leader.
+type ReplicationSource struct {
+	db      ReplicationSourceStore
+	streams *streams
+}
+
+func NewReplicationSource(db ReplicationSourceStore) *ReplicationSource {
+	return &ReplicationSource{db: db, streams: newStreams()}
+}
+
+// CloseStreams ends the open write streams. Followers reconnect and resume
+// once the leader is back.
+func (s *ReplicationSource) CloseStreams() {
+	s.streams.close()
+}
+
+func (s *ReplicationSource) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch req.URL.Path {
+	case snapshotPath:
+		s.snapshot(rw, req)
+	case streamPath:
+		s.stream(rw, req)
+	case valuePath:
+		s.value(rw, req)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// snapshot writes the Snapshot document entry by entry. Only the keys are
+// collected while writers are blocked, which should not depend on how fast
+// the follower reads; values are read afterwards and can be newer than the
+// snapshot version. Replaying the stream from that version still ends in the
+// state of the leader.
+func (s *ReplicationSource) snapshot(rw http.ResponseWriter, req *http.Request) {
+	var keys []string
+	version, err := s.db.Snapshot(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		log.Printf("Replication snapshot failed: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The document grows with the data set, not with a value size.
+	_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	w := bufio.NewWriterSize(rw, snapshotValueLimit)
+	fmt.Fprintf(w, `{"version":%d,"entries":[`, version)
+	written := 0
+	for _, key := range keys {
+		entry, err := s.entry(req.Context(), key)
+		if err == datastore.ErrNotFound {
+			// Deleted since, the delete is in the stream.
+			continue
+		} else if err != nil {
+			// The follower gets a broken document and starts over.
+			log.Printf("Replication snapshot failed: %s", err)
+			return
+		}
+		if written > 0 {
+			_ = w.WriteByte(',')
+		}
+		data, _ := json.Marshal(entry)
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+		written++
+	}
+	_, _ = w.WriteString("]}\n")
+	_ = w.Flush()
+}
+
+// entry reads the snapshot entry of key.
+func (s *ReplicationSource) entry(ctx context.Context, key string) (ReplicationEntry, error) {
+	value, size, err := s.db.GetReader(ctx, key)
+	if err != nil {
+		return ReplicationEntry{}, err
+	}
+	defer value.Close()
+	e := ReplicationEntry{Key: []byte(key)}
+	if size > snapshotValueLimit {
+		e.ValueOmitted = true
+		return e, nil
+	}
+	e.Value, err = io.ReadAll(value)
+	return e, err
+}
+
+func (s *ReplicationSource) stream(rw http.ResponseWriter, req *http.Request) {
+	since, err := strconv.ParseUint(req.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	changes, err := s.db.WatchAll(req.Context(), since)
+	if errors.Is(err, datastore.ErrWatchExpired) {
+		rw.WriteHeader(http.StatusGone)
+		return
+	} else if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rc := http.NewResponseController(rw)
+	_ = rc.SetWriteDeadline(time.Time{})
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	event := ReplicationEvent{Version: s.db.Version()}
+	for {
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(rw, "data: %s\n\n", data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				// The follower fell behind or the leader is closing. It
+				// reconnects and resumes.
+				return
+			}
+			event = ReplicationEvent{Op: c.Op, Version: c.Version, Key: []byte(c.Key), Value: []byte(c.Value), ValueOmitted: c.ValueOmitted}
+		case <-heartbeat.C:
+			event = ReplicationEvent{Version: s.db.Version()}
+		case <-req.Context().Done():
+			return
+		case <-s.streams.done:
+			return
+		}
+	}
+}
+
+// value streams the raw value of a key in its stored form.
+func (s *ReplicationSource) value(rw http.ResponseWriter, req *http.Request) {
+	value, size, err := s.db.GetReader(req.Context(), req.URL.Query().Get("key"))
+	if err == datastore.ErrNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(rw, err)
+		return
+	}
+	defer value.Close()
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(rw, value)
+}
+
+// ReplicaStore is the part of the datastore a follower writes to.
+type ReplicaStore interface {
+	datastore.Streamer
+	Put(key, value string) error
+	Delete(key string) error
+	DeleteMany(keys []string) error
+	Snapshot(fn func(key string) bool) (uint64, error)
+	Sync() error
+}
+
+// ReplicationStatus reports how far a follower is behind its leader.
+type ReplicationStatus struct {
+	Leader         string    `json:"leader"`
+	Connected      bool      `json:"connected"`
+	AppliedVersion uint64    `json:"appliedVersion"`
+	LeaderVersion  uint64    `json:"leaderVersion"`
+	Lag            uint64    `json:"lag"`
+	LastContact    time.Time `json:"lastContact"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+// retryInterval is the pause before a follower reconnects to its leader.
+const retryInterval = time.Second
+
+// Follower keeps a local datastore in sync with a leader. It loads a snapshot
+// first and then applies the write stream, falling back to a new snapshot when
+// the leader no longer retains the changes it needs.
+type Follower struct {
+	// Token is the bearer token sent to the leader, if not empty.
+	Token string
+	// MaxValueSize is the -max-value-size of the leader, which bounds the
+	// stream events. It is 64 MiB if zero.
+	MaxValueSize int64
+	// StateFile keeps the last applied leader version across restarts, so
+	// the follower resumes the stream instead of loading a snapshot. The
+	// version is saved after a snapshot and whenever the stream breaks; after
+	// a crash the stream replays the writes applied since. Nothing is kept if
+	// empty.
+	StateFile string
+
+	leader string
+	db     ReplicaStore
+	client *http.Client
+
+	lock   sync.Mutex
+	synced bool
+	status ReplicationStatus
+}
+
+func NewFollower(leader string, db ReplicaStore) *Follower {
+	leader = strings.TrimSuffix(leader, "/")
+	return &Follower{
+		leader: leader,
+		db:     db,
+		client: &http.Client{},
+		status: ReplicationStatus{Leader: leader},
+	}
+}
+
+// Run replicates until ctx is done.
+func (f *Follower) Run(ctx context.Context) {
+	if err := f.loadState(); err != nil {
+		log.Printf("Ignoring the replication state: %s", err)
+	}
+	for {
+		err := f.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		f.lock.Lock()
+		f.status.Connected = false
+		if err != nil {
+			f.status.LastError = err.Error()
+			log.Printf("Replication from %s failed: %s", f.leader, err)
+		}
+		f.lock.Unlock()
+
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *Follower) sync(ctx context.Context) error {
+	if !f.synced {
+		if err := f.loadSnapshot(ctx); err != nil {
+			return err
+		}
+		f.synced = true
+		if err := f.saveState(); err != nil {
+			return err
+		}
+	}
+	err := f.follow(ctx)
+	if saveErr := f.saveState(); saveErr != nil {
+		log.Printf("Saving the replication state failed: %s", saveErr)
+	}
+	return err
+}
+
+// followStateFile is the name of Follower.StateFile in the data directory.
+const followStateFile = "follow-state"
+
+// followState is the content of Follower.StateFile.
+type followState struct {
+	Leader  string `json:"leader"`
+	Version uint64 `json:"version"`
+}
+
+// loadState resumes from the version in StateFile if it was saved for the
+// same leader.
+func (f *Follower) loadState() error {
+	if f.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state followState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %w", f.StateFile, err)
+	}
+	if state.Leader != f.leader {
+		return fmt.Errorf("%s was saved for the leader %s", f.StateFile, state.Leader)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.synced = true
+	f.status.AppliedVersion = state.Version
+	f.updateLeaderVersion(state.Version)
+	return nil
+}
+
+// saveState records the applied version in StateFile once the writes up to
+// it are on stable storage. The file is replaced by a rename, so a crash
+// leaves either version.
+func (f *Follower) saveState() error {
+	if f.StateFile == "" || !f.synced {
+		return nil
+	}
+	if err := f.db.Sync(); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	data, _ := json.Marshal(followState{Leader: f.leader, Version: f.status.AppliedVersion})
+	f.lock.Unlock()
+
+	tmp := f.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.StateFile)
+}
+
+func (f *Follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.Token)
+	}
+	return f.client.Do(req)
+}
+
+// loadSnapshot replaces the local data with a leader snapshot.
+func (f *Follower) loadSnapshot(ctx context.Context) error {
+	resp, err := f.get(ctx, snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot: unexpected status %d", resp.StatusCode)
+	}
+
+	keep := make(map[string]bool)
+	version, err := readSnapshot(resp.Body, func(e ReplicationEntry) error {
+		keep[string(e.Key)] = true
+		if e.ValueOmitted {
+			return f.copyValue(ctx, string(e.Key))
+		}
+		return f.db.Put(string(e.Key), string(e.Value))
+	})
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	var stale []string
+	if _, err := f.db.Snapshot(func(key string) bool {
+		if !keep[key] {
+			stale = append(stale, key)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	if err := f.db.DeleteMany(stale); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	f.status.AppliedVersion = version
+	f.updateLeaderVersion(version)
+	f.lock.Unlock()
+	return nil
+}
+
+// readSnapshot decodes a Snapshot document from r, calling fn for every entry
+// as soon as it is read, and returns the snapshot version.
+func readSnapshot(r io.Reader, fn func(e ReplicationEntry) error) (uint64, error) {
+	dec := json.NewDecoder(r)
+	delim := func(expected json.Delim) error {
+		t, err := dec.Token()
+		if err == nil && t != expected {
+			err = fmt.Errorf("expected %s, got %v", expected, t)
+		}
+		return err
+	}
+
+	var version uint64
+	if err := delim('{'); err != nil {
+		return 0, err
+	}
+	for dec.More() {
+		name, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		switch name {
+		case "version":
+			err = dec.Decode(&version)
+		case "entries":
+			if err = delim('['); err != nil {
+				return 0, err
+			}
+			for err == nil && dec.More() {
+				var e ReplicationEntry
+				if err = dec.Decode(&e); err == nil {
+					err = fn(e)
+				}
+			}
+			if err == nil {
+				err = delim(']')
+			}
+		default:
+			var skipped json.RawMessage
+			err = dec.Decode(&skipped)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return version, delim('}')
+}
+
+// follow applies the write stream until it breaks.
+func (f *Follower) follow(ctx context.Context) error {
+	f.lock.Lock()
+	since := f.status.AppliedVersion
+	f.lock.Unlock()
+
+	resp, err := f.get(ctx, streamPath+"?since="+strconv.FormatUint(since, 10))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		f.synced = false
+		return fmt.Errorf("changes after version %d are gone, reloading the snapshot", since)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stream: unexpected status %d", resp.StatusCode)
+	}
+
+	f.lock.Lock()
+	f.status.Connected = true
+	f.status.LastError = ""
+	f.lock.Unlock()
+
+	maxValueSize := f.MaxValueSize
+	if maxValueSize == 0 {
+		maxValueSize = 64 << 20
+	}
+	lines := bufio.NewScanner(resp.Body)
+	lines.Buffer(nil, maxEventSize(maxValueSize))
+	for lines.Scan() {
+		data := strings.TrimPrefix(lines.Text(), "data: ")
+		if data == lines.Text() {
+			continue
+		}
+		var event ReplicationEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("stream: %w", err)
+		}
+		if err := f.apply(ctx, event); err != nil {
+			return err
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by the leader")
+}
+
+func (f *Follower) apply(ctx context.Context, event ReplicationEvent) error {
+	var err error
+	switch {
+	case event.Op == datastore.OpPut && event.ValueOmitted:
+		err = f.copyValue(ctx, string(event.Key))
+	case event.Op == datastore.OpPut:
+		err = f.db.Put(string(event.Key), string(event.Value))
+	case event.Op == datastore.OpDelete:
+		err = f.db.Delete(string(event.Key))
+	}
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if event.Op != "" {
+		f.status.AppliedVersion = event.Version
+	}
+	f.updateLeaderVersion(event.Version)
+	f.status.LastContact = time.Now()
+	return nil
+}
+
+// maxEventSize is the longest stream line with a value of maxValueSize bytes.
+// Keys and values are base64 in JSON; keys came in URLs, so they are shorter
+// than the 1 MiB of request headers a server reads.
+func maxEventSize(maxValueSize int64) int {
+	return base64.StdEncoding.EncodedLen(int(maxValueSize)) + base64.StdEncoding.EncodedLen(1<<20) + 4<<10
+}
+
+// copyValue streams the value of key from the leader. The value may be
+// newer than the event that asked for it; the later write is still ahead in
+// the stream, and so is the delete of a key that is gone already.
+func (f *Follower) copyValue(ctx context.Context, key string) error {
+	resp, err := f.get(ctx, valuePath+"?"+url.Values{"key": {key}}.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return f.db.PutReader(ctx, key, resp.Body)
+	case http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("value: unexpected status %d", resp.StatusCode)
+}
+
+// updateLeaderVersion must be called with lock held.
+func (f *Follower) updateLeaderVersion(version uint64) {
+	if version > f.status.LeaderVersion {
+		f.status.LeaderVersion = version
+	}
+	f.status.Lag = 0
+	if f.status.LeaderVersion > f.status.AppliedVersion {
+		f.status.Lag = f.status.LeaderVersion - f.status.AppliedVersion
+	}
+}
+
+func (f *Follower) Status() ReplicationStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.status
+}
+
+// ServeHTTP serves GET /replication/status.
+func (f *Follower) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != statusPath {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(f.Status())
+}
+
+var ErrReadOnly = fmt.Errorf("this replica is read-only, write to the leader")
+
+// readOnlyStore serves reads and rejects writes on a follower.
+type readOnlyStore struct {
+	datastore.Store
+}
+
+func (readOnlyStore) Put(string, string) error { return ErrReadOnly }
+
+func (readOnlyStore) Delete(string) error { return ErrReadOnly }
+
+func (readOnlyStore) PutContext(context.Context, string, string) error { return ErrReadOnly }
+
+func (readOnlyStore) DeleteContext(context.Context, string) error { return ErrReadOnly }
+
+func (readOnlyStore) Increment(string, int64) (int64, error) { return 0, ErrReadOnly }
+
+func (readOnlyStore) IncrementContext(context.Context, string, int64) (int64, error) {
+	return 0, ErrReadOnly
+}
+
+func (readOnlyStore) Append(string, string) (string, error) { return "", ErrReadOnly }
+
+func (readOnlyStore) AppendContext(context.Context, string, string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (s readOnlyStore) GetOrSet(key, def string) (string, bool, error) {
+	return s.GetOrSetContext(context.Background(), key, def)
+}
+
+// GetOrSetContext succeeds for keys that exist.
+func (s readOnlyStore) GetOrSetContext(ctx context.Context, key, _ string) (string, bool, error) {
+	value, err := s.Store.GetContext(ctx, key)
+	if err == datastore.ErrNotFound {
+		return "", false, ErrReadOnly
+	}
+	return value, err == nil, err
+}
+
+func (readOnlyStore) DeleteMany([]string) error { return ErrReadOnly }
+
+func (readOnlyStore) DeleteManyContext(context.Context, []string) error { return ErrReadOnly }
+
+func (readOnlyStore) DeleteExisting([]string) (int, error) { return 0, ErrReadOnly }
+
+func (readOnlyStore) DeleteExistingContext(context.Context, []string) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (s readOnlyStore) GetVersion(ctx context.Context, key string) (string, uint64, error) {
+	v, ok := s.Store.(datastore.Versioner)
+	if !ok {
+		return "", 0, datastore.ErrVersionsUnsupported
+	}
+	return v.GetVersion(ctx, key)
+}
+
+func (readOnlyStore) CompareAndSwap(context.Context, string, string, uint64) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) CompareAndDelete(context.Context, string, uint64) error { return ErrReadOnly }
+
+func (s readOnlyStore) Watch(ctx context.Context, prefix string, since uint64) (<-chan datastore.Change, error) {
+	w, ok := s.Store.(datastore.Watcher)
+	if !ok {
+		return nil, datastore.ErrWatchUnsupported
+	}
+	return w.Watch(ctx, prefix, since)
+}
+
+func (readOnlyStore) PutReader(context.Context, string, io.Reader) error { return ErrReadOnly }
+
+func (s readOnlyStore) GetReader(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	if streamer, ok := s.Store.(datastore.Streamer); ok {
+		return streamer.GetReader(ctx, key)
+	}
+	value, err := s.Store.GetContext(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(strings.NewReader(value)), int64(len(value)), nil
+}
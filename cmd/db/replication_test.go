@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// eventually retries check until it passes or a deadline runs out.
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leaderDb := newMemDb(t)
+	leaderMux := http.NewServeMux()
+	leaderMux.Handle("/db/", NewHandler(leaderDb))
+	leaderMux.Handle("/replication/", NewReplicationSource(leaderDb))
+	leader := httptest.NewServer(leaderMux)
+	defer leader.Close()
+
+	post := func(t *testing.T, url, body string) int {
+		t.Helper()
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	getValue := func(url string) (string, int) {
+		resp, err := http.Get(url)
+		if err != nil {
+			return "", 0
+		}
+		defer resp.Body.Close()
+		var body Response
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body.Value, resp.StatusCode
+	}
+
+	// Written before the follower starts, so it arrives in the snapshot.
+	post(t, leader.URL+"/db/before", `{"value":"snapshot"}`)
+	post(t, leader.URL+"/db/team/key", `{"value":"bucket"}`)
+	// Too large for a snapshot entry, the follower copies it separately.
+	large := strings.Repeat("v", snapshotValueLimit+1)
+	leaderDb.Put("large", large)
+
+	followerDb := newMemDb(t)
+	// A key the leader does not have must not survive the initial sync.
+	followerDb.Put("stale", "value")
+	follower := NewFollower(leader.URL, followerDb)
+	followerMux := http.NewServeMux()
+	followerMux.Handle("/db/", NewHandler(readOnlyStore{followerDb}))
+	followerMux.Handle("/replication/", follower)
+	replica := httptest.NewServer(followerMux)
+	defer replica.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go follower.Run(ctx)
+
+	eventually(t, "the snapshot", func() bool {
+		value, _ := getValue(replica.URL + "/db/before")
+		return value == "snapshot"
+	})
+	if value, _ := getValue(replica.URL + "/db/team/key"); value != "bucket" {
+		t.Errorf("Expected bucket keys to be replicated, got %q", value)
+	}
+	eventually(t, "the large value of the snapshot", func() bool {
+		value, _ := followerDb.Get("large")
+		return value == large
+	})
+	if _, code := getValue(replica.URL + "/db/stale"); code != http.StatusNotFound {
+		t.Errorf("Expected the stale key to be removed, got %d", code)
+	}
+
+	post(t, leader.URL+"/db/live", `{"value":"streamed"}`)
+	post(t, leader.URL+"/db/before", `{"value":"updated"}`)
+	team, _ := leaderDb.Bucket("team")
+	team.Delete("key")
+	eventually(t, "streamed writes", func() bool {
+		live, _ := getValue(replica.URL + "/db/live")
+		before, _ := getValue(replica.URL + "/db/before")
+		_, deleted := getValue(replica.URL + "/db/team/key")
+		return live == "streamed" && before == "updated" && deleted == http.StatusNotFound
+	})
+
+	// Too large for the change feed, the follower copies it separately.
+	huge := strings.Repeat("\x00\xff", 64<<10)
+	resp, err := http.Post(leader.URL+"/db/team/huge", octetStream, strings.NewReader(huge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	followerTeam, _ := followerDb.Bucket("team")
+	eventually(t, "the streamed value", func() bool {
+		value, _ := followerTeam.Get("huge")
+		return value == huge
+	})
+
+	if code := post(t, replica.URL+"/db/live", `{"value":"rejected"}`); code != http.StatusForbidden {
+		t.Errorf("Expected the follower to reject writes with 403, got %d", code)
+	}
+
+	eventually(t, "zero lag", func() bool {
+		status := follower.Status()
+		return status.Connected && status.Lag == 0 && status.AppliedVersion == leaderDb.Version()
+	})
+	resp, err = http.Get(replica.URL + "/replication/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status ReplicationStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Leader != leader.URL || status.AppliedVersion != leaderDb.Version() {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+// TestReplication_LargeValue replicates a binary value of the maximum size,
+// which the stream leaves out for the follower to copy.
+func TestReplication_LargeValue(t *testing.T) {
+	leaderDb := newMemDb(t)
+	leader := httptest.NewServer(NewReplicationSource(leaderDb))
+	defer leader.Close()
+
+	followerDb := newMemDb(t)
+	follower := NewFollower(leader.URL, followerDb)
+	follower.MaxValueSize = 1 << 20
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go follower.Run(ctx)
+	eventually(t, "the follower to connect", func() bool { return follower.Status().Connected })
+
+	value := strings.Repeat("\xff", 1<<20)
+	if err := leaderDb.Put(strings.Repeat("k", 1000), value); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the large value", func() bool {
+		got, _ := followerDb.Get(strings.Repeat("k", 1000))
+		return got == value
+	})
+	if status := follower.Status(); status.LastError != "" {
+		t.Errorf("Unexpected replication error %s", status.LastError)
+	}
+}
+
+func TestReplication_Resume(t *testing.T) {
+	leaderDb := newMemDb(t)
+	source := NewReplicationSource(leaderDb)
+	var snapshots int32
+	leader := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == snapshotPath {
+			atomic.AddInt32(&snapshots, 1)
+		}
+		source.ServeHTTP(rw, req)
+	}))
+	defer leader.Close()
+
+	followerDb := newMemDb(t)
+	stateFile := filepath.Join(t.TempDir(), followStateFile)
+	run := func(t *testing.T, key string) ReplicationStatus {
+		t.Helper()
+		follower := NewFollower(leader.URL, followerDb)
+		follower.StateFile = stateFile
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			follower.Run(ctx)
+		}()
+		eventually(t, key, func() bool {
+			_, err := followerDb.Get(key)
+			return err == nil
+		})
+		cancel()
+		<-done
+		return follower.Status()
+	}
+
+	leaderDb.Put("first", "1")
+	run(t, "first")
+	// Written while the follower is down, the stream replays it.
+	leaderDb.Put("second", "2")
+	status := run(t, "second")
+	if n := atomic.LoadInt32(&snapshots); n != 1 {
+		t.Errorf("Expected a single snapshot, got %d", n)
+	}
+	if version, _ := leaderDb.Snapshot(func(string) bool { return false }); status.AppliedVersion != version {
+		t.Errorf("Expected version %d to be applied, got %d", version, status.AppliedVersion)
+	}
+
+	// A state kept for another leader is ignored.
+	os.WriteFile(stateFile, []byte(`{"leader":"http://other","version":1}`), 0o600)
+	leaderDb.Put("third", "3")
+	run(t, "third")
+	if n := atomic.LoadInt32(&snapshots); n != 2 {
+		t.Errorf("Expected a new snapshot for another leader, got %d snapshots", n)
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	store := datastore.NewMemStore()
+	store.Put("key", "value")
+	ro := readOnlyStore{store}
+
+	if value, loaded, err := ro.GetOrSet("key", "other"); err != nil || !loaded || value != "value" {
+		t.Errorf("Expected GetOrSet to read existing keys, got %q, %t, %v", value, loaded, err)
+	}
+	if _, _, err := ro.GetOrSet("missing", "other"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	b, _ := datastore.NewBucket(ro, "b")
+	if err := b.Put("key", "value"); err != ErrReadOnly {
+		t.Errorf("Expected buckets to be read-only too, got %v", err)
+	}
+}
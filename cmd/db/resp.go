@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const (
+	// maxBulkSize bounds a single argument of a RESP command.
+	maxBulkSize = 64 << 20
+	// maxArgs bounds the number of arguments of a RESP command.
+	maxArgs = 1 << 16
+	// defaultScanCount is the number of keys SCAN visits without COUNT.
+	defaultScanCount = 10
+	// maxCursors is the number of unfinished SCAN cursors a connection keeps.
+	maxCursors = 64
+)
+
+// errProtocol marks malformed input, after which the connection is closed.
+var errProtocol = errors.New("Protocol error")
+
+// RespServer speaks a subset of the Redis protocol (RESP2) on top of a Store:
+// GET, SET with EX, DEL, EXISTS, INCRBY, MGET, SCAN, PING and AUTH. Expiry
+// set with SET EX is kept in memory, so a restart forgets it; a key written
+// since through any frontend does not expire, see expiries.
+type RespServer struct {
+	connServer
+	// ACL, if set, makes clients AUTH with a token before any other command
+	// and limits them to the keys of the token.
+	ACL *ACL
+
+	store    versionedStore
+	ctx      context.Context
+	cancel   context.CancelFunc
+	expiries *expiries
+}
+
+func NewRespServer(store versionedStore) *RespServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RespServer{
+		connServer: newConnServer(),
+		store:      store,
+		ctx:        ctx,
+		cancel:     cancel,
+		expiries:   newExpiries(ctx, store),
+	}
+}
+
+// Serve accepts connections on l until Close is called, which makes it
+// return nil.
+func (s *RespServer) Serve(l net.Listener) error {
+	return s.serve(l, s.serveConn)
+}
+
+// Close stops accepting connections, closes the open ones and cancels the
+// pending expiries. It returns once the commands that were running are done;
+// their replies are lost with the connection.
+func (s *RespServer) Close() error {
+	err := s.close()
+	s.serving.Wait()
+	return err
+}
+
+func (s *RespServer) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cancel()
+	err := s.shut()
+	s.expiries.stop()
+	return err
+}
+
+// respConn is the state of one client connection.
+type respConn struct {
+	r *bufio.Reader
+	w *respWriter
+	// token is the token the client authenticated with.
+	token *Token
+	// cursors maps the SCAN cursors handed out to the last key they visited.
+	cursors    map[uint64]string
+	nextCursor uint64
+}
+
+func (s *RespServer) serveConn(conn net.Conn) {
+	c := &respConn{
+		r:       bufio.NewReader(conn),
+		w:       &respWriter{bufio.NewWriter(conn)},
+		cursors: make(map[uint64]string),
+	}
+	for {
+		args, err := readCommand(c.r)
+		if errors.Is(err, errProtocol) {
+			c.w.error("ERR " + err.Error())
+			c.w.Flush()
+			return
+		} else if err != nil {
+			if err != io.EOF && s.ctx.Err() == nil {
+				log.Printf("RESP connection %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			s.exec(c, args)
+		}
+		// Pipelined commands are answered together.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads a command sent either as a RESP array of bulk strings or
+// as an inline line of space separated words.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string is not terminated by CRLF", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line ended by CRLF or a bare LF. Lines longer than the
+// reader buffer are rejected.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: too big inline request", errProtocol)
+	} else if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// respWriter encodes RESP2 replies.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w *respWriter) simple(s string) { w.WriteString("+" + s + "\r\n") }
+
+// error writes an error reply. msg starts with the error kind, such as ERR.
+func (w *respWriter) error(msg string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func (w *respWriter) integer(n int64) { w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n") }
+
+func (w *respWriter) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *respWriter) null() { w.WriteString("$-1\r\n") }
+
+func (w *respWriter) array(n int) { w.WriteString("*" + strconv.Itoa(n) + "\r\n") }
+
+// storeError reports a datastore error the way Redis reports the closest
+// one.
+func (w *respWriter) storeError(err error) {
+	switch {
+	case errors.Is(err, datastore.ErrNotInteger):
+		w.error("ERR value is not an integer or out of range")
+	case errors.Is(err, datastore.ErrOverflow):
+		w.error("ERR increment or decrement would overflow")
+	case errors.Is(err, ErrReadOnly):
+		w.error("READONLY You can't write against a read only replica.")
+	default:
+		w.error("ERR " + err.Error())
+	}
+}
+
+// respCommand describes a command: its handler, its arity, which is the
+// exact number of arguments including the name, or the minimum one when
+// negative, and the right it needs on its keys.
+type respCommand struct {
+	run   func(s *RespServer, c *respConn, args []string)
+	arity int
+	right string
+}
+
+var respCommands map[string]respCommand
+
+func init() {
+	respCommands = map[string]respCommand{
+		"PING":   {(*RespServer).ping, -1, ""},
+		"AUTH":   {(*RespServer).auth, -2, ""},
+		"GET":    {(*RespServer).get, 2, readRight},
+		"SET":    {(*RespServer).set, -3, writeRight},
+		"DEL":    {(*RespServer).del, -2, writeRight},
+		"EXISTS": {(*RespServer).exists, -2, readRight},
+		"INCRBY": {(*RespServer).incrBy, 3, writeRight},
+		"MGET":   {(*RespServer).mget, -2, readRight},
+		// SCAN checks the prefix of its pattern itself.
+		"SCAN": {(*RespServer).scan, -2, ""},
+	}
+}
+
+func (s *RespServer) exec(c *respConn, args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, ok := respCommands[name]
+	if !ok {
+		c.w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	if s.ACL != nil && c.token == nil && name != "AUTH" {
+		c.w.error("NOAUTH Authentication required.")
+		return
+	}
+	if cmd.right != "" && !c.allows(cmd.right, keyArgs(name, args)...) {
+		return
+	}
+	// NUL bytes separate bucket names from keys inside the store.
+	if name != "PING" && name != "SCAN" && name != "AUTH" {
+		for _, key := range keyArgs(name, args) {
+			if strings.Contains(key, "\x00") {
+				c.w.error("ERR invalid key")
+				return
+			}
+		}
+	}
+	cmd.run(s, c, args)
+}
+
+// keyArgs returns the arguments of a command that are keys.
+func keyArgs(name string, args []string) []string {
+	switch name {
+	case "DEL", "EXISTS", "MGET":
+		return args[1:]
+	default:
+		return args[1:2]
+	}
+}
+
+// allows checks that the token of the connection grants right on keys, which
+// are keys or prefixes of scans, and replies NOPERM otherwise. Connections
+// of a server without an ACL are always allowed.
+func (c *respConn) allows(right string, keys ...string) bool {
+	if c.token == nil {
+		return true
+	}
+	for _, key := range keys {
+		if !c.token.allows(right, key) {
+			log.Printf("auth: token %s denied %s of %q", c.token.ID, right, key)
+			c.w.error("NOPERM this user has no permissions to access one of the keys used as arguments")
+			return false
+		}
+	}
+	return true
+}
+
+// auth implements AUTH [username] password. The password is the secret of a
+// token and the username, if given, its id.
+func (s *RespServer) auth(c *respConn, args []string) {
+	if s.ACL == nil {
+		c.w.error("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+	if len(args) > 3 {
+		c.w.error("ERR syntax error")
+		return
+	}
+	token := s.ACL.lookup(args[len(args)-1])
+	if token == nil || (len(args) == 3 && args[1] != token.ID) {
+		log.Printf("auth: denied RESP AUTH: unknown token")
+		c.w.error("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.token = token
+	c.w.simple("OK")
+}
+
+func (s *RespServer) ping(c *respConn, args []string) {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *RespServer) get(c *respConn, args []string) {
+	value, err := s.store.GetContext(s.ctx, args[1])
+	if err == datastore.ErrNotFound {
+		c.w.null()
+	} else if err != nil {
+		c.w.storeError(err)
+	} else {
+		c.w.bulk(value)
+	}
+}
+
+// set implements SET key value [EX seconds]. Like in Redis, a SET without EX
+// clears the expiry of the key: the write outdates it.
+func (s *RespServer) set(c *respConn, args []string) {
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		if !strings.EqualFold(args[i], "EX") || i+1 == len(args) || ttl != 0 {
+			c.w.error("ERR syntax error")
+			return
+		}
+		i++
+		seconds, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			c.w.error("ERR value is not an integer or out of range")
+			return
+		}
+		if seconds <= 0 || seconds > math.MaxInt64/int64(time.Second) {
+			c.w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	if err := s.store.PutContext(s.ctx, args[1], args[2]); err != nil {
+		c.w.storeError(err)
+		return
+	}
+	if ttl > 0 {
+		s.expiries.set(args[1], args[2], ttl)
+	}
+	c.w.simple("OK")
+}
+
+func (s *RespServer) del(c *respConn, args []string) {
+	deleted, err := s.store.DeleteExistingContext(s.ctx, args[1:])
+	if err != nil {
+		c.w.storeError(err)
+		return
+	}
+	c.w.integer(int64(deleted))
+}
+
+// exists counts the given keys that exist, repeated keys counting every time.
+func (s *RespServer) exists(c *respConn, args []string) {
+	values, _, err := s.store.GetManyContext(s.ctx, args[1:])
+	if err != nil {
+		c.w.storeError(err)
+		return
+	}
+	n := 0
+	for _, key := range args[1:] {
+		if _, found := values[key]; found {
+			n++
+		}
+	}
+	c.w.integer(int64(n))
+}
+
+// incrBy keeps the expiry of the key, as Redis does.
+func (s *RespServer) incrBy(c *respConn, args []string) {
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		c.w.error("ERR value is not an integer or out of range")
+		return
+	}
+	n, err := s.store.IncrementContext(s.ctx, args[1], delta)
+	if err != nil {
+		c.w.storeError(err)
+		return
+	}
+	s.expiries.renew(args[1], strconv.FormatInt(n, 10))
+	c.w.integer(n)
+}
+
+func (s *RespServer) mget(c *respConn, args []string) {
+	values, _, err := s.store.GetManyContext(s.ctx, args[1:])
+	if err != nil {
+		c.w.storeError(err)
+		return
+	}
+	c.w.array(len(args) - 1)
+	for _, key := range args[1:] {
+		if value, found := values[key]; found {
+			c.w.bulk(value)
+		} else {
+			c.w.null()
+		}
+	}
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count]. Keys are visited
+// in ascending order and a cursor remembers the last key it visited, so keys
+// that exist for the whole iteration are returned exactly once. Cursors
+// belong to the connection that got them.
+func (s *RespServer) scan(c *respConn, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+	after := ""
+	if cursor != 0 {
+		var ok bool
+		if after, ok = c.cursors[cursor]; !ok {
+			c.w.error("ERR invalid cursor")
+			return
+		}
+		delete(c.cursors, cursor)
+	}
+
+	pattern, count := "*", defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				c.w.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+	// A pattern with a NUL byte would reach into named buckets.
+	if strings.Contains(pattern, "\x00") {
+		c.w.error("ERR invalid pattern")
+		return
+	}
+	if !c.allows(readRight, globPrefix(pattern)) {
+		return
+	}
+
+	var (
+		keys    []string
+		last    string
+		visited int
+		more    bool
+	)
+	err = s.store.ScanAfter(globPrefix(pattern), after, func(key, _ string) bool {
+		if visited == count {
+			more = true
+			return false
+		}
+		visited++
+		last = key
+		if globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		c.w.storeError(err)
+		return
+	}
+
+	next := uint64(0)
+	if more {
+		next = c.addCursor(last)
+	}
+	c.w.array(2)
+	c.w.bulk(strconv.FormatUint(next, 10))
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulk(key)
+	}
+}
+
+// addCursor registers a cursor continuing after key, forgetting the oldest
+// one when the connection holds too many.
+func (c *respConn) addCursor(key string) uint64 {
+	if len(c.cursors) >= maxCursors {
+		oldest := uint64(math.MaxUint64)
+		for id := range c.cursors {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		delete(c.cursors, oldest)
+	}
+	c.nextCursor++
+	c.cursors[c.nextCursor] = key
+	return c.nextCursor
+}
+
+// globPrefix returns the literal start of a glob pattern.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch reports whether s matches a Redis style glob pattern: * matches
+// any sequence, ? any single byte, [abc], [^abc] and [a-z] a byte from a set
+// and \ escapes the next byte.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '[':
+			if s == "" {
+				return false
+			}
+			var ok bool
+			if ok, pattern = matchClass(pattern[1:], s[0]); !ok {
+				return false
+			}
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// matchClass matches b against the character class at the start of pattern,
+// just after the '[', and returns the pattern after the class.
+func matchClass(pattern string, b byte) (bool, string) {
+	negate := strings.HasPrefix(pattern, "^")
+	if negate {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		hi := lo
+		if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+			hi = pattern[2]
+			pattern = pattern[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= b && b <= hi {
+			match = true
+		}
+		pattern = pattern[1:]
+	}
+	pattern = strings.TrimPrefix(pattern, "]")
+	return match != negate, pattern
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// respError is an error reply.
+type respError string
+
+// respClient is a minimal RESP2 client. Replies are decoded to string,
+// int64, nil, respError or []interface{}.
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startResp(t *testing.T, store versionedStore) string {
+	t.Helper()
+	return serveResp(t, NewRespServer(store))
+}
+
+// serveResp serves s on a new local port and returns the address.
+func serveResp(t *testing.T, s *RespServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve failed: %s", err)
+		}
+	})
+	return l.Addr().String()
+}
+
+func dialResp(t *testing.T, addr string) *respClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	c.t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *respClient) do(args ...string) interface{} {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+func (c *respClient) read() interface{} {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return respError(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:size])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		res := make([]interface{}, n)
+		for i := range res {
+			res[i] = c.read()
+		}
+		return res
+	}
+	c.t.Fatalf("Bad reply %q", line)
+	return nil
+}
+
+func (c *respClient) expect(expected interface{}, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, expected) {
+		c.t.Errorf("%q: expected %#v, got %#v", args, expected, got)
+	}
+}
+
+func TestRespServer(t *testing.T) {
+	db := newMemDb(t)
+	c := dialResp(t, startResp(t, db))
+
+	t.Run("Ping", func(t *testing.T) {
+		c.expect("PONG", "PING")
+		c.expect("hello", "ping", "hello")
+	})
+
+	t.Run("Get Set", func(t *testing.T) {
+		c.expect(nil, "GET", "k1")
+		c.expect("OK", "SET", "k1", "v1")
+		c.expect("v1", "GET", "k1")
+		c.expect("OK", "set", "bin", "\x00\r\n\xff")
+		c.expect("\x00\r\n\xff", "get", "bin")
+		if value, _ := db.Get("k1"); value != "v1" {
+			t.Errorf("Value not stored in the db: %q", value)
+		}
+		c.expect(respError("ERR syntax error"), "SET", "k1", "v", "PX", "10")
+		c.expect(respError("ERR invalid expire time in 'set' command"), "SET", "k1", "v", "EX", "0")
+		c.expect(respError("ERR invalid key"), "SET", "\x00k", "v")
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		c.expect("OK", "SET", "kept", "v", "EX", "1")
+		c.expect("OK", "SET", "kept", "v2")
+		// A write through another frontend outdates the expiry too.
+		c.expect("OK", "SET", "other", "v", "EX", "1")
+		db.Put("other", "http")
+		c.expect("OK", "SET", "counter:ttl", "1", "EX", "1")
+		c.expect(int64(2), "INCRBY", "counter:ttl", "1")
+		c.expect("OK", "SET", "temp", "v", "EX", "1")
+		eventually(t, "temp to expire", func() bool {
+			_, err := db.Get("temp")
+			return err == datastore.ErrNotFound
+		})
+		eventually(t, "the incremented counter to expire", func() bool {
+			_, err := db.Get("counter:ttl")
+			return err == datastore.ErrNotFound
+		})
+		c.expect("v2", "GET", "kept")
+		c.expect("http", "GET", "other")
+	})
+
+	t.Run("Del Exists", func(t *testing.T) {
+		c.expect("OK", "SET", "d1", "v")
+		c.expect("OK", "SET", "d2", "v")
+		c.expect(int64(3), "EXISTS", "d1", "d2", "d1", "missing")
+		c.expect(int64(2), "DEL", "d1", "d2", "d2", "missing")
+		c.expect(int64(0), "EXISTS", "d1", "d2")
+	})
+
+	t.Run("IncrBy", func(t *testing.T) {
+		c.expect(int64(5), "INCRBY", "counter", "5")
+		c.expect(int64(2), "INCRBY", "counter", "-3")
+		c.expect(respError("ERR value is not an integer or out of range"), "INCRBY", "k1", "1")
+		c.expect(respError("ERR value is not an integer or out of range"), "INCRBY", "counter", "x")
+	})
+
+	t.Run("MGet", func(t *testing.T) {
+		c.expect([]interface{}{"v1", nil, "2"}, "MGET", "k1", "missing", "counter")
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		for i := 0; i < 25; i++ {
+			c.expect("OK", "SET", fmt.Sprintf("scan:%02d", i), "v")
+		}
+		var keys []string
+		cursor := "0"
+		for calls := 0; ; calls++ {
+			if calls > 20 {
+				t.Fatal("SCAN does not finish")
+			}
+			reply := c.do("SCAN", cursor, "MATCH", "scan:?[05]", "COUNT", "4").([]interface{})
+			cursor = reply[0].(string)
+			for _, key := range reply[1].([]interface{}) {
+				keys = append(keys, key.(string))
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+		expected := []string{"scan:00", "scan:05", "scan:10", "scan:15", "scan:20"}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected %v, got %v", expected, keys)
+		}
+		c.expect(respError("ERR invalid cursor"), "SCAN", "12345")
+		c.expect(respError("ERR invalid pattern"), "SCAN", "0", "MATCH", "\x00team\x00*")
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		c.expect(respError("ERR unknown command 'FLUSHALL'"), "FLUSHALL")
+		c.expect(respError("ERR wrong number of arguments for 'get' command"), "GET")
+	})
+
+	t.Run("Pipelining and Inline Commands", func(t *testing.T) {
+		io.WriteString(c.conn, "PING\r\n*2\r\n$3\r\nGET\r\n$2\r\nk1\r\nEXISTS k1\r\n")
+		for _, expected := range []interface{}{"PONG", "v1", int64(1)} {
+			if got := c.read(); !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected %#v, got %#v", expected, got)
+			}
+		}
+	})
+
+	t.Run("Protocol Error", func(t *testing.T) {
+		bad := dialResp(t, c.conn.RemoteAddr().String())
+		io.WriteString(bad.conn, "*1\r\n:1\r\n")
+		if got, ok := bad.read().(respError); !ok || !strings.HasPrefix(string(got), "ERR Protocol error") {
+			t.Errorf("Expected a protocol error, got %#v", got)
+		}
+		if _, err := bad.r.ReadByte(); err != io.EOF {
+			t.Errorf("Expected the connection to be closed, got %v", err)
+		}
+	})
+}
+
+func TestRespServer_ReadOnly(t *testing.T) {
+	db := newMemDb(t)
+	db.Put("key", "value")
+	c := dialResp(t, startResp(t, readOnlyStore{db}))
+	c.expect("value", "GET", "key")
+	c.expect(respError("READONLY You can't write against a read only replica."), "SET", "key", "v")
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+	} {
+		if got := globMatch(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("globMatch(%q, %q) = %t, expected %t", tc.pattern, tc.s, got, tc.match)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// scanPath lists keys in ascending order:
+// GET /db/_scan?prefix=<prefix>&after=<key>&limit=<n>. after and limit page
+// through large key ranges; a limit of 0 means no limit.
+const scanPath = "_scan"
+
+type ScanResponse struct {
+	Entries []Response `json:"entries"`
+}
+
+func (h *Handler) scan(rw http.ResponseWriter, req *http.Request) {
+	if !checkQuery(rw, req, "scan") {
+		return
+	}
+	query := req.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("after")
+	if !h.authorize(rw, req, readRight, prefix) {
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	resp := ScanResponse{Entries: []Response{}}
+	err := h.store.ScanAfter(prefix, after, func(key, value string) bool {
+		resp.Entries = append(resp.Entries, Response{Key: key, Value: value})
+		return limit == 0 || len(resp.Entries) < limit
+	})
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
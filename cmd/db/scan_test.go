@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestScan(t *testing.T) {
+	store := datastore.NewMemStore()
+	for _, key := range []string{"a1", "a2", "a3", "b1"} {
+		store.Put(key, "v"+key)
+	}
+	b, _ := store.Bucket("team")
+	b.Put("a9", "bucket")
+	h := NewHandler(store)
+
+	scan := func(t *testing.T, path string) []string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d", path, rec.Code)
+		}
+		var resp ScanResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, e := range resp.Entries {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	for path, expected := range map[string][]string{
+		"/db/_scan":                        {"a1", "a2", "a3", "b1"},
+		"/db/_scan?prefix=a&limit=2":       {"a1", "a2"},
+		"/db/_scan?prefix=a&after=a2":      {"a3"},
+		"/db/team/_scan":                   {"a9"},
+		"/db/_scan?prefix=c":               nil,
+		"/db/_scan?after=a1&limit=1&x=ign": {"a2"},
+	} {
+		if keys := scan(t, path); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Unexpected keys for %s: %v, expected %v", path, keys, expected)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/_scan?limit=-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad limit, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := parseConfig([]string{"-addr", "127.0.0.1:0", "-data-dir", dir, "-segment-size", "1K"}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + svc.server.Addr()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	// An open watch stream must not hold the shutdown up.
+	watch, err := http.Get(base + "/db/_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Body.Close()
+
+	var (
+		lock  sync.Mutex
+		acked = make(map[string]string)
+		wg    sync.WaitGroup
+	)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				key := fmt.Sprintf("w%d-%d", w, i)
+				value := strings.Repeat("v", i%50) + key
+				resp, err := http.Post(base+"/db/"+key, "application/json", strings.NewReader(`{"value":"`+value+`"}`))
+				if err != nil {
+					// The server is gone.
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusCreated {
+					lock.Lock()
+					acked[key] = value
+					lock.Unlock()
+				}
+			}
+		}(w)
+	}
+
+	eventually(t, "a write burst", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(acked) >= 500
+	})
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sigs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM not delivered")
+	}
+
+	started := time.Now()
+	if err := svc.shutdown(10 * time.Second); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	// A stream left open would run into the timeout. net/http waits up to 5s
+	// for connections accepted just before the shutdown, so allow for that.
+	if elapsed := time.Since(started); elapsed > 8*time.Second {
+		t.Errorf("Shutdown took %s, streams were not closed", elapsed)
+	}
+	wg.Wait()
+
+	db, err := datastore.NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, value := range acked {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Fatalf("Acknowledged write of %s lost: %q, %v", key, got, err)
+		}
+	}
+	t.Logf("%d acknowledged writes survived the shutdown", len(acked))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Atomic operations are requested with POST /db/<key>:<operation>.
+const (
+	opIncrement = "increment"
+	opAppend    = "append"
+	opGetOrSet  = "getOrSet"
+)
+
+// splitOperation splits an atomic operation off the end of key. A key whose
+// suffix is not a known operation is left alone, so keys may contain colons.
+func splitOperation(key string) (string, string, bool) {
+	i := strings.LastIndexByte(key, ':')
+	if i < 0 {
+		return key, "", false
+	}
+	switch op := key[i+1:]; op {
+	case opIncrement, opAppend, opGetOrSet:
+		return key[:i], op, true
+	}
+	return key, "", false
+}
+
+// update runs an atomic operation and responds with the resulting value.
+// GetOrSet answers 201 when it stored the default.
+func (h *Handler) update(rw http.ResponseWriter, req *http.Request, key, op string) {
+	var body Request
+	if !decode(rw, req, op, &body) {
+		return
+	}
+
+	ctx := req.Context()
+	status := http.StatusOK
+	var (
+		value string
+		err   error
+	)
+	switch op {
+	case opIncrement:
+		delta := int64(1)
+		if body.Delta != nil {
+			delta = *body.Delta
+		}
+		var n int64
+		n, err = h.store.IncrementContext(ctx, key, delta)
+		value = strconv.FormatInt(n, 10)
+	case opAppend:
+		value, err = h.store.AppendContext(ctx, key, body.Value)
+	case opGetOrSet:
+		var loaded bool
+		value, loaded, err = h.store.GetOrSetContext(ctx, key, body.Value)
+		if !loaded {
+			status = http.StatusCreated
+		}
+	}
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(Response{Key: key, Value: value})
+}
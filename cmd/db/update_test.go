@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestUpdate(t *testing.T) {
+	store := datastore.NewMemStore()
+	h := NewHandler(store)
+
+	do := func(t *testing.T, path, body string, expectedCode int) Response {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if rec.Code != expectedCode {
+			t.Fatalf("Expected %d for %s, got %d", expectedCode, path, rec.Code)
+		}
+		var resp Response
+		if expectedCode < 300 {
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	t.Run("Increment", func(t *testing.T) {
+		if resp := do(t, "/db/hits:increment", "", http.StatusOK); resp.Key != "hits" || resp.Value != "1" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+		if resp := do(t, "/db/hits:increment", `{"delta":10}`, http.StatusOK); resp.Value != "11" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+		store.Put("text", "value")
+		do(t, "/db/text:increment", "", http.StatusConflict)
+	})
+
+	t.Run("Concurrent Increment", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/counter:increment", nil))
+			}()
+		}
+		wg.Wait()
+		if value, _ := store.Get("counter"); value != "20" {
+			t.Errorf("Expected 20 increments, got %q", value)
+		}
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		do(t, "/db/log:append", `{"value":"a"}`, http.StatusOK)
+		if resp := do(t, "/db/log:append", `{"value":"b"}`, http.StatusOK); resp.Value != "ab" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("GetOrSet", func(t *testing.T) {
+		if resp := do(t, "/db/config:getOrSet", `{"value":"default"}`, http.StatusCreated); resp.Value != "default" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+		if resp := do(t, "/db/config:getOrSet", `{"value":"other"}`, http.StatusOK); resp.Value != "default" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("Plain Key With Colon", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/a:b", strings.NewReader(`{"value":"v"}`)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", rec.Code)
+		}
+		if value, _ := store.Get("a:b"); value != "v" {
+			t.Errorf("Unexpected stored value %q", value)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// watchPath streams changes as Server-Sent Events:
+// GET /db/_watch?prefix=<prefix>&since=<version>. Reconnecting EventSource
+// clients resume through the Last-Event-ID header instead of since. Puts of
+// large or binary values come with valueOmitted set instead of the value.
+const watchPath = "_watch"
+
+// streams lets a server end its long-lived responses.
+type streams struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newStreams() *streams {
+	return &streams{done: make(chan struct{})}
+}
+
+func (s *streams) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// keepAliveInterval is how often a comment is sent on an idle stream, so
+// proxies do not close it.
+const keepAliveInterval = 15 * time.Second
+
+func (h *Handler) watch(rw http.ResponseWriter, req *http.Request) {
+	watcher, ok := h.store.(datastore.Watcher)
+	if !ok {
+		writeErrorCode(rw, http.StatusNotImplemented, codeNotImplemented, datastore.ErrWatchUnsupported.Error())
+		return
+	}
+
+	if !checkQuery(rw, req, "watch") {
+		return
+	}
+	prefix := req.URL.Query().Get("prefix")
+	if !h.authorize(rw, req, readRight, prefix) {
+		return
+	}
+
+	since := req.URL.Query().Get("since")
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	var version uint64
+	if since != "" {
+		var err error
+		if version, err = strconv.ParseUint(since, 10, 64); err != nil {
+			writeErrorCode(rw, http.StatusBadRequest, codeBadRequest, "since must be a version number")
+			return
+		}
+	}
+
+	changes, err := watcher.Watch(req.Context(), prefix, version)
+	if errors.Is(err, datastore.ErrWatchExpired) {
+		writeErrorCode(rw, http.StatusGone, codeWatchExpired, err.Error())
+		return
+	} else if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	// The stream outlives the server write timeout.
+	rc := http.NewResponseController(rw)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(c)
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", c.Version, c.Op, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		case <-h.streams.done:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestWatch(t *testing.T) {
+	store := datastore.NewMemStore()
+	server := httptest.NewServer(NewHandler(store))
+	defer server.Close()
+
+	store.Put("user:1", "alice")
+	store.Put("user:2", "bob")
+
+	resp, err := http.Get(server.URL + "/db/_watch?prefix=user:&since=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+
+	store.Put("other", "ignored")
+	store.Delete("user:2")
+
+	lines := bufio.NewScanner(resp.Body)
+	var events []string
+	for len(events) < 2 && lines.Scan() {
+		if line := lines.Text(); strings.HasPrefix(line, "data: ") {
+			events = append(events, line)
+		}
+	}
+	expected := []string{
+		`data: {"key":"user:2","op":"put","version":2,"value":"bob"}`,
+		`data: {"key":"user:2","op":"delete","version":4}`,
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected events:\n%s\nexpected:\n%s", strings.Join(events, "\n"), strings.Join(expected, "\n"))
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/db/_watch", nil)
+	req.Header.Set("Last-Event-ID", "100")
+	gone, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Body.Close()
+	if gone.StatusCode != http.StatusGone {
+		t.Errorf("Expected 410 for an unknown version, got %d", gone.StatusCode)
+	}
+}
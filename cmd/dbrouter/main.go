@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/httptools"
+	"github.com/roman-mazur/design-practice-2-template/signal"
+)
+
+const usage = `Usage:
+  dbrouter [-port <port>] -shards <url,url,...> [-vnodes <n>]
+  dbrouter rebalance -from <url,url,...> -to <url,url,...> [-vnodes <n>] [-token <token>]
+
+Serves the db API on top of several db shards, or moves keys between shards
+after the shard list changed.
+`
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rebalance" {
+		rebalance(os.Args[2:])
+		return
+	}
+	serve(os.Args[1:])
+}
+
+func splitShards(list string) []string {
+	var shards []string
+	for _, shard := range strings.Split(list, ",") {
+		if shard = strings.TrimSuffix(strings.TrimSpace(shard), "/"); shard != "" {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("dbrouter", flag.ExitOnError)
+	port := flags.Int("port", 8084, "router port")
+	shards := flags.String("shards", "", "comma separated base URLs of the db shards")
+	vnodes := flags.Int("vnodes", 64, "virtual nodes per shard on the hash ring")
+	_ = flags.Parse(args)
+
+	ring := NewRing(splitShards(*shards), *vnodes)
+	if len(ring.Shards()) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	h := http.NewServeMux()
+	h.Handle("/db/", NewRouter(ring, http.DefaultClient))
+
+	log.Printf("Routing over %d shards: %s", len(ring.Shards()), strings.Join(ring.Shards(), ", "))
+	server := httptools.CreateServer(*port, h)
+	server.Start()
+	signal.WaitForTerminationSignal()
+}
+
+func rebalance(args []string) {
+	flags := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	from := flags.String("from", "", "comma separated shard URLs keys are currently placed by")
+	to := flags.String("to", "", "comma separated shard URLs keys should be placed by")
+	vnodes := flags.Int("vnodes", 64, "virtual nodes per shard on the hash ring")
+	token := flags.String("token", "", "bearer token for shards started with -tokens, with read and write access to every key")
+	_ = flags.Parse(args)
+
+	fromRing, toRing := NewRing(splitShards(*from), *vnodes), NewRing(splitShards(*to), *vnodes)
+	if len(fromRing.Shards()) == 0 || len(toRing.Shards()) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	rebalancer := NewRebalancer(fromRing, toRing, http.DefaultClient)
+	rebalancer.Token = *token
+	moved, err := rebalancer.Run(context.Background())
+	log.Printf("Moved %d keys", moved)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
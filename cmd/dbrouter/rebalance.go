@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// rebalancePage is the number of keys listed per scan request.
+const rebalancePage = 500
+
+// Rebalancer moves keys between shards after the shard list changed. It
+// copies every key whose owner differs between the old and the new ring to
+// its new owner and then deletes it from the old one. Routers should switch
+// to the new shard list once it is done; writes to moved keys made in between
+// can be lost.
+type Rebalancer struct {
+	// Token is the bearer token sent to the shards, if not empty. It needs
+	// read and write access to every key.
+	Token string
+
+	from, to *Ring
+	client   *http.Client
+}
+
+func NewRebalancer(from, to *Ring, client *http.Client) *Rebalancer {
+	return &Rebalancer{from: from, to: to, client: client}
+}
+
+// Run returns the number of moved keys.
+func (b *Rebalancer) Run(ctx context.Context) (int, error) {
+	moved := 0
+	for _, shard := range b.from.Shards() {
+		buckets, err := b.buckets(ctx, shard)
+		if err != nil {
+			return moved, fmt.Errorf("%s: %w", shard, err)
+		}
+		for _, bucket := range buckets {
+			n, err := b.moveBucket(ctx, shard, bucket)
+			moved += n
+			if err != nil {
+				return moved, fmt.Errorf("%s: %w", shard, err)
+			}
+		}
+	}
+	return moved, nil
+}
+
+func (b *Rebalancer) do(ctx context.Context, method, url, contentType string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	if b.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.StatusCode, err
+}
+
+// buckets returns the path prefixes of the non-empty buckets of a shard: ""
+// for the default bucket and "<name>/" for the others.
+func (b *Rebalancer) buckets(ctx context.Context, shard string) ([]string, error) {
+	data, status, err := b.do(ctx, http.MethodGet, shard+"/admin/stats", "", nil)
+	if err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		return nil, fmt.Errorf("stats: unexpected status %d", status)
+	}
+	var stats struct {
+		Buckets map[string]json.RawMessage `json:"buckets"`
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, err
+	}
+	res := []string{""}
+	for name := range stats.Buckets {
+		if name != defaultBucket {
+			res = append(res, name+"/")
+		}
+	}
+	return res, nil
+}
+
+func (b *Rebalancer) moveBucket(ctx context.Context, shard, bucket string) (int, error) {
+	moved := 0
+	after := ""
+	for {
+		query := url.Values{"limit": {strconv.Itoa(rebalancePage)}, "after": {after}}
+		data, status, err := b.do(ctx, http.MethodGet, shard+"/db/"+bucket+"_scan?"+query.Encode(), "", nil)
+		if err != nil {
+			return moved, err
+		} else if status != http.StatusOK {
+			return moved, fmt.Errorf("scan: unexpected status %d", status)
+		}
+		var page ScanResponse
+		if err := json.Unmarshal(data, &page); err != nil {
+			return moved, err
+		}
+
+		var done []string
+		for _, e := range page.Entries {
+			owner := b.to.Owner(bucket + e.Key)
+			if owner == shard {
+				continue
+			}
+			copied, err := b.move(ctx, shard, owner, bucket+url.PathEscape(e.Key))
+			if err != nil {
+				return moved, err
+			} else if copied {
+				done = append(done, e.Key)
+			}
+		}
+		if len(done) > 0 {
+			body, _ := json.Marshal(ManyRequest{Keys: done})
+			if _, status, err := b.do(ctx, http.MethodPost, shard+"/db/"+bucket+"_mdelete", "application/json", body); err != nil {
+				return moved, err
+			} else if status != http.StatusNoContent {
+				return moved, fmt.Errorf("delete: unexpected status %d", status)
+			}
+			moved += len(done)
+		}
+
+		if len(page.Entries) < rebalancePage {
+			return moved, nil
+		}
+		after = page.Entries[len(page.Entries)-1].Key
+	}
+}
+
+// move copies the raw value at path from one shard to another. It reports
+// false if the key was deleted since the scan. The copy is a PUT, which
+// cmd/db takes literally, while a POST to a key such as "a:append" would
+// append to "a".
+func (b *Rebalancer) move(ctx context.Context, from, to, path string) (bool, error) {
+	value, status, err := b.do(ctx, http.MethodGet, from+"/db/"+path, "", nil)
+	if err != nil {
+		return false, err
+	} else if status == http.StatusNotFound {
+		return false, nil
+	} else if status != http.StatusOK {
+		return false, fmt.Errorf("get %s: unexpected status %d", path, status)
+	}
+	if _, status, err := b.do(ctx, http.MethodPut, to+"/db/"+path, "application/octet-stream", value); err != nil {
+		return false, err
+	} else if status != http.StatusNoContent {
+		return false, fmt.Errorf("put %s to %s: unexpected status %d", path, to, status)
+	}
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Ring assigns keys to shards by consistent hashing. Every shard owns
+// several points on the ring, so adding a shard takes over a small share of
+// keys from each of the others instead of reshuffling all of them.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+	shards []string
+}
+
+// NewRing places vnodes points for every shard on the ring.
+func NewRing(shards []string, vnodes int) *Ring {
+	r := &Ring{
+		owners: make(map[uint32]string),
+		shards: shards,
+	}
+	for _, shard := range shards {
+		for i := 0; i < vnodes; i++ {
+			point := hash(shard + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = shard
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the shard responsible for key: the one owning the first
+// point at or after the key hash.
+func (r *Ring) Owner(key string) string {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func (r *Ring) Shards() []string {
+	return r.shards
+}
+
+// hash is FNV-1a followed by the murmur3 finalizer. FNV alone leaves similar
+// short strings such as "db1#7" and "db1#8" close together on the ring.
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	shards := []string{"http://db1", "http://db2", "http://db3"}
+	ring := NewRing(shards, 64)
+
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := ring.Owner(key)
+		counts[owner]++
+		owners[key] = owner
+		if again := ring.Owner(key); again != owner {
+			t.Fatalf("Unstable owner for %s: %s and %s", key, owner, again)
+		}
+	}
+	for _, shard := range shards {
+		if counts[shard] < 600 {
+			t.Errorf("Shard %s got only %d of 3000 keys: %v", shard, counts[shard], counts)
+		}
+	}
+
+	grown := NewRing(append(shards, "http://db4"), 64)
+	moved := 0
+	for key, owner := range owners {
+		if newOwner := grown.Owner(key); newOwner != owner {
+			moved++
+			if newOwner != "http://db4" {
+				t.Fatalf("Key %s moved between old shards: %s -> %s", key, owner, newOwner)
+			}
+		}
+	}
+	if moved == 0 || moved > 1200 {
+		t.Errorf("Expected about a quarter of the keys to move, moved %d", moved)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// These mirror the request and response bodies of cmd/db.
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type ManyRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type ManyResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+type ScanResponse struct {
+	Entries []Entry `json:"entries"`
+}
+
+// defaultBucket is the bucket cmd/db keeps keys without a bucket in:
+// /db/default/<key> and /db/<key> address the same key.
+const defaultBucket = "default"
+
+// operations are the atomic operations cmd/db accepts as a key suffix.
+var operations = []string{":increment", ":append", ":getOrSet"}
+
+// Router serves the cmd/db /db/ API on top of several db shards. Single key
+// requests go to the shard owning the key, batch and scan requests are split
+// across the shards and their results merged. A key of a named bucket is
+// placed by "<bucket>/<key>", so a bucket spreads across all shards, and a
+// key of the default bucket by the key alone, however it is addressed.
+type Router struct {
+	ring   *Ring
+	client *http.Client
+}
+
+func NewRouter(ring *Ring, client *http.Client) *Router {
+	return &Router{ring: ring, client: client}
+}
+
+func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/db/")
+	bucket, name := "", path
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucket, name = path[:i+1], path[i+1:]
+	}
+	// placement prefixes the keys of bucket on the ring.
+	placement := bucket
+	if bucket == defaultBucket+"/" {
+		placement = ""
+	}
+
+	switch {
+	case req.Method == http.MethodDelete && bucket != "" && name == "":
+		r.broadcast(rw, req)
+	case req.Method == http.MethodGet && name == "_scan":
+		r.scan(rw, req)
+	case req.Method == http.MethodGet && name == "_watch":
+		// Every shard numbers its writes on its own, there is no single
+		// stream to resume from.
+		rw.WriteHeader(http.StatusNotImplemented)
+	case req.Method == http.MethodPost && name == "_mget":
+		r.getMany(rw, req, placement)
+	case req.Method == http.MethodPost && name == "_mdelete":
+		r.deleteMany(rw, req, placement)
+	default:
+		key := name
+		if req.Method == http.MethodPost {
+			key = operationKey(key)
+		}
+		r.forward(rw, req, r.ring.Owner(placement+key))
+	}
+}
+
+// operationKey returns the key a POST to name operates on. Like cmd/db, only
+// the last ":<op>" of name is an operation: a:append:increment increments
+// a:append.
+func operationKey(name string) string {
+	i := strings.LastIndexByte(name, ':')
+	if i < 0 {
+		return name
+	}
+	for _, op := range operations {
+		if name[i:] == op {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// send makes a request to a shard, copying the content negotiation and
+// Authorization headers of the original request. Shards check the token.
+func (r *Router) send(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"Content-Type", "Accept", "Authorization"} {
+		if v := header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	return r.client.Do(req)
+}
+
+func (r *Router) forward(rw http.ResponseWriter, req *http.Request, shard string) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp, err := r.send(req.Context(), req.Method, shard+req.URL.RequestURI(), req.Header, body)
+	if err != nil {
+		log.Printf("Failed to reach shard %s: %s", shard, err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(rw, resp.Body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+// shardResult is the outcome of one request of a fan-out.
+type shardResult struct {
+	status int
+	body   []byte
+}
+
+// fanOut sends a request to every shard in bodies in parallel. It fails with
+// the status of the first shard that did not answer with ok.
+func (r *Router) fanOut(req *http.Request, path string, bodies map[string][]byte, ok int) (map[string][]byte, int) {
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		results = make(map[string]shardResult)
+	)
+	for shard, body := range bodies {
+		wg.Add(1)
+		go func(shard string, body []byte) {
+			defer wg.Done()
+			res := shardResult{status: http.StatusBadGateway}
+			resp, err := r.send(req.Context(), req.Method, shard+path, req.Header, body)
+			if err != nil {
+				log.Printf("Failed to reach shard %s: %s", shard, err)
+			} else {
+				res.status = resp.StatusCode
+				res.body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					res.status = http.StatusBadGateway
+				}
+			}
+			lock.Lock()
+			results[shard] = res
+			lock.Unlock()
+		}(shard, body)
+	}
+	wg.Wait()
+
+	merged := make(map[string][]byte, len(results))
+	for _, shard := range r.ring.Shards() {
+		res, sent := results[shard]
+		if !sent {
+			continue
+		}
+		if res.status != ok {
+			return nil, res.status
+		}
+		merged[shard] = res.body
+	}
+	return merged, ok
+}
+
+// all sends the same body to every shard.
+func (r *Router) all(body []byte) map[string][]byte {
+	bodies := make(map[string][]byte)
+	for _, shard := range r.ring.Shards() {
+		bodies[shard] = body
+	}
+	return bodies
+}
+
+// split groups keys by the shard owning them and encodes a batch request for
+// every group. placement is the ring prefix of the bucket of keys.
+func (r *Router) split(placement string, keys []string) map[string][]byte {
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		owner := r.ring.Owner(placement + key)
+		groups[owner] = append(groups[owner], key)
+	}
+	bodies := make(map[string][]byte, len(groups))
+	for shard, keys := range groups {
+		bodies[shard], _ = json.Marshal(ManyRequest{Keys: keys})
+	}
+	return bodies
+}
+
+func (r *Router) broadcast(rw http.ResponseWriter, req *http.Request) {
+	if _, status := r.fanOut(req, req.URL.RequestURI(), r.all(nil), http.StatusNoContent); status != http.StatusNoContent {
+		rw.WriteHeader(status)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Router) getMany(rw http.ResponseWriter, req *http.Request, placement string) {
+	var body ManyRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	results, status := r.fanOut(req, req.URL.RequestURI(), r.split(placement, body.Keys), http.StatusOK)
+	if status != http.StatusOK {
+		rw.WriteHeader(status)
+		return
+	}
+
+	resp := ManyResponse{Values: make(map[string]string), Missing: []string{}}
+	for _, data := range results {
+		var part ManyResponse
+		if err := json.Unmarshal(data, &part); err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		for key, value := range part.Values {
+			resp.Values[key] = value
+		}
+	}
+	// Keep the order the keys were asked for.
+	seen := make(map[string]bool)
+	for _, key := range body.Keys {
+		if _, found := resp.Values[key]; !found && !seen[key] {
+			resp.Missing = append(resp.Missing, key)
+		}
+		seen[key] = true
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+func (r *Router) deleteMany(rw http.ResponseWriter, req *http.Request, placement string) {
+	var body ManyRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, status := r.fanOut(req, req.URL.RequestURI(), r.split(placement, body.Keys), http.StatusNoContent); status != http.StatusNoContent {
+		rw.WriteHeader(status)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// scan asks every shard for the same page and keeps the first limit keys of
+// the merged result.
+func (r *Router) scan(rw http.ResponseWriter, req *http.Request) {
+	limit := 0
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	results, status := r.fanOut(req, req.URL.RequestURI(), r.all(nil), http.StatusOK)
+	if status != http.StatusOK {
+		rw.WriteHeader(status)
+		return
+	}
+
+	resp := ScanResponse{Entries: []Entry{}}
+	for shard, data := range results {
+		var part ScanResponse
+		if err := json.Unmarshal(data, &part); err != nil {
+			log.Printf("Bad scan response from %s: %s", shard, err)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp.Entries = append(resp.Entries, part.Entries...)
+	}
+	sort.Slice(resp.Entries, func(i, j int) bool { return resp.Entries[i].Key < resp.Entries[j].Key })
+	if limit > 0 && len(resp.Entries) > limit {
+		resp.Entries = resp.Entries[:limit]
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// shard is a stand-in for cmd/db serving the parts of its API the router and
+// the rebalancer use.
+type shard struct {
+	*httptest.Server
+	store   *datastore.MemStore
+	buckets []string
+	// token, if set, is the only bearer token the shard accepts.
+	token string
+}
+
+func newShard(t *testing.T, buckets ...string) *shard {
+	s := &shard{store: datastore.NewMemStore(), buckets: append([]string{datastore.DefaultBucket}, buckets...)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// keys lists the stored keys the way the router places them.
+func (s *shard) keys() []string {
+	var keys []string
+	for _, name := range s.buckets {
+		b, _ := s.store.Bucket(name)
+		b.Scan("", func(key, _ string) bool {
+			if name != datastore.DefaultBucket {
+				key = name + "/" + key
+			}
+			keys = append(keys, key)
+			return true
+		})
+	}
+	return keys
+}
+
+func (s *shard) serve(rw http.ResponseWriter, req *http.Request) {
+	if s.token != "" && req.Header.Get("Authorization") != "Bearer "+s.token {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path == "/admin/stats" {
+		buckets := make(map[string]datastore.BucketStats)
+		for _, name := range s.buckets {
+			buckets[name] = datastore.BucketStats{}
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"buckets": buckets})
+		return
+	}
+
+	var store datastore.Store = s.store
+	key := strings.TrimPrefix(req.URL.Path, "/db/")
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		store, _ = datastore.NewBucket(s.store, key[:i])
+		key = key[i+1:]
+	}
+
+	switch {
+	case key == "_scan":
+		resp := ScanResponse{Entries: []Entry{}}
+		after := req.URL.Query().Get("after")
+		store.Scan(req.URL.Query().Get("prefix"), func(key, value string) bool {
+			if key > after {
+				resp.Entries = append(resp.Entries, Entry{key, value})
+			}
+			return true
+		})
+		json.NewEncoder(rw).Encode(resp)
+	case key == "_mget":
+		var body ManyRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		values, missing, _ := store.GetMany(body.Keys)
+		json.NewEncoder(rw).Encode(ManyResponse{values, missing})
+	case key == "_mdelete":
+		var body ManyRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		store.DeleteMany(body.Keys)
+		rw.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPost && strings.HasSuffix(key, ":append"):
+		// Like cmd/db, the operation suffix applies to the rest of the key.
+		var body struct{ Value string }
+		json.NewDecoder(req.Body).Decode(&body)
+		value, _ := store.Append(strings.TrimSuffix(key, ":append"), body.Value)
+		json.NewEncoder(rw).Encode(Entry{key, value})
+	case req.Method == http.MethodPost || req.Method == http.MethodPut:
+		value, _ := io.ReadAll(req.Body)
+		if req.Header.Get("Content-Type") != "application/octet-stream" {
+			var body struct{ Value string }
+			json.Unmarshal(value, &body)
+			value = []byte(body.Value)
+		}
+		store.Put(key, string(value))
+		if req.Method == http.MethodPut {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			rw.WriteHeader(http.StatusCreated)
+		}
+	default:
+		value, err := store.Get(key)
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("Accept") == "application/octet-stream" {
+			io.WriteString(rw, value)
+			return
+		}
+		json.NewEncoder(rw).Encode(Entry{key, value})
+	}
+}
+
+func TestRouter(t *testing.T) {
+	shards := []*shard{newShard(t), newShard(t), newShard(t)}
+	ring := NewRing([]string{shards[0].URL, shards[1].URL, shards[2].URL}, 64)
+	router := httptest.NewServer(NewRouter(ring, http.DefaultClient))
+	defer router.Close()
+
+	var keys []string
+	for i := 0; i < 30; i++ {
+		keys = append(keys, "key"+string(rune('a'+i%26))+strings.Repeat("x", i/26))
+	}
+	for _, key := range keys {
+		resp, err := http.Post(router.URL+"/db/"+key, "application/json", strings.NewReader(`{"value":"v-`+key+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", resp.StatusCode)
+		}
+	}
+
+	t.Run("Placement", func(t *testing.T) {
+		total := 0
+		for _, s := range shards {
+			for _, key := range s.keys() {
+				if owner := ring.Owner(key); owner != s.URL {
+					t.Errorf("Key %s stored on %s, owned by %s", key, s.URL, owner)
+				}
+			}
+			total += len(s.keys())
+			if len(s.keys()) == 0 {
+				t.Errorf("Shard %s got no keys", s.URL)
+			}
+		}
+		if total != len(keys) {
+			t.Errorf("Expected %d stored keys, got %d", len(keys), total)
+		}
+
+		resp, err := http.Get(router.URL + "/db/" + keys[7])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var e Entry
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Value != "v-"+keys[7] {
+			t.Errorf("Unexpected value %+v", e)
+		}
+	})
+
+	t.Run("Multi Get", func(t *testing.T) {
+		body, _ := json.Marshal(ManyRequest{Keys: []string{keys[0], "missing", keys[1], keys[2]}})
+		resp, err := http.Post(router.URL+"/db/_mget", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var many ManyResponse
+		json.NewDecoder(resp.Body).Decode(&many)
+		if len(many.Values) != 3 || many.Values[keys[2]] != "v-"+keys[2] {
+			t.Errorf("Unexpected values %v", many.Values)
+		}
+		if !reflect.DeepEqual(many.Missing, []string{"missing"}) {
+			t.Errorf("Unexpected missing keys %v", many.Missing)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		resp, err := http.Get(router.URL + "/db/_scan?prefix=key&limit=5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var scan ScanResponse
+		json.NewDecoder(resp.Body).Decode(&scan)
+		var got []string
+		for _, e := range scan.Entries {
+			got = append(got, e.Key)
+		}
+		if expected := []string{"keya", "keyax", "keyb", "keybx", "keyc"}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Unexpected merged scan %v, expected %v", got, expected)
+		}
+	})
+
+	t.Run("Multi Delete", func(t *testing.T) {
+		body, _ := json.Marshal(ManyRequest{Keys: keys[:10]})
+		resp, err := http.Post(router.URL+"/db/_mdelete", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", resp.StatusCode)
+		}
+		total := 0
+		for _, s := range shards {
+			total += len(s.keys())
+		}
+		if total != len(keys)-10 {
+			t.Errorf("Expected %d keys left, got %d", len(keys)-10, total)
+		}
+	})
+
+	t.Run("Default Bucket", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			key := "plain" + string(rune('a'+i))
+			resp, err := http.Post(router.URL+"/db/default/"+key, "application/json", strings.NewReader(`{"value":"v"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			resp, err = http.Get(router.URL + "/db/" + key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected %s written through the default bucket to be found, got %d", key, resp.StatusCode)
+			}
+		}
+
+		body, _ := json.Marshal(ManyRequest{Keys: keys[10:20]})
+		resp, err := http.Post(router.URL+"/db/default/_mget", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var many ManyResponse
+		json.NewDecoder(resp.Body).Decode(&many)
+		if len(many.Values) != 10 {
+			t.Errorf("Expected every key through default/_mget, got %v missing", many.Missing)
+		}
+	})
+}
+
+func TestRebalance(t *testing.T) {
+	shards := []*shard{newShard(t, "team"), newShard(t, "team"), newShard(t, "team")}
+	from := NewRing([]string{shards[0].URL, shards[1].URL}, 64)
+	to := NewRing([]string{shards[0].URL, shards[1].URL, shards[2].URL}, 64)
+
+	expected := make(map[string]string)
+	put := func(bucket, key, value string) {
+		owner := shards[0]
+		if from.Owner(bucket+key) == shards[1].URL {
+			owner = shards[1]
+		}
+		if bucket == "" {
+			owner.store.Put(key, value)
+		} else {
+			b, _ := owner.store.Bucket(strings.TrimSuffix(bucket, "/"))
+			b.Put(key, value)
+		}
+		expected[bucket+key] = value
+	}
+	for i := 0; i < 200; i++ {
+		key := "key" + strings.Repeat("k", i%7) + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		put("", key, "\x00binary\xff"+key)
+	}
+	for i := 0; i < 20; i++ {
+		put("team/", "member"+string(rune('a'+i)), "bucket value")
+	}
+	// Keys that look like operations are values like any other.
+	for i := 0; i < 20; i++ {
+		put("", "op"+string(rune('a'+i))+":append", "literal")
+		put("", "op"+string(rune('a'+i)), "base")
+	}
+
+	moved, err := NewRebalancer(from, to, http.DefaultClient).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 || moved != len(shards[2].keys()) {
+		t.Errorf("Expected the moved keys to land on the new shard, moved %d, new shard has %d", moved, len(shards[2].keys()))
+	}
+
+	router := NewRouter(to, http.DefaultClient)
+	for key, value := range expected {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/db/"+key, nil)
+		req.Header.Set("Accept", "application/octet-stream")
+		router.ServeHTTP(rec, req)
+		if rec.Body.String() != value {
+			t.Fatalf("Bad value for %s after rebalancing: %q", key, rec.Body.String())
+		}
+	}
+	for _, s := range shards {
+		for _, key := range s.keys() {
+			if owner := to.Owner(key); owner != s.URL {
+				t.Errorf("Key %q left on %s, owned by %s", key, s.URL, owner)
+			}
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	shards := []*shard{newShard(t), newShard(t)}
+	for _, s := range shards {
+		s.token = "secret"
+	}
+	from := NewRing([]string{shards[0].URL}, 64)
+	to := NewRing([]string{shards[0].URL, shards[1].URL}, 64)
+	router := httptest.NewServer(NewRouter(from, http.DefaultClient))
+	defer router.Close()
+
+	put := func(key, token string) int {
+		req, _ := http.NewRequest(http.MethodPost, router.URL+"/db/"+key, strings.NewReader(`{"value":"v"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := put("key", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", status)
+	}
+	for i := 0; i < 20; i++ {
+		if status := put("key"+string(rune('a'+i)), "secret"); status != http.StatusCreated {
+			t.Fatalf("Expected the token to reach the shard, got %d", status)
+		}
+	}
+
+	rebalancer := NewRebalancer(from, to, http.DefaultClient)
+	if _, err := rebalancer.Run(context.Background()); err == nil {
+		t.Error("Expected the rebalancer to fail without a token")
+	}
+	rebalancer.Token = "secret"
+	if moved, err := rebalancer.Run(context.Background()); err != nil || moved == 0 {
+		t.Errorf("Expected keys to move with the token, moved %d: %v", moved, err)
+	}
+}
+
+func TestOperationKey(t *testing.T) {
+	for name, key := range map[string]string{
+		"a":                  "a",
+		"a:increment":        "a",
+		"a:append:increment": "a:append",
+		"a:increment:x":      "a:increment:x",
+		"user:1:getOrSet":    "user:1",
+		"user:1":             "user:1",
+	} {
+		if got := operationKey(name); got != key {
+			t.Errorf("%s: expected key %s, got %s", name, key, got)
+		}
+	}
+}
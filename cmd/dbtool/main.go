@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const usage = `Usage: dbtool <command> [flags]
+
+Maintenance commands for a datastore directory. Stop the db service first.
+
+Commands:
+  migrate   rewrite segments stored in an older format into the current one
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "migrate":
+		migrate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dir := flags.String("dir", "", "datastore directory")
+	segmentSize := flags.Int64("segment-size", 10*1024*1024, "segment size used for records written after the migration")
+	_ = flags.Parse(args)
+
+	if *dir == "" {
+		log.Fatal("-dir is required")
+	}
+
+	db, err := datastore.NewDb(*dir, *segmentSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := db.Migrate()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("Migration failed after %d segments: %s", n, err)
+	}
+	log.Printf("Migrated %d segments in %s", n, *dir)
+}
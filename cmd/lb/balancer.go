@@ -67,6 +67,10 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 	defer cancel()
 
 	fwdRequest := r.Clone(ctx)
+	body := &bodyReader{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		fwdRequest.Body = body
+	}
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = dst
 	fwdRequest.URL.Scheme = scheme()
@@ -74,6 +78,13 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 
 	resp, err := http.DefaultClient.Do(fwdRequest)
 	if err != nil {
+		// A body that is too large or too slow is the fault of the client,
+		// not of the backend.
+		if status := httptools.BodyErrorStatus(body.err); status != 0 {
+			log.Printf("Failed to read request body for %s: %s", dst, body.err)
+			rw.WriteHeader(status)
+			return body.err
+		}
 		log.Printf("Failed to get response from %s: %s", dst, err)
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		return err
@@ -98,6 +109,21 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// bodyReader keeps the error of reading a request body, which the transport
+// does not always return as is.
+type bodyReader struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
 func main() {
 	flag.Parse()
 
@@ -111,7 +137,7 @@ func main() {
 		if err != nil {
 			return
 		}
-	}))
+	}), httptools.WithMaxBodySize(1<<20))
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
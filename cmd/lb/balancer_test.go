@@ -1,12 +1,15 @@
 package main
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/roman-mazur/design-practice-2-template/httptools"
 	. "gopkg.in/check.v1"
 )
 
@@ -65,3 +68,27 @@ func (s *TestSuite) TestHealth(c *C) {
 	c.Assert(result[1], Equals, hostURL2)
 	c.Assert(result[2], Equals, "")
 }
+
+func (s *TestSuite) TestForwardBodyTooLarge(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	dst := strings.TrimPrefix(backend.URL, "http://")
+
+	frontend := httptest.NewServer(httptools.MaxBodySize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = forward(dst, w, r)
+	}), 10))
+	defer frontend.Close()
+
+	resp, err := http.Post(frontend.URL, "text/plain", strings.NewReader("small"))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = http.Post(frontend.URL, "text/plain", strings.NewReader(strings.Repeat("x", 100)))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/roman-mazur/design-practice-2-template/openapi"
+)
+
+// ErrorResponse is the body of a request rejected by the server.
+type ErrorResponse struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message"`
+	Fields  []openapi.FieldError `json:"fields,omitempty"`
+}
+
+// spec describes the API of the server and is served at /openapi.json.
+var spec = &openapi.Document{
+	OpenAPI: openapi.Version,
+	Info:    openapi.Info{Title: "server", Version: "1"},
+	Paths: map[string]*openapi.PathItem{
+		"/health": {
+			Get: &openapi.Operation{
+				OperationID: "health",
+				Summary:     "Report whether the server is healthy.",
+				Responses: map[string]*openapi.Response{
+					"200": {Description: "Healthy.", Content: map[string]openapi.MediaType{"text/plain": {Schema: &openapi.Schema{Type: "string"}}}},
+					"500": {Description: "Unhealthy.", Content: map[string]openapi.MediaType{"text/plain": {Schema: &openapi.Schema{Type: "string"}}}},
+				},
+			},
+		},
+		"/api/v1/some-data": {
+			Get: &openapi.Operation{
+				OperationID: "getSomeData",
+				Summary:     "Get a value from the db service.",
+				Parameters: []openapi.Parameter{
+					{Name: "key", In: "query", Required: true, Schema: &openapi.Schema{Type: "string", Example: "kentiki"}},
+				},
+				Responses: map[string]*openapi.Response{
+					"200": {Description: "The key and its value.", Content: openapi.JSON(openapi.Ref("Response"))},
+					"400": {Description: "The request is invalid.", Content: openapi.JSON(openapi.Ref("Error"))},
+					"404": {Description: "The key is not found."},
+					"500": {Description: "The db service failed."},
+				},
+			},
+		},
+	},
+	Components: openapi.Components{Schemas: map[string]*openapi.Schema{
+		"Response": {
+			Type: "object",
+			Properties: map[string]*openapi.Schema{
+				"key":   {Type: "string"},
+				"value": {Type: "string"},
+			},
+			Required: []string{"key", "value"},
+		},
+		"Error": {
+			Type: "object",
+			Properties: map[string]*openapi.Schema{
+				"code":    {Type: "string"},
+				"message": {Type: "string"},
+				"fields": {Type: "array", Items: &openapi.Schema{
+					Type: "object",
+					Properties: map[string]*openapi.Schema{
+						"field":   {Type: "string"},
+						"message": {Type: "string"},
+					},
+					Required: []string{"field", "message"},
+				}},
+			},
+			Required: []string{"code", "message"},
+		},
+	}},
+}
+
+// checkQuery checks the query parameters of r against operation and answers
+// 400 with the offending ones if they do not match.
+func checkQuery(rw http.ResponseWriter, r *http.Request, operation string) bool {
+	err := spec.ValidateQuery(spec.Operation(operation), r.URL.Query())
+	if err == nil {
+		return true
+	}
+	resp := ErrorResponse{Code: "bad_request", Message: err.Error()}
+	var invalid *openapi.ValidationError
+	if errors.As(err, &invalid) {
+		resp.Fields = invalid.Fields
+	}
+	writeError(rw, resp)
+	return false
+}
+
+// writeBadRequest answers 400 for an invalid value of the query parameter
+// field.
+func writeBadRequest(rw http.ResponseWriter, field string, err error) {
+	writeError(rw, ErrorResponse{
+		Code:    "bad_request",
+		Message: err.Error(),
+		Fields:  []openapi.FieldError{{Field: field, Message: err.Error()}},
+	})
+}
+
+func writeError(rw http.ResponseWriter, resp ErrorResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
+)
+
+// TestSpec fails when the handlers and the API description disagree.
+func TestSpec(t *testing.T) {
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/db/kentiki" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte("2024-01-01T00:00:00Z"))
+	}))
+	defer db.Close()
+	h := newHandler(dbclient.New(db.URL))
+
+	for path, item := range spec.Paths {
+		for method, op := range item.Operations() {
+			query := url.Values{}
+			for _, p := range op.Parameters {
+				if p.In == "query" && p.Schema.Example != nil {
+					query.Set(p.Name, fmt.Sprint(p.Schema.Example))
+				}
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, path+"?"+query.Encode(), nil))
+			response := op.Responses[strconv.Itoa(rec.Code)]
+			if response == nil || rec.Code >= 300 {
+				t.Errorf("%s %s: expected a documented success, got %d", method, path, rec.Code)
+				continue
+			}
+			if media, ok := response.Content["application/json"]; ok {
+				if err := spec.Validate(media.Schema, rec.Body.Bytes()); err != nil {
+					t.Errorf("%s %s: response does not match the spec: %s", method, path, err)
+				}
+			}
+		}
+	}
+
+	t.Run("Missing Key", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", rec.Code)
+		}
+		if err := spec.Validate(spec.Operation("getSomeData").Responses["400"].Content["application/json"].Schema, rec.Body.Bytes()); err != nil {
+			t.Errorf("Error does not match the spec: %s", err)
+		}
+		var resp ErrorResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		if len(resp.Fields) != 1 || resp.Fields[0].Field != "key" {
+			t.Errorf("Expected an error for the key field, got %+v", resp)
+		}
+	})
+
+	t.Run("Invalid Key", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=a%2Fb", nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", rec.Code)
+		}
+		if err := spec.Validate(spec.Operation("getSomeData").Responses["400"].Content["application/json"].Schema, rec.Body.Bytes()); err != nil {
+			t.Errorf("Error does not match the spec: %s", err)
+		}
+	})
+
+	t.Run("Types", func(t *testing.T) {
+		for name, value := range map[string]interface{}{"Response": Response{}, "Error": ErrorResponse{}} {
+			var fields []string
+			typ := reflect.TypeOf(value)
+			for i := 0; i < typ.NumField(); i++ {
+				name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+				fields = append(fields, name)
+			}
+			properties := spec.Components.Schemas[name].Properties
+			if len(fields) != len(properties) {
+				t.Errorf("%T has fields %v, the %s schema has %d properties", value, fields, name, len(properties))
+			}
+			for _, field := range fields {
+				if properties[field] == nil {
+					t.Errorf("%T.%s is not in the %s schema", value, field, name)
+				}
+			}
+		}
+	})
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
 	"github.com/roman-mazur/design-practice-2-template/signal"
 
 	"github.com/roman-mazur/design-practice-2-template/httptools"
@@ -19,11 +21,7 @@ var port = flag.Int("port", 8080, "server port")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
-const dbUrl = "http://db:8083/db"
-
-type Request struct {
-	Value string "json:\"value\""
-}
+const dbUrl = "http://db:8083"
 
 type Response struct {
 	Key   string "json:\"key\""
@@ -33,9 +31,26 @@ type Response struct {
 func main() {
 	flag.Parse()
 
-	client := http.DefaultClient
+	db := dbclient.New(dbUrl)
+
+	// The API takes no request bodies worth more than a few kilobytes.
+	server := httptools.CreateServer(*port, newHandler(db), httptools.WithMaxBodySize(64<<10))
+	server.Start()
+
+	time.Sleep(5 * time.Second)
+
+	if err := db.Put(context.Background(), "kentiki", time.Now().Format(time.RFC3339)); err != nil {
+		fmt.Println("Failed to store the value:", err)
+		return
+	}
+
+	signal.WaitForTerminationSignal()
+}
 
+// newHandler serves the API of the server, reading data from the db service.
+func newHandler(db *dbclient.Client) http.Handler {
 	mux := http.NewServeMux()
+	mux.Handle("/openapi.json", spec)
 
 	mux.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("Content-Type", "text/plain")
@@ -51,22 +66,22 @@ func main() {
 	report := NewReport()
 
 	mux.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			rw.WriteHeader(http.StatusBadRequest)
+		if !checkQuery(rw, r, "getSomeData") {
 			return
 		}
+		key := r.URL.Query().Get("key")
 
-		resp, err := client.Get(fmt.Sprintf("%s/%s", dbUrl, key))
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
+		value, err := db.Get(r.Context(), key)
+		var dbErr *dbclient.Error
+		if errors.As(err, &dbErr) {
+			rw.WriteHeader(dbErr.Status)
 			return
-		}
-		defer resp.Body.Close()
-
-		statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
-		if !statusOK {
-			rw.WriteHeader(resp.StatusCode)
+		} else if errors.Is(err, dbclient.ErrInvalidKey) {
+			// The client refuses keys the db service cannot address.
+			writeBadRequest(rw, "key", err)
+			return
+		} else if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
@@ -77,37 +92,12 @@ func main() {
 
 		report.Process(r)
 
-		var body Response
-		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
 		rw.Header().Set("Content-Type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(body)
+		_ = json.NewEncoder(rw).Encode(Response{Key: key, Value: value})
 	})
 
-	server := httptools.CreateServer(*port, mux)
-	server.Start()
-
-	time.Sleep(5 * time.Second)
-
-	buffer := new(bytes.Buffer)
-	body := Request{Value: time.Now().Format(time.RFC3339)}
-	if err := json.NewEncoder(buffer).Encode(body); err != nil {
-		fmt.Println("Failed to encode request body:", err)
-		return
-	}
-
-	res, err := client.Post(fmt.Sprintf("%s/kentiki", dbUrl), "application/json", buffer)
-	if err != nil {
-		fmt.Println("Failed to send POST request:", err)
-		return
-	}
-	defer res.Body.Close()
-
-	signal.WaitForTerminationSignal()
+	return mux
 }
 
 func NewReport() *Report {
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var ErrWriteStall = fmt.Errorf("writes are stalled until compaction catches up")
+
+// Backpressure limits how far writes can run ahead of compaction, measured in
+// sealed segments. Every extra segment makes lookups of missing or old keys
+// slower, so once there are SoftLimit sealed segments each write is delayed by
+// Delay for every segment at or above the limit. At HardLimit writes stall:
+// they fail with ErrWriteStall, or wait for a merge when Block is set. Zero
+// limits are disabled.
+type Backpressure struct {
+	SoftLimit int
+	HardLimit int
+	Delay     time.Duration
+	Block     bool
+}
+
+// WithBackpressure enables write backpressure. It is disabled by default.
+func WithBackpressure(b Backpressure) Option {
+	return func(db *Db) { db.backpressure = b }
+}
+
+// writeState reports whether writes are currently slowed down or stalled. It
+// must be called with indexLock held.
+func (db *Db) writeState() (delay time.Duration, stalled bool) {
+	bp := db.backpressure
+	sealed := len(db.segments) - 1
+	if bp.HardLimit > 0 && sealed >= bp.HardLimit {
+		return 0, true
+	}
+	if bp.SoftLimit > 0 && sealed >= bp.SoftLimit {
+		return bp.Delay * time.Duration(sealed-bp.SoftLimit+1), false
+	}
+	return 0, false
+}
+
+// throttle applies backpressure before a write.
+func (db *Db) throttle(ctx context.Context) error {
+	counted := false
+	for {
+		db.indexLock.RLock()
+		delay, stalled := db.writeState()
+		shrunk := db.segmentsShrunk
+		db.indexLock.RUnlock()
+
+		if !stalled {
+			if delay > 0 {
+				db.delayedWrites.Add(1)
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		}
+
+		if !counted {
+			db.stalledWrites.Add(1)
+			counted = true
+		}
+		if !db.backpressure.Block {
+			return ErrWriteStall
+		}
+		select {
+		case <-shrunk:
+		case <-db.closing:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
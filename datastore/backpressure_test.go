@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fillSegments writes pairs of 22 byte records, which fill one 45 byte segment
+// each.
+func fillSegments(t *testing.T, db *Db, count int) {
+	t.Helper()
+	for i := 0; i < count*2; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), "value1"); err != nil {
+			t.Fatalf("Cannot put: %s", err)
+		}
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	bp := Backpressure{SoftLimit: 2, HardLimit: 3, Delay: 20 * time.Millisecond}
+
+	t.Run("Slowdown", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 45, WithCompactionPolicy(nil), WithBackpressure(bp))
+		fillSegments(t, db, 2)
+		if stats := db.Stats(); stats.WriteDelay != 0 {
+			t.Fatalf("Unexpected write delay %s below the soft limit", stats.WriteDelay)
+		}
+
+		db.Put("key", "value1")
+		stats := db.Stats()
+		if stats.WriteDelay != bp.Delay || stats.WriteStalled {
+			t.Fatalf("Expected write delay %s, got %s (stalled %t)", bp.Delay, stats.WriteDelay, stats.WriteStalled)
+		}
+		start := time.Now()
+		db.Put("key", "value1")
+		if elapsed := time.Since(start); elapsed < bp.Delay {
+			t.Errorf("Expected the write to be delayed, took %s", elapsed)
+		}
+		if db.Stats().DelayedWrites != 1 {
+			t.Errorf("Expected 1 delayed write, got %d", db.Stats().DelayedWrites)
+		}
+	})
+
+	t.Run("Stall", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 45, WithCompactionPolicy(nil), WithBackpressure(bp))
+		fillSegments(t, db, 3)
+		db.Put("key", "value1")
+
+		if err := db.Put("key", "value2"); err != ErrWriteStall {
+			t.Fatalf("Expected ErrWriteStall, got %v", err)
+		}
+		stats := db.Stats()
+		if !stats.WriteStalled || stats.StalledWrites != 1 {
+			t.Errorf("Expected a stalled write in stats, got %t and %d", stats.WriteStalled, stats.StalledWrites)
+		}
+		checkValues(t, db, map[string]string{"key": "value1"})
+
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", "value2"); err != nil {
+			t.Errorf("Expected writes to resume after compaction, got %v", err)
+		}
+		if db.Stats().WriteStalled {
+			t.Error("Expected the stall to be cleared")
+		}
+	})
+
+	t.Run("Blocking Stall", func(t *testing.T) {
+		blocking := bp
+		blocking.Block = true
+		db := openMemDb(t, NewMemFS(), 45, WithCompactionPolicy(nil), WithBackpressure(blocking))
+		fillSegments(t, db, 3)
+		db.Put("key", "value1")
+
+		done := make(chan error)
+		go func() { done <- db.Put("key", "value2") }()
+		select {
+		case err := <-done:
+			t.Fatalf("Expected the write to block, got %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("The write stayed blocked after compaction")
+		}
+		checkValues(t, db, map[string]string{"key": "value2"})
+	})
+}
@@ -0,0 +1,206 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DefaultBucket is the name of the bucket that holds keys stored directly
+// through a Db or MemStore.
+const DefaultBucket = "default"
+
+// bucketMarker starts every key of a named bucket, which is stored as
+// marker + name + marker + key. Keys of the default bucket cannot start with
+// the marker, see checkKey.
+const bucketMarker = "\x00"
+
+var (
+	ErrInvalidBucket = fmt.Errorf("invalid bucket name")
+	ErrInvalidKey    = fmt.Errorf("invalid key: a key starting with a NUL byte must be a bucket key")
+)
+
+// checkKey rejects writes of keys that start with bucketMarker without being
+// the stored form of a bucket key. Scans and stats would take them for bucket
+// keys or skip them. A key in the stored form is a key of that bucket, like
+// the ones written through Bucket.
+func checkKey(key string) error {
+	if !strings.HasPrefix(key, bucketMarker) {
+		return nil
+	}
+	if name, _, ok := strings.Cut(key[len(bucketMarker):], bucketMarker); !ok || name == "" {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// Bucket is a namespace inside a Store. It has the same API as the store and
+// sees only its own keys.
+type Bucket struct {
+	store  Store
+	name   string
+	prefix string
+}
+
+var _ Store = (*Bucket)(nil)
+
+// NewBucket returns the bucket called name inside store. Bucket names must not
+// be empty or contain a NUL byte. Buckets are created by storing a key and
+// disappear with their last key.
+func NewBucket(store Store, name string) (*Bucket, error) {
+	if name == "" || strings.Contains(name, bucketMarker) {
+		return nil, ErrInvalidBucket
+	}
+	b := &Bucket{store: store, name: name}
+	if name != DefaultBucket {
+		b.prefix = bucketMarker + name + bucketMarker
+	}
+	return b, nil
+}
+
+func (db *Db) Bucket(name string) (*Bucket, error) { return NewBucket(db, name) }
+
+func (s *MemStore) Bucket(name string) (*Bucket, error) { return NewBucket(s, name) }
+
+func (b *Bucket) Name() string { return b.name }
+
+// bucketName returns the bucket a stored key belongs to.
+func bucketName(key string) string {
+	if !strings.HasPrefix(key, bucketMarker) {
+		return DefaultBucket
+	}
+	name := key[len(bucketMarker):]
+	if i := strings.Index(name, bucketMarker); i >= 0 {
+		return name[:i]
+	}
+	return DefaultBucket
+}
+
+// inScan reports whether a scan for prefix visits key. Scans of the default
+// bucket do not descend into named buckets.
+func inScan(key, prefix string) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	return strings.HasPrefix(prefix, bucketMarker) || !strings.HasPrefix(key, bucketMarker)
+}
+
+// inRange reports whether a scan for prefix starting after the key after
+// visits key. An empty after starts at the first key.
+func inRange(key, prefix, after string) bool {
+	return (after == "" || key > after) && inScan(key, prefix)
+}
+
+func (b *Bucket) Get(key string) (string, error) { return b.store.Get(b.prefix + key) }
+
+func (b *Bucket) Put(key, value string) error { return b.store.Put(b.prefix+key, value) }
+
+func (b *Bucket) Delete(key string) error { return b.store.Delete(b.prefix + key) }
+
+func (b *Bucket) GetContext(ctx context.Context, key string) (string, error) {
+	return b.store.GetContext(ctx, b.prefix+key)
+}
+
+func (b *Bucket) PutContext(ctx context.Context, key, value string) error {
+	return b.store.PutContext(ctx, b.prefix+key, value)
+}
+
+func (b *Bucket) DeleteContext(ctx context.Context, key string) error {
+	return b.store.DeleteContext(ctx, b.prefix+key)
+}
+
+func (b *Bucket) Increment(key string, delta int64) (int64, error) {
+	return b.store.Increment(b.prefix+key, delta)
+}
+
+func (b *Bucket) IncrementContext(ctx context.Context, key string, delta int64) (int64, error) {
+	return b.store.IncrementContext(ctx, b.prefix+key, delta)
+}
+
+func (b *Bucket) Append(key, suffix string) (string, error) {
+	return b.store.Append(b.prefix+key, suffix)
+}
+
+func (b *Bucket) AppendContext(ctx context.Context, key, suffix string) (string, error) {
+	return b.store.AppendContext(ctx, b.prefix+key, suffix)
+}
+
+func (b *Bucket) GetOrSet(key, def string) (string, bool, error) {
+	return b.store.GetOrSet(b.prefix+key, def)
+}
+
+func (b *Bucket) GetOrSetContext(ctx context.Context, key, def string) (string, bool, error) {
+	return b.store.GetOrSetContext(ctx, b.prefix+key, def)
+}
+
+func (b *Bucket) GetMany(keys []string) (map[string]string, []string, error) {
+	return b.GetManyContext(context.Background(), keys)
+}
+
+func (b *Bucket) GetManyContext(ctx context.Context, keys []string) (map[string]string, []string, error) {
+	values, missing, err := b.store.GetManyContext(ctx, b.keys(keys))
+	if err != nil {
+		return nil, nil, err
+	}
+	res := make(map[string]string, len(values))
+	for key, value := range values {
+		res[key[len(b.prefix):]] = value
+	}
+	for i, key := range missing {
+		missing[i] = key[len(b.prefix):]
+	}
+	return res, missing, nil
+}
+
+func (b *Bucket) DeleteMany(keys []string) error {
+	return b.store.DeleteMany(b.keys(keys))
+}
+
+func (b *Bucket) DeleteManyContext(ctx context.Context, keys []string) error {
+	return b.store.DeleteManyContext(ctx, b.keys(keys))
+}
+
+func (b *Bucket) DeleteExisting(keys []string) (int, error) {
+	return b.store.DeleteExisting(b.keys(keys))
+}
+
+func (b *Bucket) DeleteExistingContext(ctx context.Context, keys []string) (int, error) {
+	return b.store.DeleteExistingContext(ctx, b.keys(keys))
+}
+
+func (b *Bucket) Scan(prefix string, fn func(key, value string) bool) error {
+	return b.ScanAfter(prefix, "", fn)
+}
+
+func (b *Bucket) ScanAfter(prefix, after string, fn func(key, value string) bool) error {
+	if after != "" {
+		after = b.prefix + after
+	}
+	return b.store.ScanAfter(b.prefix+prefix, after, func(key, value string) bool {
+		return fn(key[len(b.prefix):], value)
+	})
+}
+
+// Close does nothing, the bucket shares the store with others.
+func (b *Bucket) Close() error { return nil }
+
+// Drop deletes every key in the bucket. Keys stored while it runs may survive.
+func (b *Bucket) Drop() error {
+	var keys []string
+	err := b.Scan("", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return b.DeleteMany(keys)
+}
+
+func (b *Bucket) keys(keys []string) []string {
+	res := make([]string, len(keys))
+	for i, key := range keys {
+		res[i] = b.prefix + key
+	}
+	return res
+}
@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	db := openMemDb(t, NewMemFS(), 1000)
+	a, _ := db.Bucket("a")
+	b, _ := db.Bucket("b")
+
+	db.Put("key", "flat")
+	a.Put("key", "a1")
+	a.Put("key2", "a2")
+	b.Put("key", "b1")
+
+	for store, expected := range map[Store]string{db: "flat", a: "a1", b: "b1"} {
+		if value, err := store.Get("key"); err != nil || value != expected {
+			t.Errorf("Expected %q, got %q, %v", expected, value, err)
+		}
+	}
+	def, _ := db.Bucket(DefaultBucket)
+	if value, _ := def.Get("key"); value != "flat" {
+		t.Errorf("Expected the default bucket to hold flat keys, got %q", value)
+	}
+
+	var keys []string
+	db.Scan("", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if expected := []string{"key"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the default scan to skip buckets, got %q", keys)
+	}
+	keys = nil
+	a.ScanAfter("", "key", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if expected := []string{"key2"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the bucket scan to start after key, got %q", keys)
+	}
+
+	stats := db.Stats()
+	if stats.Buckets[DefaultBucket].Keys != 1 || stats.Buckets["a"].Keys != 2 || stats.Buckets["b"].Keys != 1 {
+		t.Errorf("Unexpected bucket stats %+v", stats.Buckets)
+	}
+
+	if err := a.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get("key2"); err != ErrNotFound {
+		t.Errorf("Expected dropped keys to be gone, got %v", err)
+	}
+	if value, _ := b.Get("key"); value != "b1" {
+		t.Errorf("Expected other buckets to survive a drop, got %q", value)
+	}
+	if _, ok := db.Stats().Buckets["a"]; ok {
+		t.Error("Expected the dropped bucket to disappear from stats")
+	}
+
+	for _, name := range []string{"", "a\x00b"} {
+		if _, err := db.Bucket(name); err != ErrInvalidBucket {
+			t.Errorf("Expected ErrInvalidBucket for %q, got %v", name, err)
+		}
+	}
+
+	// Default keys starting with the marker would alias bucket keys.
+	for _, store := range []Store{db, NewMemStore()} {
+		for _, key := range []string{"\x00", "\x00key", "\x00\x00key"} {
+			if err := store.Put(key, "v"); err != ErrInvalidKey {
+				t.Errorf("%T: expected ErrInvalidKey for %q, got %v", store, key, err)
+			}
+			if _, err := store.Increment(key, 1); err != ErrInvalidKey {
+				t.Errorf("%T: expected ErrInvalidKey incrementing %q, got %v", store, key, err)
+			}
+		}
+		if err := store.Put("\x00b\x00key2", "b2"); err != nil {
+			t.Errorf("%T: expected the stored form of a bucket key to be accepted, got %v", store, err)
+		}
+	}
+	if value, _ := b.Get("key2"); value != "b2" {
+		t.Errorf("Expected a key in the stored form to land in its bucket, got %q", value)
+	}
+	if stats := db.Stats(); stats.Buckets[DefaultBucket].Keys != 1 || stats.Buckets["b"].Keys != 2 {
+		t.Errorf("Unexpected bucket stats %+v", stats.Buckets)
+	}
+}
@@ -0,0 +1,46 @@
+package datastore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBytes(t *testing.T) {
+	fs := NewMemFS()
+	db := openMemDb(t, fs, 45, WithSyncWrites(true))
+
+	pairs := map[string][]byte{
+		"key\x00":  {0, 1, 2, 0xff, 0},
+		"deleted":  []byte(legacyDeletedValue),
+		"\xffutf8": []byte("\xc3\x28 not utf-8"),
+		"empty":    {},
+	}
+	for key, value := range pairs {
+		if err := db.PutBytes([]byte(key), value); err != nil {
+			t.Fatalf("Cannot put %q: %s", key, err)
+		}
+	}
+	check := func(db *Db) {
+		t.Helper()
+		for key, expected := range pairs {
+			value, err := db.GetBytes([]byte(key))
+			if err != nil {
+				t.Fatalf("Cannot get %q: %s", key, err)
+			}
+			if !bytes.Equal(value, expected) {
+				t.Errorf("Bad value for %q: expected %v, got %v", key, expected, value)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db = crash(t, fs, db, 45)
+	check(db)
+
+	if _, err := db.GetBytes([]byte("missing")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package datastore
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+var ErrClosed = fmt.Errorf("datastore is closed")
+
+const (
+	minCompactionBackoff = time.Second
+	maxCompactionBackoff = time.Minute
+	// maxMergesPerRun bounds how many merges one wake-up of the scheduler can
+	// run, in case a policy keeps asking for more.
+	maxMergesPerRun = 8
+)
+
+// CompactionPolicy decides when sealed segments are merged and which ones.
+type CompactionPolicy interface {
+	// Plan picks a run of sealed segments to merge, given as inclusive
+	// indexes into stats.Segments. The last segment there is the active one
+	// and can never be picked. ok is false when nothing should be merged.
+	Plan(stats Stats) (first, last int, ok bool)
+}
+
+// SegmentCountPolicy merges all sealed segments once the total number of
+// segments reaches Threshold.
+type SegmentCountPolicy struct {
+	Threshold int
+}
+
+func (p SegmentCountPolicy) Plan(stats Stats) (int, int, bool) {
+	sealed := len(stats.Segments) - 1
+	if sealed < 2 || len(stats.Segments) < p.Threshold {
+		return 0, 0, false
+	}
+	return 0, sealed - 1, true
+}
+
+// DeadRatioPolicy merges all sealed segments once the share of dead bytes in
+// them reaches Ratio. Nothing is merged while there are fewer than
+// MinDeadBytes dead bytes, so small stores are not rewritten over and over.
+type DeadRatioPolicy struct {
+	Ratio        float64
+	MinDeadBytes int64
+}
+
+func (p DeadRatioPolicy) Plan(stats Stats) (int, int, bool) {
+	sealed := len(stats.Segments) - 1
+	if sealed < 1 {
+		return 0, 0, false
+	}
+
+	var total, dead int64
+	for _, s := range stats.Segments[:sealed] {
+		total += s.TotalBytes
+		dead += s.DeadBytes
+	}
+	if total == 0 || dead < p.MinDeadBytes || float64(dead)/float64(total) < p.Ratio {
+		return 0, 0, false
+	}
+	return 0, sealed - 1, true
+}
+
+// SizeTieredPolicy merges runs of neighbouring sealed segments of similar
+// size. A segment joins the current run while its size stays within
+// [BucketLow, BucketHigh] times the average size of the run, and the first run
+// of at least MinThreshold segments gets merged. Zero fields take the defaults
+// 4, 0.5 and 1.5.
+type SizeTieredPolicy struct {
+	MinThreshold int
+	BucketLow    float64
+	BucketHigh   float64
+}
+
+func (p SizeTieredPolicy) Plan(stats Stats) (int, int, bool) {
+	minThreshold, low, high := p.MinThreshold, p.BucketLow, p.BucketHigh
+	if minThreshold == 0 {
+		minThreshold = 4
+	}
+	if low == 0 {
+		low = 0.5
+	}
+	if high == 0 {
+		high = 1.5
+	}
+
+	sealed := stats.Segments[:len(stats.Segments)-1]
+	start := 0
+	var sum int64
+	for i, s := range sealed {
+		if i > start {
+			avg := float64(sum) / float64(i-start)
+			size := float64(s.TotalBytes)
+			if size < avg*low || size > avg*high {
+				if i-start >= minThreshold {
+					return start, i - 1, true
+				}
+				start, sum = i, 0
+			}
+		}
+		sum += s.TotalBytes
+	}
+	if len(sealed)-start >= minThreshold {
+		return start, len(sealed) - 1, true
+	}
+	return 0, 0, false
+}
+
+// WithCompactionPolicy replaces the default SegmentCountPolicy{Threshold: 3}.
+// A nil policy disables automatic compaction, leaving only Compact.
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(db *Db) { db.policy = policy }
+}
+
+// notifyCompaction asks the scheduler to consult the policy. It must be called
+// with indexLock held.
+func (db *Db) notifyCompaction() {
+	if db.policy == nil || db.compactPending {
+		return
+	}
+	db.compactPending = true
+	db.mergeWg.Add(1)
+	db.compactWake <- struct{}{}
+}
+
+// runCompactions is the background scheduler. It runs one merge at a time,
+// either when the policy asks for it or on a Compact call, and backs off
+// exponentially while merges keep failing.
+func (db *Db) runCompactions() {
+	defer db.background.Done()
+
+	var (
+		backoff time.Duration
+		retry   *time.Timer
+		retryC  <-chan time.Time
+	)
+	for {
+		var (
+			reply chan error
+			woken bool
+		)
+		select {
+		case <-db.closing:
+			if retry != nil {
+				retry.Stop()
+			}
+			return
+		case <-db.compactWake:
+			woken = true
+			db.indexLock.Lock()
+			db.compactPending = false
+			db.indexLock.Unlock()
+		case <-retryC:
+			retry, retryC = nil, nil
+		case reply = <-db.compactReq:
+		}
+
+		var err error
+		ran := true
+		if reply != nil {
+			err = db.compact(true)
+			reply <- err
+		} else if retry == nil {
+			err = db.compact(false)
+		} else {
+			// Still backing off, the pending retry will consult the policy.
+			ran = false
+		}
+		if woken {
+			db.mergeWg.Done()
+		}
+		if !ran {
+			continue
+		}
+
+		if retry != nil {
+			retry.Stop()
+			retry, retryC = nil, nil
+		}
+		if err == nil {
+			backoff = 0
+			continue
+		}
+		backoff *= 2
+		if backoff < minCompactionBackoff {
+			backoff = minCompactionBackoff
+		} else if backoff > maxCompactionBackoff {
+			backoff = maxCompactionBackoff
+		}
+		retry = time.NewTimer(backoff)
+		retryC = retry.C
+	}
+}
+
+// compact runs the merges the policy asks for, or a single merge of all
+// sealed segments when forced.
+func (db *Db) compact(force bool) error {
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
+
+	for i := 0; i < maxMergesPerRun; i++ {
+		db.indexLock.RLock()
+		stats := db.stats()
+		segments := make([]*Segment, len(db.segments))
+		copy(segments, db.segments)
+		db.indexLock.RUnlock()
+
+		sealed := len(segments) - 1
+		first, last, ok := 0, sealed-1, sealed > 0
+		if !force {
+			first, last, ok = db.policy.Plan(stats)
+		}
+		if !ok || first < 0 || first > last || last >= sealed {
+			return nil
+		}
+
+		start := time.Now()
+		err := db.merge(segments[first:last+1], first == 0)
+		db.indexLock.Lock()
+		db.mergeStats.record(time.Since(start), err)
+		db.indexLock.Unlock()
+		if err != nil {
+			log.Printf("Merging segments failed: %s", err)
+			return err
+		}
+		if force {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Compact merges all sealed segments right away, regardless of the policy,
+// and waits for the merge to finish.
+func (db *Db) Compact() error {
+	reply := make(chan error, 1)
+	select {
+	case db.compactReq <- reply:
+	case <-db.closing:
+		return ErrClosed
+	}
+	return <-reply
+}
+
+// stopBackground stops the compaction scheduler, letting a running merge
+// finish first.
+func (db *Db) stopBackground() {
+	db.closeOnce.Do(func() { close(db.closing) })
+	db.background.Wait()
+}
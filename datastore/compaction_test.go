@@ -0,0 +1,141 @@
+package datastore
+
+import (
+	"syscall"
+	"testing"
+)
+
+func statsWithSizes(sizes ...int64) Stats {
+	var stats Stats
+	for i, size := range sizes {
+		stats.Segments = append(stats.Segments, SegmentStats{ID: i, TotalBytes: size})
+	}
+	return stats
+}
+
+func TestCompactionPolicies(t *testing.T) {
+	type plan struct {
+		first, last int
+		ok          bool
+	}
+	check := func(t *testing.T, policy CompactionPolicy, stats Stats, expected plan) {
+		t.Helper()
+		first, last, ok := policy.Plan(stats)
+		if got := (plan{first, last, ok}); ok != expected.ok || (ok && got != expected) {
+			t.Errorf("Unexpected plan %+v, expected %+v", got, expected)
+		}
+	}
+
+	t.Run("Segment Count", func(t *testing.T) {
+		policy := SegmentCountPolicy{Threshold: 3}
+		check(t, policy, statsWithSizes(10, 10), plan{})
+		check(t, policy, statsWithSizes(10, 10, 10), plan{0, 1, true})
+		check(t, policy, statsWithSizes(10, 10, 10, 10), plan{0, 2, true})
+	})
+
+	t.Run("Dead Ratio", func(t *testing.T) {
+		policy := DeadRatioPolicy{Ratio: 0.5, MinDeadBytes: 10}
+		stats := statsWithSizes(100, 100, 100)
+		stats.Segments[0].DeadBytes = 40
+		check(t, policy, stats, plan{})
+		stats.Segments[1].DeadBytes = 60
+		check(t, policy, stats, plan{0, 1, true})
+		// Dead bytes in the active segment cannot be reclaimed.
+		stats = statsWithSizes(100)
+		stats.Segments[0].DeadBytes = 100
+		check(t, policy, stats, plan{})
+
+		small := statsWithSizes(8, 10)
+		small.Segments[0].DeadBytes = 8
+		check(t, policy, small, plan{})
+	})
+
+	t.Run("Size Tiered", func(t *testing.T) {
+		policy := SizeTieredPolicy{MinThreshold: 3}
+		check(t, policy, statsWithSizes(1000, 10, 10, 10), plan{})
+		check(t, policy, statsWithSizes(1000, 10, 12, 9, 10), plan{1, 3, true})
+		check(t, policy, statsWithSizes(1000, 900, 1100, 10, 10, 10), plan{0, 2, true})
+		check(t, policy, statsWithSizes(10, 11, 1000, 10, 10), plan{})
+	})
+}
+
+// fixedPolicy merges the same run of segments whenever there are enough.
+type fixedPolicy struct {
+	first, last int
+}
+
+func (p fixedPolicy) Plan(stats Stats) (int, int, bool) {
+	return p.first, p.last, p.last < len(stats.Segments)-1
+}
+
+func TestCompaction_PartialRun(t *testing.T) {
+	fs := NewMemFS()
+	db := openMemDb(t, fs, 45, WithSyncWrites(true), WithCompactionPolicy(fixedPolicy{1, 2}))
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	// Segment 1.
+	db.Put("key1", "value3")
+	db.Delete("key2")
+	// Segment 2.
+	db.Put("key3", "value3")
+	db.Put("key1", "value4")
+	// Segment 3 is the active one and triggers the merge of 1 and 2.
+	db.Put("key4", "value4")
+	db.mergeWg.Wait()
+
+	stats := db.Stats()
+	if stats.SegmentCount != 3 || stats.Merges != 1 {
+		t.Fatalf("Expected 3 segments after 1 merge, got %d and %d", stats.SegmentCount, stats.Merges)
+	}
+	// The deletion marker has to stay since segment 0 still holds key2.
+	expected := map[string]string{"key1": "value4", "key2": "", "key3": "value3", "key4": "value4"}
+	checkValues(t, db, expected)
+
+	db = crash(t, fs, db, 45)
+	checkValues(t, db, expected)
+	if len(db.segments) != 3 {
+		t.Errorf("Expected the untouched oldest segment to survive recovery, got %d segments", len(db.segments))
+	}
+}
+
+func TestCompaction_Backoff(t *testing.T) {
+	fs := NewMemFS()
+	db := openMemDb(t, fs, 45)
+	fs.FailRename(syscall.EIO)
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		db.Put(key, "value")
+	}
+	db.mergeWg.Wait()
+	if stats := db.Stats(); stats.MergeErrors != 1 {
+		t.Fatalf("Expected 1 failed merge, got %d", stats.MergeErrors)
+	}
+
+	// Further rollovers must not hammer the failing disk.
+	for _, key := range []string{"key6", "key7", "key8", "key9"} {
+		db.Put(key, "value")
+	}
+	db.mergeWg.Wait()
+	if stats := db.Stats(); stats.Merges != 1 {
+		t.Errorf("Expected no merges while backing off, got %d", stats.Merges)
+	}
+
+	fs.FailRename(nil)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.Stats()
+	if stats.SegmentCount != 2 || stats.LastMergeError != "" {
+		t.Errorf("Expected a successful forced merge, got %d segments and error %q", stats.SegmentCount, stats.LastMergeError)
+	}
+	if stats.Keys != 9 {
+		t.Errorf("Expected 9 keys, got %d", stats.Keys)
+	}
+}
+
+func TestCompact_Closed(t *testing.T) {
+	db := openMemDb(t, NewMemFS(), 45)
+	db.Close()
+	if err := db.Compact(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContext(t *testing.T) {
+	t.Run("Waiting For Writer", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000)
+		db.writer <- struct{}{}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := db.PutContext(ctx, "key", "value"); err != context.DeadlineExceeded {
+			t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+		}
+
+		db.unlockWriter()
+		if err := db.Put("key2", "value2"); err != nil {
+			t.Fatalf("Expected the writer slot to be free, got %v", err)
+		}
+		checkValues(t, db, map[string]string{"key": "", "key2": "value2"})
+	})
+
+	t.Run("Blocking Stall", func(t *testing.T) {
+		bp := Backpressure{HardLimit: 3, Block: true}
+		db := openMemDb(t, NewMemFS(), 45, WithCompactionPolicy(nil), WithBackpressure(bp))
+		fillSegments(t, db, 3)
+		db.Put("key", "value1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := db.PutContext(ctx, "key", "value2"); err != context.DeadlineExceeded {
+			t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+		}
+		checkValues(t, db, map[string]string{"key": "value1"})
+	})
+
+	t.Run("Write Delay", func(t *testing.T) {
+		bp := Backpressure{SoftLimit: 1, Delay: time.Minute}
+		db := openMemDb(t, NewMemFS(), 45, WithCompactionPolicy(nil), WithBackpressure(bp))
+		fillSegments(t, db, 1)
+		db.Put("key", "value1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := db.DeleteContext(ctx, "key"); err != context.DeadlineExceeded {
+			t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+		}
+		checkValues(t, db, map[string]string{"key": "value1"})
+	})
+}
@@ -0,0 +1,368 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const memDir = "db"
+
+func openMemDb(t *testing.T, fs *MemFS, segmentSize int64, opts ...Option) *Db {
+	t.Helper()
+	db, err := NewDb(memDir, segmentSize, append([]Option{WithFS(fs)}, opts...)...)
+	if err != nil {
+		t.Fatalf("Cannot open db: %s", err)
+	}
+	t.Cleanup(db.stopBackground)
+	return db
+}
+
+// crash simulates a power loss and starts a new db process on what is left.
+func crash(t *testing.T, fs *MemFS, db *Db, segmentSize int64) *Db {
+	t.Helper()
+	db.mergeWg.Wait()
+	db.stopBackground()
+	fs.Crash()
+	return openMemDb(t, fs, segmentSize, WithSyncWrites(true))
+}
+
+func checkValues(t *testing.T, db *Db, expected map[string]string) {
+	t.Helper()
+	for key, value := range expected {
+		result, err := db.Get(key)
+		if value == "" {
+			if err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for key %s, got %q, %v", key, result, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Cannot get %s: %s", key, err)
+		} else if result != value {
+			t.Errorf("Bad value for %s: expected %s, got %s", key, value, result)
+		}
+	}
+}
+
+func TestCrash_Put(t *testing.T) {
+	t.Run("Synced Writes Survive", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 1000, WithSyncWrites(true))
+		for _, d := range []Data{{"key1", "value1"}, {"key2", "value2"}, {"key1", "value3"}} {
+			if err := db.Put(d.key, d.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value3", "key2": "value2"})
+	})
+
+	t.Run("Unsynced Writes Are Dropped", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 1000)
+		db.Put("key1", "value1")
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		db.Put("key2", "value2")
+
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": ""})
+
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value1", "key3": "value3"})
+	})
+
+	t.Run("Short Write", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 1000, WithSyncWrites(true))
+		db.Put("key1", "value1")
+
+		fs.ShortWrite(5)
+		if err := db.Put("key2", "value2"); err == nil {
+			t.Fatal("Expected short write to fail Put")
+		}
+		checkValues(t, db, map[string]string{"key2": ""})
+
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, db, map[string]string{"key1": "value1", "key3": "value3"})
+
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": "", "key3": "value3"})
+	})
+
+	t.Run("Sync Failure", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 1000, WithSyncWrites(true))
+		db.Put("key1", "value1")
+
+		fs.FailSync(syscall.EIO)
+		if err := db.Put("key2", "value2"); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("Expected EIO, got %v", err)
+		}
+		checkValues(t, db, map[string]string{"key2": ""})
+
+		fs.FailSync(nil)
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": "", "key3": "value3"})
+	})
+
+	t.Run("No Space", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 1000, WithSyncWrites(true))
+		db.Put("key1", "value1")
+
+		fs.SetCapacity(30)
+		if err := db.Put("key2", "value2"); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("Expected ENOSPC, got %v", err)
+		}
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": ""})
+
+		fs.SetCapacity(0)
+		if err := db.Put("key2", "value2"); err != nil {
+			t.Fatal(err)
+		}
+
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": "value2"})
+	})
+
+	t.Run("Torn Record", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 1000, WithSyncWrites(true))
+		db.Put("key1", "value1")
+
+		// A record cut in the middle, as a crash during the write leaves it.
+		f, err := fs.OpenFile(db.segments[0].outPath, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := entry{"key2", "value2"}
+		f.Write(e.Encode()[:10])
+		f.Sync()
+		f.Close()
+
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": ""})
+
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		db = crash(t, fs, db, 1000)
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": "", "key3": "value3"})
+	})
+}
+
+func TestCrash_SegmentRollover(t *testing.T) {
+	t.Run("All Segments Recovered", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45, WithSyncWrites(true))
+		db.Put("key1", "value1")
+		db.Put("key2", "value2")
+		db.Put("key3", "value3")
+		db.Put("key1", "value4")
+
+		db = crash(t, fs, db, 45)
+		expected := map[string]string{"key1": "value4", "key2": "value2", "key3": "value3"}
+		checkValues(t, db, expected)
+
+		// New segments must not clash with the recovered ones.
+		db.Put("key4", "value4")
+		db.Put("key5", "value5")
+		db.Put("key6", "value6")
+		expected["key4"], expected["key5"], expected["key6"] = "value4", "value5", "value6"
+
+		db = crash(t, fs, db, 45)
+		checkValues(t, db, expected)
+	})
+
+	t.Run("Sync Failure On Rollover", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45)
+		db.Put("key1", "value1")
+		db.Put("key2", "value2")
+
+		fs.FailSync(syscall.EIO)
+		if err := db.Put("key3", "value3"); err == nil {
+			t.Fatal("Expected rollover to fail")
+		}
+		if len(db.segments) != 1 {
+			t.Errorf("Expected 1 segment instead %d", len(db.segments))
+		}
+
+		fs.FailSync(nil)
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		db.Sync()
+
+		db = crash(t, fs, db, 45)
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": "value2", "key3": "value3"})
+	})
+}
+
+func TestCrash_LargeValue(t *testing.T) {
+	// Values larger than the read buffer are skipped without being read on
+	// recovery, so a torn one has to be noticed by its size.
+	fs := NewMemFS()
+	db := openMemDb(t, fs, 1<<20, WithSyncWrites(true))
+	large := strings.Repeat("x", 3*bufSize)
+	db.Put("before", large)
+	db.Put("small", "value")
+	db.Put("torn", large)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _ := fs.OpenFile(filepath.Join(memDir, outFileName+"0"), os.O_RDWR, 0o600)
+	info, _ := f.Stat()
+	f.Truncate(info.Size() - bufSize)
+	f.Close()
+
+	db = openMemDb(t, fs, 1<<20, WithSyncWrites(true))
+	checkValues(t, db, map[string]string{"before": large, "small": "value", "torn": ""})
+	db.Put("after", "value")
+	db = crash(t, fs, db, 1<<20)
+	checkValues(t, db, map[string]string{"before": large, "small": "value", "after": "value"})
+}
+
+func TestCrash_Merge(t *testing.T) {
+	// fill produces three segments, which triggers a merge of the first two.
+	fill := func(db *Db) {
+		db.Put("key1", "value1")
+		db.Put("key2", "value2")
+		db.Put("key1", "value3")
+		db.Delete("key2")
+		db.Put("key4", "value4")
+	}
+	expected := map[string]string{"key1": "value3", "key2": "", "key4": "value4"}
+
+	checkNoLeftovers := func(t *testing.T, fs *MemFS) {
+		names, _ := fs.ReadDir(memDir)
+		for _, name := range names {
+			if strings.HasSuffix(name, mergeSuffix) || strings.HasSuffix(name, seqTempSuffix) {
+				t.Errorf("Unexpected leftover file %s", name)
+			}
+		}
+	}
+
+	t.Run("Completed Merge", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45, WithSyncWrites(true))
+		fill(db)
+		db.mergeWg.Wait()
+		if len(db.segments) != 2 {
+			t.Errorf("Expected 2 segments instead %d", len(db.segments))
+		}
+
+		db = crash(t, fs, db, 45)
+		checkValues(t, db, expected)
+		if len(db.segments) != 2 {
+			t.Errorf("Expected 2 segments after recovery instead %d", len(db.segments))
+		}
+	})
+
+	t.Run("Sync Failure", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45, WithSyncWrites(true), WithCompactionPolicy(nil))
+		fill(db)
+
+		fs.FailSync(syscall.EIO)
+		if err := db.Compact(); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("Expected EIO, got %v", err)
+		}
+		fs.FailSync(nil)
+		if len(db.segments) != 3 {
+			t.Errorf("Expected failed merge to keep 3 segments, got %d", len(db.segments))
+		}
+		checkNoLeftovers(t, fs)
+
+		db = crash(t, fs, db, 45)
+		checkValues(t, db, expected)
+	})
+
+	t.Run("Rename Failure", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45, WithSyncWrites(true))
+		fs.FailRename(syscall.EIO)
+		fill(db)
+		db.mergeWg.Wait()
+		if len(db.segments) != 3 {
+			t.Errorf("Expected failed merge to keep 3 segments, got %d", len(db.segments))
+		}
+		checkNoLeftovers(t, fs)
+		checkValues(t, db, expected)
+
+		db = crash(t, fs, db, 45)
+		checkValues(t, db, expected)
+	})
+
+	t.Run("Crash Before Old Segments Removed", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45, WithSyncWrites(true))
+		fs.FailRemove(syscall.EIO)
+		fill(db)
+		db.mergeWg.Wait()
+
+		if _, err := fs.Open(filepath.Join(memDir, outFileName+"0")); err != nil {
+			t.Fatalf("Expected the stale segment to be left behind: %s", err)
+		}
+
+		db = crash(t, fs, db, 45)
+		if _, err := fs.Open(filepath.Join(memDir, outFileName+"0")); err == nil {
+			t.Error("Expected recovery to delete the stale segment")
+		}
+		checkValues(t, db, expected)
+	})
+
+	t.Run("Crash During Merge", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45, WithSyncWrites(true))
+		fill(db)
+		db.mergeWg.Wait()
+
+		// An unsynced merge output left behind must be ignored and cleaned up.
+		f, _ := fs.OpenFile(filepath.Join(memDir, outFileName+"2"+mergeSuffix), os.O_CREATE|os.O_WRONLY, 0o600)
+		e := entry{"key1", "stale"}
+		f.Write(e.Encode())
+		f.Sync()
+
+		db = crash(t, fs, db, 45)
+		checkValues(t, db, expected)
+		checkNoLeftovers(t, fs)
+	})
+
+	t.Run("Crash During Version Reservation", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45, WithSyncWrites(true))
+		fill(db)
+		version := db.Version()
+
+		// A reservation that never got renamed into place must be ignored
+		// and cleaned up.
+		f, _ := fs.OpenFile(filepath.Join(memDir, seqFileName+seqTempSuffix), os.O_CREATE|os.O_WRONLY, 0o600)
+		f.Write([]byte{1})
+		f.Sync()
+
+		db = crash(t, fs, db, 45)
+		checkValues(t, db, expected)
+		checkNoLeftovers(t, fs)
+		if db.Version() < version {
+			t.Errorf("Expected versions to continue after %d, got %d", version, db.Version())
+		}
+	})
+}
@@ -2,277 +2,859 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const bufSize = 8192
 
 const outFileName = "current-data"
 
+// mergeSuffix marks the temporary file a merge writes before it takes the
+// place of the newest merged segment.
+const mergeSuffix = ".merge"
+
+// legacyDeletedValue is the value that marks a deleted key in segments
+// written before format version 2.
+const legacyDeletedValue = "DELETED"
+
 var ErrNotFound = fmt.Errorf("record does not exist")
 
-type hashIndex map[string]int64
+// record locates an entry inside a segment file.
+type record struct {
+	position int64
+	size     int64
+	deleted  bool
+	// version is the version of the write, 0 for records loaded from disk.
+	// See Db.GetVersion.
+	version uint64
+}
+
+type hashIndex map[string]record
 
 type Segment struct {
-	index   hashIndex
+	index  hashIndex
+	id     int
+	header segmentHeader
+	// size is the length of the valid data in the file.
+	size    int64
 	outPath string
+	fs      FS
 	lock    sync.RWMutex
 }
 
 func (s *Segment) getValue(position int64) (string, error) {
-	file, err := os.Open(s.outPath)
+	file, err := s.fs.Open(s.outPath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	_, err = reader.Discard(int(position))
+	reader := bufio.NewReader(io.NewSectionReader(file, position, math.MaxInt64-position))
+	value, err := readValue(reader)
 	if err != nil {
 		return "", err
 	}
 
-	value, err := readValue(reader)
+	return value, nil
+}
+
+// readHeader reads the segment header from its file.
+func (s *Segment) readHeader() error {
+	file, err := s.fs.Open(s.outPath)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer file.Close()
 
-	return value, nil
+	s.header, err = readHeader(file, s.id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.outPath, err)
+	}
+	return nil
+}
+
+// load rebuilds the segment index from its file. Everything after a broken
+// record is ignored. Only the record headers are read: values that are not
+// buffered already are skipped by starting to read after them.
+func (s *Segment) load() error {
+	file, err := s.fs.Open(s.outPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	s.size = s.header.size()
+	in := bufio.NewReaderSize(io.NewSectionReader(file, s.size, end-s.size), bufSize)
+	for {
+		key, n, valueSize, err := readEntryHeader(in)
+		if err == io.EOF || err == errBrokenEntry || (err == nil && s.size+n > end) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		deleted := valueSize == tombstoneSize
+		if !deleted {
+			if s.header.version < 2 && int(valueSize) == len(legacyDeletedValue) {
+				value, err := in.Peek(len(legacyDeletedValue))
+				deleted = err == nil && string(value) == legacyDeletedValue
+			}
+			if int(valueSize) <= in.Buffered() {
+				_, _ = in.Discard(int(valueSize))
+			} else {
+				next := s.size + n
+				in.Reset(io.NewSectionReader(file, next, end-next))
+			}
+		}
+		s.index[key] = record{
+			position: s.size,
+			size:     n,
+			deleted:  deleted,
+		}
+		s.size += n
+	}
+}
+
+// Option configures optional behaviour of a Db.
+type Option func(db *Db)
+
+// WithFS makes the Db keep its files in fs instead of the OS file system.
+func WithFS(fs FS) Option {
+	return func(db *Db) { db.fs = fs }
+}
+
+// WithSyncWrites makes every write fsync the active segment before returning,
+// so that an acknowledged write survives a crash.
+func WithSyncWrites(sync bool) Option {
+	return func(db *Db) { db.syncWrites = sync }
 }
 
 type Db struct {
-	out         *os.File
-	outOffset   int64
+	fs        FS
+	out       File
+	outOffset int64
+	// outBroken is set when a failed write could not be rolled back, so the
+	// next write has to start a fresh segment.
+	outBroken   bool
 	dir         string
 	segmentSize int64
+	syncWrites  bool
 	totalNumber int
 	segments    []*Segment
 	indexLock   sync.RWMutex
+	// writer is a single slot semaphore that serializes writers.
+	writer chan struct{}
+	// seq is the version of the last write and seqLimit the end of the
+	// reserved block of versions.
+	seq      uint64
+	seqLimit uint64
+	// openVersion is seq when the Db was opened.
+	openVersion uint64
+	feed        *changeFeed
+
+	policy         CompactionPolicy
+	compactPending bool
+	compactWake    chan struct{}
+	compactReq     chan chan error
+	// mergeWg tracks compaction requests the scheduler has not finished yet.
+	mergeWg    sync.WaitGroup
+	mergeStats mergeStats
+	// mergeLock keeps merges and migrations from rewriting segments at the
+	// same time.
+	mergeLock sync.Mutex
+
+	backpressure Backpressure
+	// segmentsShrunk is closed and replaced whenever a merge removes
+	// segments, waking up stalled writers.
+	segmentsShrunk chan struct{}
+	delayedWrites  atomic.Int64
+	stalledWrites  atomic.Int64
+
+	getHits      atomic.Int64
+	getMisses    atomic.Int64
+	bytesWritten atomic.Int64
+	// spools numbers the files PutReader spools values to.
+	spools atomic.Int64
+
+	closing    chan struct{}
+	closeOnce  sync.Once
+	background sync.WaitGroup
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
 	db := &Db{
+		fs:          OSFS,
 		segments:    make([]*Segment, 0),
 		dir:         dir,
 		segmentSize: segmentSize,
+		writer:      make(chan struct{}, 1),
+		feed:        newChangeFeed(),
+		policy:      SegmentCountPolicy{Threshold: 3},
+		compactWake: make(chan struct{}, 1),
+		compactReq:  make(chan chan error),
+		closing:     make(chan struct{}),
+
+		segmentsShrunk: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(db)
 	}
 
-	err := db.createSegment()
-	if err != nil {
+	if err := db.fs.MkdirAll(dir, 0o700); err != nil {
 		return nil, err
 	}
 
-	err = db.recover()
-	if err != nil && err != io.EOF {
+	err := db.recover()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.recoverVersions(); err != nil {
 		return nil, err
 	}
+	db.openVersion = db.seq
+
+	db.background.Add(1)
+	go db.runCompactions()
 
 	return db, nil
 }
 
+func (db *Db) segmentPath(id int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, id))
+}
+
 func (db *Db) createSegment() error {
-	outFile := fmt.Sprintf("%s%d", outFileName, db.totalNumber)
-	outPath := filepath.Join(db.dir, outFile)
-	db.totalNumber++
+	if db.out != nil {
+		if err := db.out.Sync(); err != nil {
+			return err
+		}
+	}
+
+	outPath := db.segmentPath(db.totalNumber)
+	f, err := db.fs.OpenFile(outPath, os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
 
-	f, err := os.OpenFile(outPath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
+	header := newHeader(kindWrite, db.totalNumber)
+	_, err = f.Write(header.Encode())
+	if err == nil {
+		err = f.Sync()
+	}
 	if err != nil {
+		f.Close()
+		db.fs.Remove(outPath)
 		return err
 	}
 
 	newSegment := &Segment{
+		id:      db.totalNumber,
+		header:  header,
+		size:    header.size(),
 		outPath: outPath,
+		fs:      db.fs,
 		index:   make(hashIndex),
 	}
+	db.totalNumber++
 
-	db.out.Close()
+	if db.out != nil {
+		db.out.Close()
+	}
 	db.out = f
-	db.outOffset = 0
+	db.outOffset = header.size()
+	db.outBroken = false
 
 	db.segments = append(db.segments, newSegment)
-	if len(db.segments) >= 3 {
-		db.mergeSegments()
-	}
+	db.notifyCompaction()
 	return nil
 }
 
-func (db *Db) mergeSegments() {
-	go func() {
-		outFile := fmt.Sprintf("%s%d", outFileName, db.totalNumber)
-		outPath := filepath.Join(db.dir, outFile)
-		db.totalNumber++
+// merge compacts a run of sealed segments into one that takes the place of
+// the newest of them. It must be called with mergeLock held.
+func (db *Db) merge(segments []*Segment, dropDeleted bool) error {
+	last := segments[len(segments)-1]
+	newSegment := &Segment{
+		id:      last.id,
+		header:  newHeader(kindMerge, segments[0].header.base),
+		outPath: last.outPath,
+		fs:      db.fs,
+		index:   make(hashIndex),
+	}
+	return db.rewrite(segments, newSegment, dropDeleted)
+}
+
+// Migrate rewrites every sealed segment stored in an older format into the
+// current one and returns the number of rewritten segments. The active segment
+// is always in the current format.
+func (db *Db) Migrate() (int, error) {
+	db.mergeLock.Lock()
+	defer db.mergeLock.Unlock()
 
+	db.indexLock.RLock()
+	sealed := make([]*Segment, len(db.segments)-1)
+	copy(sealed, db.segments)
+	db.indexLock.RUnlock()
+
+	migrated := 0
+	for _, s := range sealed {
+		if s.header.version == formatVersion {
+			continue
+		}
 		newSegment := &Segment{
-			outPath: outPath,
+			id:      s.id,
+			header:  newHeader(kindMigrate, s.header.base),
+			outPath: s.outPath,
+			fs:      db.fs,
 			index:   make(hashIndex),
 		}
-		var offset int64
+		if err := db.rewrite([]*Segment{s}, newSegment, false); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
 
-		f, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+// rewrite replaces a contiguous run of sealed segments with out, which takes
+// the place of the newest of them. The new file is written under a temporary
+// name and renamed into place only once it is synced, so a crash at any point
+// leaves either the old segments or the new one readable. Old segments that
+// outlive a crash next to the new one are found by recover through the base
+// recorded in the header and deleted.
+func (db *Db) rewrite(segments []*Segment, out *Segment, dropDeleted bool) error {
+	tmpPath := out.outPath + mergeSuffix
+	f, err := db.fs.OpenFile(tmpPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	err = writeMerged(f, segments, out, dropDeleted)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		return err
+	}
+
+	db.indexLock.Lock()
+	if err := db.fs.Rename(tmpPath, out.outPath); err != nil {
+		db.indexLock.Unlock()
+		db.fs.Remove(tmpPath)
+		return err
+	}
+	first := 0
+	for db.segments[first] != segments[0] {
+		first++
+	}
+	updated := make([]*Segment, 0, len(db.segments)-len(segments)+1)
+	updated = append(updated, db.segments[:first]...)
+	updated = append(updated, out)
+	updated = append(updated, db.segments[first+len(segments):]...)
+	db.segments = updated
+	if len(segments) > 1 {
+		close(db.segmentsShrunk)
+		db.segmentsShrunk = make(chan struct{})
+	}
+	db.indexLock.Unlock()
+
+	for _, s := range segments {
+		if s.outPath == out.outPath {
+			continue
+		}
+		if err := db.fs.Remove(s.outPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMerged writes the header of out followed by the newest value of every
+// key found in segments to f and records the written positions in out.
+// Deletion markers can only be dropped when the oldest segment takes part,
+// as otherwise an older value would show through.
+func writeMerged(f File, segments []*Segment, out *Segment, dropDeleted bool) error {
+	if _, err := f.Write(out.header.Encode()); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	offset := out.header.size()
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		n, err := s.copyNewest(f, out, offset, seen, dropDeleted)
 		if err != nil {
-			return
+			return err
 		}
-		defer f.Close()
-
-		lastSegmentIndex := len(db.segments) - 2
-		for i := 0; i <= lastSegmentIndex; i++ {
-			s := db.segments[i]
-			for key, index := range s.index {
-				if i < lastSegmentIndex {
-					duplicated := false
-					for _, segment := range db.segments[i+1 : lastSegmentIndex+1] {
-						if _, ok := segment.index[key]; ok {
-							duplicated = true
-							break
-						}
-					}
-					if duplicated {
-						continue
-					}
-				}
-				value, _ := s.getValue(index)
-				entry := entry{
-					key:   key,
-					value: value,
-				}
-				n, err := f.Write(entry.Encode())
-				if err == nil {
-					newSegment.index[key] = offset
-					offset += int64(n)
-				}
-			}
+		offset += n
+	}
+	out.size = offset
+
+	return f.Sync()
+}
+
+// copyNewest copies the records of the keys not seen in newer segments to f,
+// which is at offset, and records them in out. Values are copied record by
+// record, never read into memory whole.
+func (s *Segment) copyNewest(f File, out *Segment, offset int64, seen map[string]bool, dropDeleted bool) (int64, error) {
+	file, err := s.fs.Open(s.outPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	start := offset
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if seen[key] {
+			continue
 		}
+		seen[key] = true
 
-		db.segments = []*Segment{newSegment, db.segments[len(db.segments)-1]}
-	}()
+		rec := s.index[key]
+		if dropDeleted && rec.deleted {
+			continue
+		}
+		var n int64
+		if rec.deleted {
+			// Deletion markers of legacy segments become tombstones too.
+			written, err := f.Write(encodeTombstone(key))
+			if err != nil {
+				return 0, err
+			}
+			n = int64(written)
+		} else if n, err = io.CopyN(f, io.NewSectionReader(file, rec.position, rec.size), rec.size); err != nil {
+			return 0, err
+		}
+		out.index[key] = record{
+			position: offset,
+			size:     n,
+			deleted:  rec.deleted,
+			version:  rec.version,
+		}
+		offset += n
+	}
+	return offset - start, nil
 }
 
+// recover loads every segment found in the directory, oldest first, and
+// reopens the newest one for appending.
 func (db *Db) recover() error {
-	var err error
-	var buf [bufSize]byte
+	names, err := db.fs.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
 
-	for _, segment := range db.segments {
-		file, err := os.Open(segment.outPath)
+	for _, name := range names {
+		// Leftovers of a merge, an upload or a version reservation
+		// interrupted by a crash. The segments a merge was built from and
+		// the previous reservation are still in place.
+		if strings.HasSuffix(name, mergeSuffix) || strings.HasPrefix(name, spoolPrefix) || strings.HasSuffix(name, seqTempSuffix) {
+			if err := db.fs.Remove(filepath.Join(db.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(name, outFileName) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(name, outFileName))
 		if err != nil {
+			continue
+		}
+		db.segments = append(db.segments, &Segment{
+			id:      id,
+			outPath: filepath.Join(db.dir, name),
+			fs:      db.fs,
+			index:   make(hashIndex),
+		})
+	}
+	sort.Slice(db.segments, func(i, j int) bool {
+		return db.segments[i].id < db.segments[j].id
+	})
+
+	for _, segment := range db.segments {
+		if err := segment.readHeader(); err != nil {
 			return err
 		}
-		defer file.Close()
-
-		in := bufio.NewReaderSize(file, bufSize)
-		for err == nil {
-			var (
-				header, data []byte
-				n            int
-			)
-			header, err = in.Peek(bufSize)
-			if err == io.EOF {
-				if len(header) == 0 {
-					break
-				}
-			} else if err != nil {
-				return err
-			}
-			size := binary.LittleEndian.Uint32(header)
+		db.totalNumber = segment.id + 1
+	}
+	db.segments = db.dropSuperseded(db.segments)
 
-			if size < bufSize {
-				data = buf[:size]
-			} else {
-				data = make([]byte, size)
-			}
-			n, err = in.Read(data)
-
-			if err == nil {
-				var e entry
-				e.Decode(data)
-				db.indexLock.Lock()
-				segment.index[e.key] = db.outOffset
-				db.indexLock.Unlock()
-				db.outOffset += int64(n)
-			}
+	for _, segment := range db.segments {
+		if err := segment.load(); err != nil {
+			return err
 		}
 	}
 
-	return err
+	if len(db.segments) == 0 {
+		return db.createSegment()
+	}
+
+	last := db.segments[len(db.segments)-1]
+	if last.header.version != formatVersion {
+		// New records go to a segment in the current format.
+		return db.createSegment()
+	}
+	f, err := db.fs.OpenFile(last.outPath, os.O_APPEND|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	// Cut off a record left half-written by a crash before appending after it.
+	if err := f.Truncate(last.size); err != nil {
+		f.Close()
+		return err
+	}
+	db.out = f
+	db.outOffset = last.size
+	return nil
+}
+
+// dropSuperseded deletes the segments covered by a later merge result. They
+// are left behind when a crash happens right after the merge is renamed into
+// place.
+func (db *Db) dropSuperseded(segments []*Segment) []*Segment {
+	var res []*Segment
+	for i, s := range segments {
+		superseded := false
+		for _, later := range segments[i+1:] {
+			if later.header.base <= s.id {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			res = append(res, s)
+		} else if err := db.fs.Remove(s.outPath); err != nil {
+			// Keeping it is harmless, the merge result shadows it.
+			res = append(res, s)
+		}
+	}
+	return res
 }
 
 func (db *Db) Get(key string) (string, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is Get that gives up once ctx is done. ctx is checked before the
+// index lookup and again before the value is read from disk.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := db.get(ctx, key)
+	return value, err
+}
+
+func (db *Db) get(ctx context.Context, key string) (string, record, error) {
+	if err := ctx.Err(); err != nil {
+		return "", record{}, err
+	}
+
 	db.indexLock.RLock()
 	defer db.indexLock.RUnlock()
 
-	var (
-		segment  *Segment
-		position int64
-		ok       bool
-	)
+	segment, rec, ok := db.lookup(key)
+	if !ok {
+		db.getMisses.Add(1)
+		return "", record{}, ErrNotFound
+	}
+	db.getHits.Add(1)
+	if err := ctx.Err(); err != nil {
+		return "", record{}, err
+	}
+
+	value, err := segment.getValue(rec.position)
+	if err != nil {
+		return "", record{}, err
+	}
 
-	for i := range db.segments {
-		segment = db.segments[len(db.segments)-i-1]
+	return value, rec, nil
+}
+
+// lookup finds the newest live record of key. It must be called with
+// indexLock held.
+func (db *Db) lookup(key string) (*Segment, record, bool) {
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		segment := db.segments[i]
 		segment.lock.RLock()
-		position, ok = segment.index[key]
+		rec, ok := segment.index[key]
 		segment.lock.RUnlock()
 		if ok {
-			break
+			return segment, rec, !rec.deleted
 		}
 	}
+	return nil, record{}, false
+}
 
-	if !ok {
-		return "", ErrNotFound
+func (db *Db) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put that gives up once ctx is done while it is held back by
+// backpressure or waits for other writers. A record that has made it to disk
+// stays there.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if err := db.throttle(ctx); err != nil {
+		return err
 	}
+	if err := db.lockWriter(ctx); err != nil {
+		return err
+	}
+	defer db.unlockWriter()
+
+	return db.put(key, value, false)
+}
 
-	value, err := segment.getValue(position)
+// PutBytes is Put for binary keys and values, which are stored unchanged.
+func (db *Db) PutBytes(key, value []byte) error {
+	return db.Put(string(key), string(value))
+}
+
+// GetBytes is Get for binary keys. The returned slice belongs to the caller.
+func (db *Db) GetBytes(key []byte) ([]byte, error) {
+	value, err := db.Get(string(key))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return []byte(value), nil
+}
 
-	if value == "DELETED" {
-		return "", ErrNotFound
+// lockWriter waits for the single writer slot. Writers queue up here rather
+// than on indexLock, which cannot be abandoned.
+func (db *Db) lockWriter(ctx context.Context) error {
+	select {
+	case db.writer <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// The slot may have been free just as ctx was done.
+	if err := ctx.Err(); err != nil {
+		<-db.writer
+		return err
 	}
+	return nil
+}
 
-	return value, nil
+func (db *Db) unlockWriter() {
+	<-db.writer
 }
 
-func (db *Db) Put(key, value string) error {
+// put appends a record, or a deletion marker for key when deleted is set, to
+// the active segment. It must be called holding the writer slot.
+func (db *Db) put(key, value string, deleted bool) error {
+	if !deleted {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+
 	db.indexLock.Lock()
 	defer db.indexLock.Unlock()
 
-	entry := entry{
-		key:   key,
-		value: value,
-	}
-	size := int64(len(key) + len(value) + 12)
-
-	stat, err := db.out.Stat()
+	version, err := db.nextVersion()
 	if err != nil {
 		return err
 	}
 
-	if stat.Size()+size > db.segmentSize {
+	var data []byte
+	if deleted {
+		data = encodeTombstone(key)
+	} else {
+		entry := entry{
+			key:   key,
+			value: value,
+		}
+		data = entry.Encode()
+	}
+
+	active := db.segments[len(db.segments)-1]
+	dataSize := db.outOffset - active.header.size()
+	if db.outBroken || (dataSize > 0 && dataSize+int64(len(data)) > db.segmentSize) {
 		err := db.createSegment()
 		if err != nil {
 			return err
 		}
 	}
 
-	n, err := db.out.Write(entry.Encode())
+	if err := db.write(data); err != nil {
+		return err
+	}
+	db.bytesWritten.Add(int64(len(data)))
+
+	active = db.segments[len(db.segments)-1]
+	active.lock.Lock()
+	active.index[key] = record{
+		position: db.outOffset,
+		size:     int64(len(data)),
+		deleted:  deleted,
+		version:  version,
+	}
+	db.outOffset += int64(len(data))
+	active.size = db.outOffset
+	active.lock.Unlock()
+
+	if deleted {
+		db.feed.publish(Change{Key: key, Op: OpDelete, Version: version})
+	} else {
+		db.feed.publish(putChange(key, version, value))
+	}
+	return nil
+}
+
+// write appends data to the active segment. If that fails the segment is cut
+// back to its previous length, so a partially written record can never end up
+// in front of later ones.
+func (db *Db) write(data []byte) error {
+	_, err := db.out.Write(data)
+	if err == nil && db.syncWrites {
+		err = db.out.Sync()
+	}
 	if err != nil {
+		if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+			db.outBroken = true
+		}
+		return err
+	}
+	return nil
+}
+
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	if err := db.throttle(ctx); err != nil {
+		return err
+	}
+	if err := db.lockWriter(ctx); err != nil {
 		return err
 	}
+	defer db.unlockWriter()
+
+	return db.put(key, "", true)
+}
+
+// Sync flushes the active segment to stable storage.
+func (db *Db) Sync() error {
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+	return db.out.Sync()
+}
+
+// Scan calls fn for every live key starting with prefix in ascending key
+// order until fn returns false. Writers are blocked while the scan runs, so fn
+// must not call back into db.
+func (db *Db) Scan(prefix string, fn func(key, value string) bool) error {
+	return db.ScanAfter(prefix, "", fn)
+}
+
+func (db *Db) ScanAfter(prefix, after string, fn func(key, value string) bool) error {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+	return db.scan(rangeMatcher(prefix, after), fn)
+}
+
+// Snapshot calls fn for every key of every bucket, with bucket keys in their
+// stored form, and returns the version of the last write it reflects. Values
+// are not read, so writers are blocked only while the index is walked.
+func (db *Db) Snapshot(fn func(key string) bool) (uint64, error) {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+	keys, latest := db.newest(func(string) bool { return true })
+	for _, key := range keys {
+		if !latest[key].rec.deleted && !fn(key) {
+			break
+		}
+	}
+	return db.seq, nil
+}
+
+// Version returns the version of the last write.
+func (db *Db) Version() uint64 {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+	return db.seq
+}
 
-	db.segments[len(db.segments)-1].lock.Lock()
-	db.segments[len(db.segments)-1].index[entry.key] = db.outOffset
-	db.segments[len(db.segments)-1].lock.Unlock()
-	db.outOffset += int64(n)
+// location is where the newest record of a key is.
+type location struct {
+	segment *Segment
+	rec     record
+}
 
+// scan must be called with indexLock held.
+func (db *Db) scan(match func(key string) bool, fn func(key, value string) bool) error {
+	keys, latest := db.newest(match)
+	for _, key := range keys {
+		loc := latest[key]
+		if loc.rec.deleted {
+			continue
+		}
+		value, err := loc.segment.getValue(loc.rec.position)
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			break
+		}
+	}
 	return nil
 }
 
-func (db *Db) Delete(key string) error {
-	return db.Put(key, "DELETED")
+// newest returns the sorted keys accepted by match and their newest records,
+// which may be deletion markers. It must be called with indexLock held.
+func (db *Db) newest(match func(key string) bool) ([]string, map[string]location) {
+	latest := make(map[string]location)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		segment := db.segments[i]
+		segment.lock.RLock()
+		for key, rec := range segment.index {
+			if _, ok := latest[key]; !ok && match(key) {
+				latest[key] = location{segment, rec}
+			}
+		}
+		segment.lock.RUnlock()
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, latest
 }
 
-func (db *Db) Close() { db.out.Close() }
+// Close stops the compaction scheduler, waiting for a running merge, then
+// flushes and closes the active segment.
+func (db *Db) Close() error {
+	db.stopBackground()
+	db.feed.close()
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+
+	err := db.out.Sync()
+	if closeErr := db.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -81,7 +81,7 @@ func TestPutGet(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if size1*2 != outInfo.Size() {
+		if (size1-headerSize)*2 != outInfo.Size()-headerSize {
 			t.Errorf("Unexpected size (%d vs %d)", size1, outInfo.Size())
 		}
 	})
@@ -165,12 +165,12 @@ func TestSegmentation(t *testing.T) {
 		}
 		info2, _ := file2.Stat()
 
-		if info1.Size() != 88 {
-			t.Errorf("Expected size 88 instead %d", info1.Size())
+		if info1.Size() != headerSize+88 {
+			t.Errorf("Expected size %d instead %d", headerSize+88, info1.Size())
 		}
 
-		if info2.Size() != 22 {
-			t.Errorf("Expected size 22 instead %d", info2.Size())
+		if info2.Size() != headerSize+22 {
+			t.Errorf("Expected size %d instead %d", headerSize+22, info2.Size())
 		}
 	})
 
@@ -4,8 +4,19 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 )
 
+// errBrokenEntry is returned by readEntry for a record that is truncated or
+// malformed, which is what a write interrupted by a crash leaves behind.
+var errBrokenEntry = fmt.Errorf("broken entry")
+
+// tombstoneSize takes the place of the value length in a deletion marker,
+// which has no value bytes. Segments before format version 2 marked deletions
+// with legacyDeletedValue instead, so that value could not be stored.
+const tombstoneSize = math.MaxUint32
+
 type entry struct {
 	key, value string
 }
@@ -23,6 +34,18 @@ func (e *entry) Encode() []byte {
 	return res
 }
 
+// encodeTombstone encodes a deletion marker for key.
+func encodeTombstone(key string) []byte {
+	kl := len(key)
+	size := kl + 12
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	copy(res[8:], key)
+	binary.LittleEndian.PutUint32(res[kl+8:], tombstoneSize)
+	return res
+}
+
 func (e *entry) Decode(input []byte) {
 	kl := binary.LittleEndian.Uint32(input[4:])
 	keyBuf := make([]byte, kl)
@@ -57,13 +80,50 @@ func readValue(in *bufio.Reader) (string, error) {
 	}
 
 	data := make([]byte, valSize)
-	n, err := in.Read(data)
-	if err != nil {
-		return "", err
-	}
-	if n != valSize {
+	n, err := io.ReadFull(in, data)
+	if err == io.ErrUnexpectedEOF {
 		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	} else if err != nil {
+		return "", err
 	}
 
 	return string(data), nil
 }
+
+// readEntryHeader reads the next record from in up to its value, which is
+// left unread. It returns the key, the number of bytes the whole record
+// occupies and the value size, tombstoneSize for a deletion marker. io.EOF is
+// returned only at a clean record boundary.
+func readEntryHeader(in *bufio.Reader) (string, int64, uint32, error) {
+	header, err := in.Peek(8)
+	if err == io.EOF && len(header) == 0 {
+		return "", 0, 0, io.EOF
+	} else if err == io.EOF {
+		return "", 0, 0, errBrokenEntry
+	} else if err != nil {
+		return "", 0, 0, err
+	}
+
+	size := binary.LittleEndian.Uint32(header)
+	kl := binary.LittleEndian.Uint32(header[4:])
+	if size < 12 || uint64(kl)+12 > uint64(size) {
+		return "", 0, 0, errBrokenEntry
+	}
+	if _, err := in.Discard(8); err != nil {
+		return "", 0, 0, err
+	}
+	data := make([]byte, kl+4)
+	if _, err := io.ReadFull(in, data); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return "", 0, 0, errBrokenEntry
+	} else if err != nil {
+		return "", 0, 0, err
+	}
+
+	vl := binary.LittleEndian.Uint32(data[kl:])
+	switch {
+	case vl == tombstoneSize && uint64(kl)+12 == uint64(size):
+	case uint64(kl)+uint64(vl)+12 != uint64(size):
+		return "", 0, 0, errBrokenEntry
+	}
+	return string(data[:kl]), int64(size), vl, nil
+}
@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Segment files written by this version start with a fixed size header:
+//
+//	magic   [4]byte  "KVSG"
+//	version uint16   format version of the records that follow
+//	kind    uint8    how the segment was produced
+//	_       uint8    reserved
+//	created int64    creation time in Unix nanoseconds
+//	base    uint32   id of the oldest segment whose data this one holds
+//
+// Files written before the header was introduced have no header at all and
+// are read as format version 0. Version 2 replaced the "DELETED" value that
+// marked deletions with a dedicated tombstone record.
+const (
+	segmentMagic  = "KVSG"
+	headerSize    = 20
+	formatVersion = 2
+)
+
+type segmentKind uint8
+
+const (
+	kindWrite segmentKind = iota
+	kindMerge
+	kindMigrate
+)
+
+func (k segmentKind) String() string {
+	switch k {
+	case kindWrite:
+		return "write"
+	case kindMerge:
+		return "merge"
+	case kindMigrate:
+		return "migrate"
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+type segmentHeader struct {
+	version uint16
+	kind    segmentKind
+	created time.Time
+	// base equals the segment id unless the segment is a merge result, in
+	// which case every segment from base up to the own id is superseded by it.
+	base int
+}
+
+func newHeader(kind segmentKind, base int) segmentHeader {
+	return segmentHeader{
+		version: formatVersion,
+		kind:    kind,
+		created: time.Now(),
+		base:    base,
+	}
+}
+
+func (h segmentHeader) Encode() []byte {
+	res := make([]byte, headerSize)
+	copy(res, segmentMagic)
+	binary.LittleEndian.PutUint16(res[4:], h.version)
+	res[6] = byte(h.kind)
+	binary.LittleEndian.PutUint64(res[8:], uint64(h.created.UnixNano()))
+	binary.LittleEndian.PutUint32(res[16:], uint32(h.base))
+	return res
+}
+
+// size is the number of bytes the header occupies in the file.
+func (h segmentHeader) size() int64 {
+	if h.version == 0 {
+		return 0
+	}
+	return headerSize
+}
+
+// readHeader reads the header of a segment file. A file that does not start
+// with the magic bytes is a legacy one and yields a version 0 header with the
+// given id as its base.
+func readHeader(in io.ReaderAt, id int) (segmentHeader, error) {
+	buf := make([]byte, headerSize)
+	n, err := in.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return segmentHeader{}, err
+	}
+	if n < headerSize || string(buf[:4]) != segmentMagic {
+		return segmentHeader{base: id}, nil
+	}
+
+	h := segmentHeader{
+		version: binary.LittleEndian.Uint16(buf[4:]),
+		kind:    segmentKind(buf[6]),
+		created: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:]))),
+		base:    int(binary.LittleEndian.Uint32(buf[16:])),
+	}
+	if h.version > formatVersion {
+		return h, fmt.Errorf("unsupported segment format version %d", h.version)
+	}
+	return h, nil
+}
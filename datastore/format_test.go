@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeLegacySegment stores entries the way segments were written before they
+// had a header.
+func writeLegacySegment(t *testing.T, fs FS, id int, entries ...entry) {
+	t.Helper()
+	f, err := fs.OpenFile(filepath.Join(memDir, outFileName+strconv.Itoa(id)), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, e := range entries {
+		if _, err := f.Write(e.Encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Sync()
+}
+
+func segmentVersion(t *testing.T, fs FS, id int) uint16 {
+	t.Helper()
+	f, err := fs.Open(filepath.Join(memDir, outFileName+strconv.Itoa(id)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h, err := readHeader(f, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.version
+}
+
+func TestSegmentHeader(t *testing.T) {
+	h := newHeader(kindMerge, 7)
+	fs := NewMemFS()
+	f, _ := fs.OpenFile("segment", os.O_CREATE|os.O_RDWR, 0o600)
+	f.Write(h.Encode())
+
+	got, err := readHeader(f, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.version != formatVersion || got.kind != kindMerge || got.base != 7 || !got.created.Equal(h.created) {
+		t.Errorf("Unexpected header %+v, expected %+v", got, h)
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	fs := NewMemFS()
+	writeLegacySegment(t, fs, 0, entry{"key1", "value1"}, entry{"key2", "value2"})
+	writeLegacySegment(t, fs, 1, entry{"key1", "value3"})
+
+	db := openMemDb(t, fs, 1000, WithSyncWrites(true))
+	checkValues(t, db, map[string]string{"key1": "value3", "key2": "value2"})
+
+	db.Put("key3", "value3")
+	if v := segmentVersion(t, fs, 2); v != formatVersion {
+		t.Errorf("Expected the active segment in version %d, got %d", formatVersion, v)
+	}
+
+	// Opening adds a third segment, so the legacy ones get merged into the
+	// current format.
+	db.mergeWg.Wait()
+	if v := segmentVersion(t, fs, 1); v != formatVersion {
+		t.Errorf("Expected the merged segment in version %d, got %d", formatVersion, v)
+	}
+
+	db = crash(t, fs, db, 1000)
+	checkValues(t, db, map[string]string{"key1": "value3", "key2": "value2", "key3": "value3"})
+}
+
+func TestMigrate(t *testing.T) {
+	fs := NewMemFS()
+	writeLegacySegment(t, fs, 0, entry{"key1", "value1"}, entry{"key2", "value2"}, entry{"key2", legacyDeletedValue})
+
+	db := openMemDb(t, fs, 1000, WithSyncWrites(true))
+	n, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 migrated segment, got %d", n)
+	}
+	if v := segmentVersion(t, fs, 0); v != formatVersion {
+		t.Errorf("Expected version %d after migration, got %d", formatVersion, v)
+	}
+	checkValues(t, db, map[string]string{"key1": "value1", "key2": ""})
+
+	db = crash(t, fs, db, 1000)
+	checkValues(t, db, map[string]string{"key1": "value1", "key2": ""})
+	if n, _ := db.Migrate(); n != 0 {
+		t.Errorf("Expected nothing left to migrate, got %d", n)
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	fs := NewMemFS()
+	h := newHeader(kindWrite, 0)
+	data := h.Encode()
+	binary.LittleEndian.PutUint16(data[4:], formatVersion+1)
+	f, _ := fs.OpenFile(filepath.Join(memDir, outFileName+"0"), os.O_CREATE|os.O_WRONLY, 0o600)
+	f.Write(data)
+
+	_, err := NewDb(memDir, 1000, WithFS(fs))
+	if err == nil || !strings.Contains(err.Error(), "unsupported segment format") {
+		t.Errorf("Expected unsupported format error, got %v", err)
+	}
+}
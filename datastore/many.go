@@ -0,0 +1,146 @@
+package datastore
+
+import "context"
+
+// GetMany looks up several keys in one consistent pass: no write lands while
+// the values are read. It returns the values found and the missing keys in
+// the order they were asked for.
+func (db *Db) GetMany(keys []string) (map[string]string, []string, error) {
+	return db.GetManyContext(context.Background(), keys)
+}
+
+func (db *Db) GetManyContext(ctx context.Context, keys []string) (map[string]string, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+
+	values := make(map[string]string, len(keys))
+	var missing []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		segment, rec, ok := db.lookup(key)
+		if !ok {
+			db.getMisses.Add(1)
+			missing = append(missing, key)
+			continue
+		}
+		db.getHits.Add(1)
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		value, err := segment.getValue(rec.position)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[key] = value
+	}
+	return values, missing, nil
+}
+
+// DeleteMany deletes several keys. Other writers wait until all of them are
+// deleted, but a failed write can leave the keys before it deleted.
+func (db *Db) DeleteMany(keys []string) error {
+	return db.DeleteManyContext(context.Background(), keys)
+}
+
+func (db *Db) DeleteManyContext(ctx context.Context, keys []string) error {
+	_, err := db.DeleteExistingContext(ctx, keys)
+	return err
+}
+
+func (db *Db) DeleteExisting(keys []string) (int, error) {
+	return db.DeleteExistingContext(context.Background(), keys)
+}
+
+func (db *Db) DeleteExistingContext(ctx context.Context, keys []string) (int, error) {
+	if err := db.throttle(ctx); err != nil {
+		return 0, err
+	}
+	if err := db.lockWriter(ctx); err != nil {
+		return 0, err
+	}
+	defer db.unlockWriter()
+
+	existed := 0
+	for _, key := range keys {
+		db.indexLock.RLock()
+		_, _, ok := db.lookup(key)
+		db.indexLock.RUnlock()
+		if ok {
+			existed++
+		}
+		if err := db.put(key, "", true); err != nil {
+			return existed, err
+		}
+	}
+	return existed, nil
+}
+
+func (s *MemStore) GetMany(keys []string) (map[string]string, []string, error) {
+	return s.GetManyContext(context.Background(), keys)
+}
+
+func (s *MemStore) GetManyContext(ctx context.Context, keys []string) (map[string]string, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	values := make(map[string]string, len(keys))
+	var missing []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if value, ok := s.data[key]; ok {
+			values[key] = value
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	return values, missing, nil
+}
+
+func (s *MemStore) DeleteMany(keys []string) error {
+	return s.DeleteManyContext(context.Background(), keys)
+}
+
+func (s *MemStore) DeleteManyContext(ctx context.Context, keys []string) error {
+	_, err := s.DeleteExistingContext(ctx, keys)
+	return err
+}
+
+func (s *MemStore) DeleteExisting(keys []string) (int, error) {
+	return s.DeleteExistingContext(context.Background(), keys)
+}
+
+func (s *MemStore) DeleteExistingContext(ctx context.Context, keys []string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existed := 0
+	for _, key := range keys {
+		if _, ok := s.data[key]; ok {
+			existed++
+		}
+		s.remove(key)
+	}
+	return existed, nil
+}
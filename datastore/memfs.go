@@ -0,0 +1,355 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is an in-memory FS meant for tests. Besides plain storage it can
+// inject faults: short writes, failing fsync, failing rename/remove, running
+// out of space and crashing.
+//
+// The crash model is deliberately simple: directory operations (create,
+// rename, remove) are durable as soon as they return, while file contents are
+// durable only up to the last successful Sync.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	// gen is bumped by Crash so that handles opened before it stop working.
+	gen int
+
+	shortWrite int
+	syncErr    error
+	renameErr  error
+	removeErr  error
+	capacity   int64
+}
+
+type memNode struct {
+	data    []byte
+	synced  int
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files:      make(map[string]*memNode),
+		shortWrite: -1,
+	}
+}
+
+// ShortWrite makes the next Write store only the first n bytes and fail with
+// io.ErrShortWrite.
+func (fs *MemFS) ShortWrite(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.shortWrite = n
+}
+
+// FailSync makes every following Sync fail with err. A nil err clears the fault.
+func (fs *MemFS) FailSync(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.syncErr = err
+}
+
+// FailRename makes every following Rename fail with err. A nil err clears the fault.
+func (fs *MemFS) FailRename(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.renameErr = err
+}
+
+// FailRemove makes every following Remove fail with err. A nil err clears the fault.
+func (fs *MemFS) FailRemove(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.removeErr = err
+}
+
+// SetCapacity limits the total size of all files. Writes that do not fit are
+// cut short and fail with ENOSPC. Zero means unlimited.
+func (fs *MemFS) SetCapacity(bytes int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.capacity = bytes
+}
+
+// Crash simulates a power loss: every file loses the data written after its
+// last successful Sync, all open handles become invalid and injected faults
+// are cleared.
+func (fs *MemFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, n := range fs.files {
+		n.data = n.data[:n.synced]
+	}
+	fs.gen++
+	fs.shortWrite = -1
+	fs.syncErr = nil
+	fs.renameErr = nil
+	fs.removeErr = nil
+	fs.capacity = 0
+}
+
+func (fs *MemFS) used() int64 {
+	var total int64
+	for _, n := range fs.files {
+		total += int64(len(n.data))
+	}
+	return total
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, _ os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	n, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		n = &memNode{modTime: time.Now()}
+		fs.files[name] = n
+	} else if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if flag&os.O_TRUNC != 0 {
+		n.data = n.data[:0]
+		n.synced = 0
+	}
+	return &memFile{fs: fs, name: name, node: n, flag: flag, gen: fs.gen}, nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if fs.removeErr != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.removeErr}
+	}
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *MemFS) Rename(oldPath, newPath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	if fs.renameErr != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.renameErr}
+	}
+	n, ok := fs.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldPath)
+	fs.files[newPath] = n
+	return nil
+}
+
+func (fs *MemFS) ReadDir(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// MkdirAll is a no-op: MemFS keeps a flat namespace where every directory
+// implicitly exists.
+func (fs *MemFS) MkdirAll(string, os.FileMode) error { return nil }
+
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	gen    int
+	closed bool
+}
+
+func (f *memFile) check(op string) error {
+	if f.closed || f.gen != f.fs.gen {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if !f.writable() {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+
+	want := len(p)
+	var err error
+	if f.fs.shortWrite >= 0 && f.fs.shortWrite < want {
+		want = f.fs.shortWrite
+		err = io.ErrShortWrite
+		f.fs.shortWrite = -1
+	}
+	if f.fs.capacity > 0 {
+		free := f.fs.capacity - f.fs.used()
+		if free < 0 {
+			free = 0
+		}
+		if int64(want) > free {
+			want = int(free)
+			err = &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+		}
+	}
+
+	pos := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		pos = int64(len(f.node.data))
+	}
+	if end := pos + int64(want); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[pos:], p[:want])
+	f.node.modTime = time.Now()
+	if f.flag&os.O_APPEND == 0 {
+		f.offset = pos + int64(want)
+	}
+	return want, err
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	if f.fs.syncErr != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: f.fs.syncErr}
+	}
+	f.node.synced = len(f.node.data)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	if !f.writable() {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	if f.node.synced > int(size) {
+		f.node.synced = int(size)
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return memFileInfo{
+		name:    filepath.Base(f.name),
+		size:    int64(len(f.node.data)),
+		modTime: f.node.modTime,
+	}, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0o600 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
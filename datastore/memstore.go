@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemStore is a Store that keeps everything in a map. It is safe for
+// concurrent use and meant as a lightweight stand-in for Db in tests.
+type MemStore struct {
+	lock sync.RWMutex
+	data map[string]string
+	seq  uint64
+	feed *changeFeed
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		data: make(map[string]string),
+		feed: newChangeFeed(),
+	}
+}
+
+func (s *MemStore) Get(key string) (string, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+func (s *MemStore) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	value, ok := s.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *MemStore) Put(key, value string) error {
+	return s.PutContext(context.Background(), key, value)
+}
+
+func (s *MemStore) PutContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(key, value)
+	return nil
+}
+
+func (s *MemStore) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+func (s *MemStore) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.remove(key)
+	return nil
+}
+
+func (s *MemStore) Scan(prefix string, fn func(key, value string) bool) error {
+	return s.ScanAfter(prefix, "", fn)
+}
+
+func (s *MemStore) ScanAfter(prefix, after string, fn func(key, value string) bool) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		if inRange(key, prefix, after) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !fn(key, s.data[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) Close() error {
+	s.feed.close()
+	return nil
+}
+
+// set and remove change a key and publish the change. They must be called
+// with lock held.
+func (s *MemStore) set(key, value string) {
+	s.data[key] = value
+	s.seq++
+	s.feed.publish(putChange(key, s.seq, value))
+}
+
+func (s *MemStore) remove(key string) {
+	delete(s.data, key)
+	s.seq++
+	s.feed.publish(Change{Key: key, Op: OpDelete, Version: s.seq})
+}
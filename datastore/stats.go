@@ -0,0 +1,142 @@
+package datastore
+
+import "time"
+
+// SegmentStats describes a single segment file.
+type SegmentStats struct {
+	ID      int       `json:"id"`
+	Format  int       `json:"format"`
+	Kind    string    `json:"kind"`
+	Created time.Time `json:"created"`
+	// Keys counts the live keys whose newest value is stored in the segment.
+	Keys       int   `json:"keys"`
+	TotalBytes int64 `json:"totalBytes"`
+	// DeadBytes counts the bytes a merge would reclaim: overwritten values
+	// and deletion markers.
+	DeadBytes int64 `json:"deadBytes"`
+}
+
+// Stats is a snapshot of the Db state.
+type Stats struct {
+	Keys              int            `json:"keys"`
+	SegmentCount      int            `json:"segmentCount"`
+	Segments          []SegmentStats `json:"segments"`
+	ActiveSegmentSize int64          `json:"activeSegmentSize"`
+	TotalBytes        int64          `json:"totalBytes"`
+	DeadBytes         int64          `json:"deadBytes"`
+	Merges            int            `json:"merges"`
+	MergeErrors       int            `json:"mergeErrors"`
+	MergeDuration     time.Duration  `json:"mergeDurationNs"`
+	LastMergeDuration time.Duration  `json:"lastMergeDurationNs"`
+	LastMergeError    string         `json:"lastMergeError,omitempty"`
+	// GetHits and GetMisses count the keys looked up by reads since the Db
+	// was opened, and BytesWritten the bytes appended by writes, not counting
+	// merges.
+	GetHits      int64 `json:"getHits"`
+	GetMisses    int64 `json:"getMisses"`
+	BytesWritten int64 `json:"bytesWritten"`
+	// WriteDelay is the delay currently added to every write, and
+	// WriteStalled tells whether writes are stalled. See Backpressure.
+	WriteDelay    time.Duration `json:"writeDelayNs"`
+	WriteStalled  bool          `json:"writeStalled"`
+	DelayedWrites int64         `json:"delayedWrites"`
+	StalledWrites int64         `json:"stalledWrites"`
+	// Buckets maps the name of every non-empty bucket to its usage.
+	Buckets map[string]BucketStats `json:"buckets"`
+}
+
+// BucketStats describes the live data of a bucket.
+type BucketStats struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// mergeStats accumulates the outcome of merges. It is guarded by indexLock.
+type mergeStats struct {
+	runs          int
+	errors        int
+	totalDuration time.Duration
+	lastDuration  time.Duration
+	lastError     string
+}
+
+func (m *mergeStats) record(duration time.Duration, err error) {
+	m.runs++
+	m.totalDuration += duration
+	m.lastDuration = duration
+	m.lastError = ""
+	if err != nil {
+		m.errors++
+		m.lastError = err.Error()
+	}
+}
+
+// Stats walks the segment indexes and reports how much of the stored data is
+// still live. Segments are listed oldest first.
+func (db *Db) Stats() Stats {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+	return db.stats()
+}
+
+// stats must be called with indexLock held.
+func (db *Db) stats() Stats {
+	stats := Stats{
+		SegmentCount:      len(db.segments),
+		Segments:          make([]SegmentStats, len(db.segments)),
+		ActiveSegmentSize: db.outOffset,
+		Merges:            db.mergeStats.runs,
+		MergeErrors:       db.mergeStats.errors,
+		MergeDuration:     db.mergeStats.totalDuration,
+		LastMergeDuration: db.mergeStats.lastDuration,
+		LastMergeError:    db.mergeStats.lastError,
+		DelayedWrites:     db.delayedWrites.Load(),
+		StalledWrites:     db.stalledWrites.Load(),
+		GetHits:           db.getHits.Load(),
+		GetMisses:         db.getMisses.Load(),
+		BytesWritten:      db.bytesWritten.Load(),
+		Buckets:           make(map[string]BucketStats),
+	}
+	stats.WriteDelay, stats.WriteStalled = db.writeState()
+
+	seen := make(map[string]bool)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		s := db.segments[i]
+		segmentStats := SegmentStats{
+			ID:      s.id,
+			Format:  int(s.header.version),
+			Kind:    s.header.kind.String(),
+			Created: s.header.created,
+		}
+		if s.header.version == 0 {
+			segmentStats.Kind = "legacy"
+		}
+
+		s.lock.RLock()
+		live := s.header.size()
+		for key, rec := range s.index {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if !rec.deleted {
+				segmentStats.Keys++
+				live += rec.size
+				bucket := stats.Buckets[bucketName(key)]
+				bucket.Keys++
+				bucket.Bytes += rec.size
+				stats.Buckets[bucketName(key)] = bucket
+			}
+		}
+		segmentStats.TotalBytes = s.size
+		s.lock.RUnlock()
+		segmentStats.DeadBytes = segmentStats.TotalBytes - live
+
+		stats.Segments[i] = segmentStats
+		stats.Keys += segmentStats.Keys
+		stats.TotalBytes += segmentStats.TotalBytes
+		stats.DeadBytes += segmentStats.DeadBytes
+	}
+
+	return stats
+}
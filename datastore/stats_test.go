@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	t.Run("Live And Dead Bytes", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000)
+		db.Put("key1", "value1")
+		db.Put("key2", "value2")
+		db.Put("key1", "value3")
+		db.Delete("key2")
+
+		stats := db.Stats()
+		if stats.Keys != 1 {
+			t.Errorf("Expected 1 live key, got %d", stats.Keys)
+		}
+		if stats.SegmentCount != 1 || len(stats.Segments) != 1 {
+			t.Fatalf("Expected 1 segment, got %d", stats.SegmentCount)
+		}
+		segment := stats.Segments[0]
+		if expected := int64(headerSize + 22*3 + 16); segment.TotalBytes != expected || stats.ActiveSegmentSize != expected {
+			t.Errorf("Expected %d bytes, got %d (active %d)", expected, segment.TotalBytes, stats.ActiveSegmentSize)
+		}
+		if segment.DeadBytes != 22*2+16 {
+			t.Errorf("Expected %d dead bytes, got %d", 22*2+16, segment.DeadBytes)
+		}
+		if segment.Format != formatVersion || segment.Kind != "write" {
+			t.Errorf("Unexpected segment format %d and kind %s", segment.Format, segment.Kind)
+		}
+		if stats.BytesWritten != 22*3+16 {
+			t.Errorf("Expected %d bytes written, got %d", 22*3+16, stats.BytesWritten)
+		}
+	})
+
+	t.Run("Reads", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000)
+		db.Put("key1", "value1")
+		db.Get("key1")
+		db.Get("missing")
+		db.GetMany([]string{"key1", "missing", "other"})
+
+		stats := db.Stats()
+		if stats.GetHits != 2 || stats.GetMisses != 3 {
+			t.Errorf("Expected 2 hits and 3 misses, got %d and %d", stats.GetHits, stats.GetMisses)
+		}
+	})
+
+	t.Run("Merges", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 45)
+		db.Put("key1", "value1")
+		db.Put("key1", "value2")
+		db.Put("key2", "value2")
+		db.Put("key3", "value3")
+		db.Put("key4", "value4")
+		db.mergeWg.Wait()
+
+		stats := db.Stats()
+		if stats.Merges != 1 || stats.MergeErrors != 0 {
+			t.Errorf("Expected 1 successful merge, got %d runs and %d errors", stats.Merges, stats.MergeErrors)
+		}
+		if stats.MergeDuration <= 0 || stats.MergeDuration != stats.LastMergeDuration {
+			t.Errorf("Unexpected merge durations %s and %s", stats.MergeDuration, stats.LastMergeDuration)
+		}
+		if stats.SegmentCount != 2 || stats.Keys != 4 {
+			t.Errorf("Expected 2 segments and 4 keys, got %d and %d", stats.SegmentCount, stats.Keys)
+		}
+		if merged := stats.Segments[0]; merged.Kind != "merge" || merged.DeadBytes != 0 || merged.Keys != 3 {
+			t.Errorf("Unexpected merged segment %+v", merged)
+		}
+	})
+
+	t.Run("Merge Errors", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 45)
+		fs.FailRename(syscall.EIO)
+		for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+			db.Put(key, "value")
+		}
+		db.mergeWg.Wait()
+
+		stats := db.Stats()
+		if stats.MergeErrors != 1 || !strings.Contains(stats.LastMergeError, "input/output error") {
+			t.Errorf("Expected a recorded merge error, got %d: %q", stats.MergeErrors, stats.LastMergeError)
+		}
+	})
+}
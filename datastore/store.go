@@ -0,0 +1,47 @@
+package datastore
+
+import "context"
+
+// Store is the key-value storage API shared by the disk-backed Db and the
+// in-memory MemStore. The Context variants return early with the context
+// error once the context is done.
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	Delete(key string) error
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+	// Increment, Append and GetOrSet read and write a key atomically with
+	// respect to other writers.
+	Increment(key string, delta int64) (int64, error)
+	IncrementContext(ctx context.Context, key string, delta int64) (int64, error)
+	Append(key, suffix string) (string, error)
+	AppendContext(ctx context.Context, key, suffix string) (string, error)
+	GetOrSet(key, def string) (value string, loaded bool, err error)
+	GetOrSetContext(ctx context.Context, key, def string) (value string, loaded bool, err error)
+	// GetMany returns the values found and the missing keys in the order
+	// they were asked for.
+	GetMany(keys []string) (values map[string]string, missing []string, err error)
+	GetManyContext(ctx context.Context, keys []string) (values map[string]string, missing []string, err error)
+	DeleteMany(keys []string) error
+	DeleteManyContext(ctx context.Context, keys []string) error
+	// DeleteExisting is DeleteMany that returns how many of the keys
+	// existed, counting a repeated key once. No other write lands between
+	// the check and the delete.
+	DeleteExisting(keys []string) (int, error)
+	DeleteExistingContext(ctx context.Context, keys []string) (int, error)
+	// Scan calls fn for every key starting with prefix in ascending key order
+	// until fn returns false. fn must not call back into the store.
+	Scan(prefix string, fn func(key, value string) bool) error
+	// ScanAfter is Scan over the keys greater than after. The values of the
+	// keys it skips are never read, so paging through a large range with
+	// the last key of every page stays cheap.
+	ScanAfter(prefix, after string, fn func(key, value string) bool) error
+	Close() error
+}
+
+var (
+	_ Store = (*Db)(nil)
+	_ Store = (*MemStore)(nil)
+)
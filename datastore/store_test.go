@@ -0,0 +1,300 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testStore is the conformance suite every Store implementation has to pass.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("Get Missing", func(t *testing.T) {
+		store := newStore(t)
+		if _, err := store.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Put Get Overwrite", func(t *testing.T) {
+		store := newStore(t)
+		for _, value := range []string{"value1", "value2", ""} {
+			if err := store.Put("key", value); err != nil {
+				t.Fatalf("Cannot put: %s", err)
+			}
+			result, err := store.Get("key")
+			if err != nil {
+				t.Fatalf("Cannot get: %s", err)
+			}
+			if result != value {
+				t.Errorf("Bad value returned expected %q, got %q", value, result)
+			}
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		store.Put("key", "value")
+		if err := store.Delete("key"); err != nil {
+			t.Fatalf("Cannot delete: %s", err)
+		}
+		if _, err := store.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if err := store.Delete("missing"); err != nil {
+			t.Errorf("Deleting a missing key failed: %s", err)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		store := newStore(t)
+		for _, key := range []string{"b2", "a1", "b1", "b3", "c1"} {
+			store.Put(key, "v-"+key)
+		}
+		store.Put("b1", "new")
+		store.Delete("b3")
+
+		var got []string
+		err := store.Scan("b", func(key, value string) bool {
+			got = append(got, key+"="+value)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"b1=new", "b2=v-b2"}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Unexpected scan result %v, expected %v", got, expected)
+		}
+
+		got = nil
+		store.Scan("", func(key, value string) bool {
+			got = append(got, key)
+			return len(got) < 2
+		})
+		if expected := []string{"a1", "b1"}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Unexpected stopped scan result %v, expected %v", got, expected)
+		}
+
+		got = nil
+		err = store.ScanAfter("b", "b1", func(key, value string) bool {
+			got = append(got, key+"="+value)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"b2=v-b2"}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Unexpected scan result after b1 %v, expected %v", got, expected)
+		}
+	})
+
+	t.Run("Cancelled Context", func(t *testing.T) {
+		store := newStore(t)
+		store.Put("key", "value")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := store.GetContext(ctx, "key"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled from Get, got %v", err)
+		}
+		if err := store.PutContext(ctx, "key", "value2"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled from Put, got %v", err)
+		}
+		if err := store.DeleteContext(ctx, "key"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled from Delete, got %v", err)
+		}
+		if value, err := store.Get("key"); err != nil || value != "value" {
+			t.Errorf("Expected the value to be untouched, got %q, %v", value, err)
+		}
+	})
+
+	t.Run("Increment", func(t *testing.T) {
+		store := newStore(t)
+		for _, step := range []struct {
+			delta, expected int64
+		}{{1, 1}, {41, 42}, {-50, -8}} {
+			n, err := store.Increment("counter", step.delta)
+			if err != nil {
+				t.Fatalf("Cannot increment: %s", err)
+			}
+			if n != step.expected {
+				t.Errorf("Expected %d, got %d", step.expected, n)
+			}
+		}
+		if value, _ := store.Get("counter"); value != "-8" {
+			t.Errorf("Unexpected stored counter %q", value)
+		}
+
+		store.Put("text", "value")
+		if _, err := store.Increment("text", 1); err != ErrNotInteger {
+			t.Errorf("Expected ErrNotInteger, got %v", err)
+		}
+		store.Put("max", "9223372036854775807")
+		if _, err := store.Increment("max", 1); err != ErrOverflow {
+			t.Errorf("Expected ErrOverflow, got %v", err)
+		}
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		store := newStore(t)
+		for _, expected := range []string{"a", "ab", "abb"} {
+			value, err := store.Append("key", expected[len(expected)-1:])
+			if err != nil {
+				t.Fatalf("Cannot append: %s", err)
+			}
+			if value != expected {
+				t.Errorf("Expected %q, got %q", expected, value)
+			}
+		}
+	})
+
+	t.Run("GetOrSet", func(t *testing.T) {
+		store := newStore(t)
+		value, loaded, err := store.GetOrSet("key", "first")
+		if err != nil || loaded || value != "first" {
+			t.Errorf("Expected the default to be stored, got %q, %t, %v", value, loaded, err)
+		}
+		value, loaded, err = store.GetOrSet("key", "second")
+		if err != nil || !loaded || value != "first" {
+			t.Errorf("Expected the stored value, got %q, %t, %v", value, loaded, err)
+		}
+	})
+
+	t.Run("Many", func(t *testing.T) {
+		store := newStore(t)
+		store.Put("key1", "value1")
+		store.Put("key2", "value2")
+		store.Put("key3", "value3")
+
+		values, missing, err := store.GetMany([]string{"key1", "missing2", "key3", "missing1", "key1"})
+		if err != nil {
+			t.Fatalf("Cannot get many: %s", err)
+		}
+		if expected := map[string]string{"key1": "value1", "key3": "value3"}; !reflect.DeepEqual(values, expected) {
+			t.Errorf("Unexpected values %v, expected %v", values, expected)
+		}
+		if expected := []string{"missing2", "missing1"}; !reflect.DeepEqual(missing, expected) {
+			t.Errorf("Unexpected missing keys %v, expected %v", missing, expected)
+		}
+
+		if err := store.DeleteMany([]string{"key1", "key3", "missing1"}); err != nil {
+			t.Fatalf("Cannot delete many: %s", err)
+		}
+		values, missing, _ = store.GetMany([]string{"key1", "key2", "key3"})
+		if expected := map[string]string{"key2": "value2"}; !reflect.DeepEqual(values, expected) {
+			t.Errorf("Unexpected values after delete %v, expected %v", values, expected)
+		}
+		if expected := []string{"key1", "key3"}; !reflect.DeepEqual(missing, expected) {
+			t.Errorf("Unexpected missing keys after delete %v, expected %v", missing, expected)
+		}
+
+		if n, err := store.DeleteExisting([]string{"key2", "key2", "key1"}); err != nil || n != 1 {
+			t.Errorf("Expected 1 existing key deleted, got %d, %v", n, err)
+		}
+		if _, err := store.Get("key2"); err != ErrNotFound {
+			t.Errorf("Expected key2 to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("Concurrent Increment", func(t *testing.T) {
+		store := newStore(t)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					if _, err := store.Increment("counter", 1); err != nil {
+						t.Errorf("Cannot increment: %s", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if value, _ := store.Get("counter"); value != "200" {
+			t.Errorf("Expected 200 increments, got %q", value)
+		}
+	})
+
+	t.Run("Concurrent Access", func(t *testing.T) {
+		store := newStore(t)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					key := fmt.Sprintf("w%d-%d", w, i)
+					if err := store.Put(key, key); err != nil {
+						t.Errorf("Cannot put %s: %s", key, err)
+						return
+					}
+					if value, err := store.Get(key); err != nil || value != key {
+						t.Errorf("Bad value for %s: %q, %v", key, value, err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		count := 0
+		store.Scan("w", func(key, value string) bool {
+			count++
+			return true
+		})
+		if count != 200 {
+			t.Errorf("Expected 200 keys, got %d", count)
+		}
+	})
+}
+
+func newTestDb(segmentSize int64) func(t *testing.T) Store {
+	return func(t *testing.T) Store {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			db.Close()
+			os.RemoveAll(dir)
+		})
+		return db
+	}
+}
+
+func TestStore_Db(t *testing.T) {
+	testStore(t, newTestDb(1<<20))
+}
+
+func TestStore_DbSmallSegments(t *testing.T) {
+	testStore(t, newTestDb(100))
+}
+
+func TestStore_MemStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemStore() })
+}
+
+func TestStore_Bucket(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		store := NewMemStore()
+		// Keys of the default bucket and another bucket must not show up.
+		store.Put("key", "default")
+		other, _ := store.Bucket("other")
+		other.Put("key", "other")
+
+		b, err := store.Bucket("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	})
+}
@@ -0,0 +1,257 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrValueTooLarge is returned for a value that does not fit in a record.
+var ErrValueTooLarge = errors.New("value is too large")
+
+// Streamer is implemented by stores that move values through readers, so
+// that large values are never held in memory whole.
+type Streamer interface {
+	// PutReader stores the value read from r at key. Nothing is stored if
+	// reading fails.
+	PutReader(ctx context.Context, key string, r io.Reader) error
+	// GetReader returns a reader of the value of key and the value size. The
+	// reader has to be closed.
+	GetReader(ctx context.Context, key string) (io.ReadCloser, int64, error)
+}
+
+var (
+	_ Streamer = (*Db)(nil)
+	_ Streamer = (*MemStore)(nil)
+	_ Streamer = (*Bucket)(nil)
+)
+
+// spoolPrefix starts the names of the files uploads are spooled to. Files
+// left behind by a crash are deleted by recover.
+const spoolPrefix = "upload-"
+
+// PutReader spools the value to a file in the Db directory first and only
+// then copies it into the active segment, so a slow reader does not hold up
+// the other writers. Readers are not blocked while the copy runs either.
+//
+// Values over feedValueLimit reach watchers without the value, see
+// Change.ValueOmitted.
+func (db *Db) PutReader(ctx context.Context, key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	spool, size, err := db.spool(ctx, key, r)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		db.fs.Remove(spool.Name())
+	}()
+
+	if err := db.throttle(ctx); err != nil {
+		return err
+	}
+	if err := db.lockWriter(ctx); err != nil {
+		return err
+	}
+	defer db.unlockWriter()
+
+	return db.putFrom(key, io.NewSectionReader(spool, 0, size), size)
+}
+
+// spool copies the value from r to a new file and returns it with the value
+// size.
+func (db *Db) spool(ctx context.Context, key string, r io.Reader) (File, int64, error) {
+	var (
+		f   File
+		err error
+	)
+	for i := 0; ; i++ {
+		name := filepath.Join(db.dir, fmt.Sprintf("%s%d", spoolPrefix, db.spools.Add(1)))
+		f, err = db.fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if !errors.Is(err, os.ErrExist) || i == 100 {
+			break
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	maxSize := int64(math.MaxUint32) - int64(len(key)) - 12
+	size, err := io.Copy(f, io.LimitReader(r, maxSize+1))
+	if err == nil && size > maxSize {
+		err = ErrValueTooLarge
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		f.Close()
+		db.fs.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// putFrom appends a record with the size bytes of value to the active
+// segment. It must be called holding the writer slot, which keeps the active
+// segment to itself while it copies the value without indexLock.
+func (db *Db) putFrom(key string, value io.Reader, size int64) error {
+	header := make([]byte, len(key)+12)
+	recordSize := int64(len(header)) + size
+	binary.LittleEndian.PutUint32(header, uint32(recordSize))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(key)))
+	copy(header[8:], key)
+	binary.LittleEndian.PutUint32(header[len(key)+8:], uint32(size))
+
+	db.indexLock.Lock()
+	active := db.segments[len(db.segments)-1]
+	dataSize := db.outOffset - active.header.size()
+	if db.outBroken || (dataSize > 0 && dataSize+recordSize > db.segmentSize) {
+		if err := db.createSegment(); err != nil {
+			db.indexLock.Unlock()
+			return err
+		}
+	}
+	db.indexLock.Unlock()
+
+	var feedValue strings.Builder
+	data := io.MultiReader(bytes.NewReader(header), value)
+	if size <= feedValueLimit {
+		data = io.MultiReader(bytes.NewReader(header), io.TeeReader(value, &feedValue))
+	}
+	if err := db.writeFrom(data); err != nil {
+		return err
+	}
+
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+	// The version is taken only now, so that no snapshot reports it before
+	// the record is in the index.
+	version, err := db.nextVersion()
+	if err != nil {
+		if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+			db.outBroken = true
+		}
+		return err
+	}
+	db.bytesWritten.Add(recordSize)
+
+	active = db.segments[len(db.segments)-1]
+	active.lock.Lock()
+	active.index[key] = record{
+		position: db.outOffset,
+		size:     recordSize,
+		version:  version,
+	}
+	db.outOffset += recordSize
+	active.size = db.outOffset
+	active.lock.Unlock()
+
+	change := Change{Key: key, Op: OpPut, Version: version, ValueOmitted: true}
+	if size <= feedValueLimit {
+		change = putChange(key, version, feedValue.String())
+	}
+	db.feed.publish(change)
+	return nil
+}
+
+// writeFrom is write for data read from r.
+func (db *Db) writeFrom(r io.Reader) error {
+	w := bufio.NewWriterSize(db.out, bufSize)
+	_, err := io.Copy(w, r)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && db.syncWrites {
+		err = db.out.Sync()
+	}
+	if err != nil {
+		if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+			db.outBroken = true
+		}
+		return err
+	}
+	return nil
+}
+
+// GetReader reads the value straight from its segment file. The reader keeps
+// working when a merge deletes the file in the meantime.
+func (db *Db) GetReader(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+
+	segment, rec, ok := db.lookup(key)
+	if !ok {
+		db.getMisses.Add(1)
+		return nil, 0, ErrNotFound
+	}
+	db.getHits.Add(1)
+	file, err := segment.fs.Open(segment.outPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := rec.size - int64(len(key)) - 12
+	value := io.NewSectionReader(file, rec.position+int64(len(key))+12, size)
+	return struct {
+		io.Reader
+		io.Closer
+	}{value, file}, size, nil
+}
+
+// PutReader of a MemStore reads the whole value, which it keeps in memory
+// anyway.
+func (s *MemStore) PutReader(ctx context.Context, key string, r io.Reader) error {
+	return putReader(ctx, s, key, r)
+}
+
+func (s *MemStore) GetReader(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	return getReader(ctx, s, key)
+}
+
+// PutReader streams the value if the underlying store is a Streamer and
+// reads it whole otherwise.
+func (b *Bucket) PutReader(ctx context.Context, key string, r io.Reader) error {
+	if s, ok := b.store.(Streamer); ok {
+		return s.PutReader(ctx, b.prefix+key, r)
+	}
+	return putReader(ctx, b.store, b.prefix+key, r)
+}
+
+func (b *Bucket) GetReader(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	if s, ok := b.store.(Streamer); ok {
+		return s.GetReader(ctx, b.prefix+key)
+	}
+	return getReader(ctx, b.store, b.prefix+key)
+}
+
+// putReader and getReader implement Streamer for any Store by holding values
+// in memory.
+func putReader(ctx context.Context, s Store, key string, r io.Reader) error {
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.PutContext(ctx, key, string(value))
+}
+
+func getReader(ctx context.Context, s Store, key string) (io.ReadCloser, int64, error) {
+	value, err := s.GetContext(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(strings.NewReader(value)), int64(len(value)), nil
+}
@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// failingReader fails after n bytes, like a client that goes away midway.
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func readAll(t *testing.T, s Streamer, key string) string {
+	t.Helper()
+	r, size, err := s.GetReader(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetReader %s: %s", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != size {
+		t.Errorf("Reader of %s returned %d bytes, size is %d", key, len(data), size)
+	}
+	return string(data)
+}
+
+func TestStreamer(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemFS()
+	db := openMemDb(t, fs, 1000)
+	changes, err := db.Watch(ctx, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("0123456789", 500)
+	db.Put("small", "value")
+	if err := db.PutReader(ctx, "large", strings.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("large"); err != nil || value != large {
+		t.Errorf("Get of a streamed value: %d bytes, %v", len(value), err)
+	}
+	if value := readAll(t, db, "small"); value != "value" {
+		t.Errorf("Unexpected value %q", value)
+	}
+	if value := readAll(t, db, "large"); value != large {
+		t.Errorf("Streamed value read back as %d bytes", len(value))
+	}
+	if _, _, err := db.GetReader(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	<-changes
+	if c := <-changes; c.Key != "large" || c.Op != OpPut || c.Value != large || c.Version != db.Version() {
+		t.Errorf("Unexpected change %s %s %d with %d bytes", c.Key, c.Op, c.Version, len(c.Value))
+	}
+
+	huge := strings.Repeat("x", feedValueLimit+1)
+	if err := db.PutReader(ctx, "huge", strings.NewReader(huge)); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-changes; c.Key != "huge" || !c.ValueOmitted || c.Value != "" {
+		t.Errorf("Expected the huge value to be omitted from the feed, got %s with %d bytes", c.Key, len(c.Value))
+	}
+	if value := readAll(t, db, "huge"); value != huge {
+		t.Errorf("Huge value read back as %d bytes", len(value))
+	}
+
+	t.Run("Failed Read", func(t *testing.T) {
+		readErr := errors.New("connection reset")
+		if err := db.PutReader(ctx, "small", &failingReader{n: 100, err: readErr}); err != readErr {
+			t.Errorf("Expected the read error, got %v", err)
+		}
+		if value, _ := db.Get("small"); value != "value" {
+			t.Errorf("A failed upload changed the value to %q", value)
+		}
+		names, _ := fs.ReadDir(memDir)
+		for _, name := range names {
+			if strings.HasPrefix(name, spoolPrefix) {
+				t.Errorf("Spool file %s left behind", name)
+			}
+		}
+	})
+
+	t.Run("Merge And Reopen", func(t *testing.T) {
+		r, _, err := db.GetReader(ctx, "large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		db.Put("small", "new")
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := io.ReadAll(r); string(data) != large {
+			t.Errorf("A reader opened before a merge returned %d bytes", len(data))
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = openMemDb(t, fs, 1000)
+		if value := readAll(t, db, "large"); value != large {
+			t.Errorf("Streamed value lost on reopen, got %d bytes", len(value))
+		}
+	})
+
+	t.Run("Bucket", func(t *testing.T) {
+		for _, store := range []Store{db, NewMemStore()} {
+			b, _ := NewBucket(store, "files")
+			if err := b.PutReader(ctx, "f", strings.NewReader("content")); err != nil {
+				t.Fatal(err)
+			}
+			if value, _ := store.Get(b.prefix + "f"); value != "content" {
+				t.Errorf("%T: unexpected stored value %q", store, value)
+			}
+			if value := readAll(t, b, "f"); value != "content" {
+				t.Errorf("%T: unexpected value %q", store, value)
+			}
+		}
+	})
+}
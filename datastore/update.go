@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = fmt.Errorf("value is not an integer")
+	ErrOverflow   = fmt.Errorf("increment overflows int64")
+)
+
+// updateFunc computes the new value of a key from its current one. found is
+// false for a missing key. Nothing is written when write is false.
+type updateFunc func(value string, found bool) (newValue string, write bool, err error)
+
+// increment adds delta to a base 10 int64 value, a missing key counting as 0.
+func increment(delta int64) updateFunc {
+	return func(value string, found bool) (string, bool, error) {
+		var n int64
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", false, ErrNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return "", false, ErrOverflow
+		}
+		return strconv.FormatInt(n+delta, 10), true, nil
+	}
+}
+
+func appendValue(suffix string) updateFunc {
+	return func(value string, _ bool) (string, bool, error) {
+		return value + suffix, true, nil
+	}
+}
+
+func getOrSet(def string) updateFunc {
+	return func(value string, found bool) (string, bool, error) {
+		if found {
+			return value, false, nil
+		}
+		return def, true, nil
+	}
+}
+
+// update applies fn to the value of key while holding the writer slot, so no
+// other write can slip in between the read and the write.
+func (db *Db) update(ctx context.Context, key string, fn updateFunc) (string, bool, error) {
+	if err := db.throttle(ctx); err != nil {
+		return "", false, err
+	}
+	if err := db.lockWriter(ctx); err != nil {
+		return "", false, err
+	}
+	defer db.unlockWriter()
+
+	value, err := db.GetContext(ctx, key)
+	found := err == nil
+	if err != nil && err != ErrNotFound {
+		return "", false, err
+	}
+	value, write, err := fn(value, found)
+	if err != nil || !write {
+		return value, found, err
+	}
+	return value, found, db.put(key, value, false)
+}
+
+// Increment atomically adds delta to the base 10 integer stored at key and
+// returns the result. A missing key counts as 0.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	return db.IncrementContext(context.Background(), key, delta)
+}
+
+func (db *Db) IncrementContext(ctx context.Context, key string, delta int64) (int64, error) {
+	value, _, err := db.update(ctx, key, increment(delta))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Append atomically adds suffix to the end of the value stored at key and
+// returns the new value. A missing key counts as empty.
+func (db *Db) Append(key, suffix string) (string, error) {
+	return db.AppendContext(context.Background(), key, suffix)
+}
+
+func (db *Db) AppendContext(ctx context.Context, key, suffix string) (string, error) {
+	value, _, err := db.update(ctx, key, appendValue(suffix))
+	return value, err
+}
+
+// GetOrSet returns the value stored at key, or stores def if the key is
+// missing and returns it. loaded reports whether the value already existed.
+func (db *Db) GetOrSet(key, def string) (value string, loaded bool, err error) {
+	return db.GetOrSetContext(context.Background(), key, def)
+}
+
+func (db *Db) GetOrSetContext(ctx context.Context, key, def string) (string, bool, error) {
+	// Existing keys are the common case and need neither the writer slot nor
+	// a pass through backpressure.
+	if value, err := db.GetContext(ctx, key); err != ErrNotFound {
+		return value, err == nil, err
+	}
+	return db.update(ctx, key, getOrSet(def))
+}
+
+// update is the MemStore counterpart of Db.update.
+func (s *MemStore) update(ctx context.Context, key string, fn updateFunc) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	if err := checkKey(key); err != nil {
+		return "", false, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, found := s.data[key]
+	value, write, err := fn(value, found)
+	if err != nil || !write {
+		return value, found, err
+	}
+	s.set(key, value)
+	return value, found, nil
+}
+
+func (s *MemStore) Increment(key string, delta int64) (int64, error) {
+	return s.IncrementContext(context.Background(), key, delta)
+}
+
+func (s *MemStore) IncrementContext(ctx context.Context, key string, delta int64) (int64, error) {
+	value, _, err := s.update(ctx, key, increment(delta))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (s *MemStore) Append(key, suffix string) (string, error) {
+	return s.AppendContext(context.Background(), key, suffix)
+}
+
+func (s *MemStore) AppendContext(ctx context.Context, key, suffix string) (string, error) {
+	value, _, err := s.update(ctx, key, appendValue(suffix))
+	return value, err
+}
+
+func (s *MemStore) GetOrSet(key, def string) (string, bool, error) {
+	return s.GetOrSetContext(context.Background(), key, def)
+}
+
+func (s *MemStore) GetOrSetContext(ctx context.Context, key, def string) (string, bool, error) {
+	return s.update(ctx, key, getOrSet(def))
+}
@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrVersionMismatch is returned by CompareAndSwap when the key has been
+	// written since the expected version.
+	ErrVersionMismatch     = errors.New("version mismatch")
+	ErrVersionsUnsupported = errors.New("store does not track versions")
+)
+
+// Versioner is implemented by stores that know the version of the last write
+// of every key, which lets clients update keys optimistically.
+type Versioner interface {
+	// GetVersion returns the value of key and the version of its last write.
+	GetVersion(ctx context.Context, key string) (string, uint64, error)
+	// CompareAndSwap stores value at key if the last write of key has
+	// version. It returns ErrNotFound for a missing key and
+	// ErrVersionMismatch if the key has been written since.
+	CompareAndSwap(ctx context.Context, key, value string, version uint64) error
+	// CompareAndDelete deletes key if the last write of key has version,
+	// with the errors of CompareAndSwap.
+	CompareAndDelete(ctx context.Context, key string, version uint64) error
+}
+
+var _ Versioner = (*Db)(nil)
+
+// GetVersion returns the value of key and the version of its last write.
+// Segments do not store versions, so the keys loaded from disk all report
+// the version the Db was opened at. It is newer than any version handed out
+// before, so a version read before a restart never matches.
+func (db *Db) GetVersion(ctx context.Context, key string) (string, uint64, error) {
+	value, rec, err := db.get(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, db.recordVersion(rec), nil
+}
+
+func (db *Db) recordVersion(rec record) uint64 {
+	if rec.version == 0 {
+		return db.openVersion
+	}
+	return rec.version
+}
+
+func (db *Db) CompareAndSwap(ctx context.Context, key, value string, version uint64) error {
+	return db.compareAndPut(ctx, key, value, false, version)
+}
+
+func (db *Db) CompareAndDelete(ctx context.Context, key string, version uint64) error {
+	return db.compareAndPut(ctx, key, "", true, version)
+}
+
+func (db *Db) compareAndPut(ctx context.Context, key, value string, deleted bool, version uint64) error {
+	if err := db.throttle(ctx); err != nil {
+		return err
+	}
+	if err := db.lockWriter(ctx); err != nil {
+		return err
+	}
+	defer db.unlockWriter()
+
+	_, rec, err := db.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if db.recordVersion(rec) != version {
+		return ErrVersionMismatch
+	}
+	return db.put(key, value, deleted)
+}
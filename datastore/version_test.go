@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemFS()
+	db := openMemDb(t, fs, 100)
+
+	if _, _, err := db.GetVersion(ctx, "key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing key, got %v", err)
+	}
+	if err := db.CompareAndSwap(ctx, "key", "v", 1); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound swapping a missing key, got %v", err)
+	}
+
+	db.Put("key", "v1")
+	value, v1, err := db.GetVersion(ctx, "key")
+	if err != nil || value != "v1" || v1 != db.Version() {
+		t.Fatalf("Unexpected version of v1: %q %d %v, last write %d", value, v1, err, db.Version())
+	}
+	db.Put("other", "value")
+	if _, v, _ := db.GetVersion(ctx, "key"); v != v1 {
+		t.Errorf("Writing another key changed the version from %d to %d", v1, v)
+	}
+
+	if err := db.CompareAndSwap(ctx, "key", "v2", v1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap(ctx, "key", "v3", v1); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for a stale version, got %v", err)
+	}
+	value, v2, _ := db.GetVersion(ctx, "key")
+	if value != "v2" || v2 <= v1 {
+		t.Errorf("Unexpected value %q at version %d after %d", value, v2, v1)
+	}
+
+	// Merges keep versions, many writes make sure one runs.
+	for i := 0; i < 20; i++ {
+		db.Put("filler", "0123456789")
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, _ := db.GetVersion(ctx, "key"); v != v2 {
+		t.Errorf("A merge changed the version from %d to %d", v2, v)
+	}
+
+	// Versions are not stored, so after a restart no old one matches.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openMemDb(t, fs, 100)
+	value, v, err := db.GetVersion(ctx, "key")
+	if err != nil || value != "v2" || v <= v2 {
+		t.Errorf("Unexpected version after reopening: %q %d %v, had %d", value, v, err, v2)
+	}
+	if err := db.CompareAndSwap(ctx, "key", "v3", v2); err != ErrVersionMismatch {
+		t.Errorf("Expected a version from before the restart to mismatch, got %v", err)
+	}
+	if err := db.CompareAndSwap(ctx, "key", "v3", v); err != nil {
+		t.Fatal(err)
+	}
+	_, v3, _ := db.GetVersion(ctx, "key")
+	if v3 <= v {
+		t.Errorf("Expected a new version after %d, got %d", v, v3)
+	}
+
+	if err := db.CompareAndDelete(ctx, "key", v); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch deleting at a stale version, got %v", err)
+	}
+	if err := db.CompareAndDelete(ctx, "key", v3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+	if err := db.CompareAndDelete(ctx, "key", v3); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deleting a missing key, got %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	// ErrWatchExpired is returned when a watch asks to resume from a version
+	// that is no longer retained. The client has to read the data afresh.
+	ErrWatchExpired     = fmt.Errorf("watch position is outside the retained window")
+	ErrWatchUnsupported = fmt.Errorf("store does not support watching")
+)
+
+type ChangeOp string
+
+const (
+	OpPut    ChangeOp = "put"
+	OpDelete ChangeOp = "delete"
+)
+
+// Change describes a single write. Version is the sequence number of the
+// write; it grows with every write to the store.
+type Change struct {
+	Key     string   `json:"key"`
+	Op      ChangeOp `json:"op"`
+	Version uint64   `json:"version"`
+	Value   string   `json:"value,omitempty"`
+	// ValueOmitted is set for puts of values over feedValueLimit, which the
+	// feed does not keep, and of values that are not valid UTF-8, which
+	// JSON cannot carry. Readers get the value by Key.
+	ValueOmitted bool `json:"valueOmitted,omitempty"`
+}
+
+// feedValueLimit is the largest value the change feed carries. The feed
+// retains a window of changes, so it must not hold on to large values.
+const feedValueLimit = 64 << 10
+
+// putChange describes a put of value to key at version.
+func putChange(key string, version uint64, value string) Change {
+	if len(value) > feedValueLimit || !utf8.ValidString(value) {
+		return Change{Key: key, Op: OpPut, Version: version, ValueOmitted: true}
+	}
+	return Change{Key: key, Op: OpPut, Version: version, Value: value}
+}
+
+// Watcher is implemented by stores that publish their changes.
+type Watcher interface {
+	// Watch returns the changes to keys starting with prefix. With a non-zero
+	// since, retained changes newer than that version are replayed first.
+	// The channel is closed once ctx is done, the store is closed or the
+	// reader falls more than the retained window behind; the reader can then
+	// resume from the last version it got.
+	Watch(ctx context.Context, prefix string, since uint64) (<-chan Change, error)
+}
+
+var (
+	_ Watcher = (*Db)(nil)
+	_ Watcher = (*MemStore)(nil)
+	_ Watcher = (*Bucket)(nil)
+)
+
+// defaultWatchWindow is the number of changes kept for resuming watches.
+const defaultWatchWindow = 1024
+
+// WithWatchWindow sets how many recent changes are kept for resuming watches.
+func WithWatchWindow(n int) Option {
+	return func(db *Db) { db.feed.window = n }
+}
+
+// changeFeed keeps a window of recent changes and fans new ones out to the
+// watchers.
+type changeFeed struct {
+	lock     sync.Mutex
+	window   int
+	last     uint64
+	history  []Change
+	watchers map[*watcher]bool
+	closed   bool
+}
+
+type watcher struct {
+	match   func(key string) bool
+	changes chan Change
+	done    chan struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{
+		window:   defaultWatchWindow,
+		watchers: make(map[*watcher]bool),
+	}
+}
+
+// publish records c and hands it to every interested watcher. A watcher whose
+// buffer is full is dropped instead of holding up the writer.
+func (f *changeFeed) publish(c Change) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.last = c.Version
+	if f.window > 0 {
+		if len(f.history) == f.window {
+			f.history = f.history[1:]
+		}
+		f.history = append(f.history, c)
+	}
+	for w := range f.watchers {
+		if !w.match(c.Key) {
+			continue
+		}
+		select {
+		case w.changes <- c:
+		default:
+			f.remove(w)
+		}
+	}
+}
+
+// subscribe registers a watcher for the keys accepted by match. With resume
+// set, retained changes after since are replayed first.
+func (f *changeFeed) subscribe(ctx context.Context, match func(key string) bool, since uint64, resume bool) (<-chan Change, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return nil, ErrClosed
+	}
+	var replay []Change
+	if resume {
+		oldest := f.last + 1
+		if len(f.history) > 0 {
+			oldest = f.history[0].Version
+		}
+		if since > f.last || since+1 < oldest {
+			return nil, ErrWatchExpired
+		}
+		for _, c := range f.history {
+			if c.Version > since && match(c.Key) {
+				replay = append(replay, c)
+			}
+		}
+	}
+
+	w := &watcher{
+		match:   match,
+		changes: make(chan Change, f.window+len(replay)+1),
+		done:    make(chan struct{}),
+	}
+	for _, c := range replay {
+		w.changes <- c
+	}
+	f.watchers[w] = true
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.lock.Lock()
+			f.remove(w)
+			f.lock.Unlock()
+		case <-w.done:
+		}
+	}()
+	return w.changes, nil
+}
+
+// remove must be called with lock held.
+func (f *changeFeed) remove(w *watcher) {
+	if f.watchers[w] {
+		delete(f.watchers, w)
+		close(w.changes)
+		close(w.done)
+	}
+}
+
+func (f *changeFeed) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.closed = true
+	for w := range f.watchers {
+		f.remove(w)
+	}
+}
+
+func (db *Db) Watch(ctx context.Context, prefix string, since uint64) (<-chan Change, error) {
+	return db.feed.subscribe(ctx, scanMatcher(prefix), since, since > 0)
+}
+
+// WatchAll returns the changes to every key of every bucket after since, with
+// bucket keys in their stored form. Unlike Watch it also replays from version
+// 0, so it can pick up right after a Snapshot of a fresh Db.
+func (db *Db) WatchAll(ctx context.Context, since uint64) (<-chan Change, error) {
+	return db.feed.subscribe(ctx, func(string) bool { return true }, since, true)
+}
+
+func (s *MemStore) Watch(ctx context.Context, prefix string, since uint64) (<-chan Change, error) {
+	return s.feed.subscribe(ctx, scanMatcher(prefix), since, since > 0)
+}
+
+func scanMatcher(prefix string) func(key string) bool {
+	return func(key string) bool { return inScan(key, prefix) }
+}
+
+// rangeMatcher matches the keys of a scan for prefix that sort after after.
+func rangeMatcher(prefix, after string) func(key string) bool {
+	return func(key string) bool { return inRange(key, prefix, after) }
+}
+
+// Watch watches the keys of the bucket. It needs the underlying store to be a
+// Watcher.
+func (b *Bucket) Watch(ctx context.Context, prefix string, since uint64) (<-chan Change, error) {
+	w, ok := b.store.(Watcher)
+	if !ok {
+		return nil, ErrWatchUnsupported
+	}
+	changes, err := w.Watch(ctx, b.prefix+prefix, since)
+	if err != nil || b.prefix == "" {
+		return changes, err
+	}
+
+	res := make(chan Change)
+	go func() {
+		defer close(res)
+		for c := range changes {
+			c.Key = c.Key[len(b.prefix):]
+			select {
+			case res <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+// Versions have to keep growing across restarts. Rather than storing one with
+// every record, the Db reserves them in blocks and records the end of the
+// reserved block in seqFileName. After a restart numbering continues after
+// that block, skipping whatever was left of it. A new limit is written to a
+// file with seqTempSuffix first and renamed over seqFileName.
+const (
+	seqFileName   = "sequence"
+	seqTempSuffix = ".seq-tmp"
+	seqBlock      = 1 << 16
+)
+
+// nextVersion returns the version of the next write. It must be called with
+// indexLock held.
+func (db *Db) nextVersion() (uint64, error) {
+	if db.seq+1 > db.seqLimit {
+		if err := db.reserveVersions(db.seq + seqBlock); err != nil {
+			return 0, err
+		}
+	}
+	db.seq++
+	return db.seq, nil
+}
+
+// reserveVersions durably records limit as the end of the reserved block.
+func (db *Db) reserveVersions(limit uint64) error {
+	path := filepath.Join(db.dir, seqFileName)
+	tmpPath := path + seqTempSuffix
+	f, err := db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, limit)
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = db.fs.Rename(tmpPath, path)
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		return err
+	}
+	db.seqLimit = limit
+	return nil
+}
+
+// recoverVersions continues numbering after the last reserved block and
+// reserves the next one.
+func (db *Db) recoverVersions() error {
+	f, err := db.fs.Open(filepath.Join(db.dir, seqFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		buf := make([]byte, 8)
+		_, err := f.ReadAt(buf, 0)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", seqFileName, err)
+		}
+		db.seq = binary.LittleEndian.Uint64(buf)
+		db.feed.last = db.seq
+	}
+	return db.reserveVersions(db.seq + seqBlock)
+}
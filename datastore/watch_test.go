@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, changes <-chan Change) Change {
+	t.Helper()
+	select {
+	case c, ok := <-changes:
+		if !ok {
+			t.Fatal("The watch channel was closed")
+		}
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("No change received")
+	}
+	return Change{}
+}
+
+func TestWatch(t *testing.T) {
+	t.Run("Live Changes", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000)
+		ctx, cancel := context.WithCancel(context.Background())
+		changes, err := db.Watch(ctx, "user:", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db.Put("other", "value")
+		db.Put("user:1", "alice")
+		db.Delete("user:1")
+
+		put := receive(t, changes)
+		if put.Key != "user:1" || put.Op != OpPut || put.Value != "alice" {
+			t.Errorf("Unexpected change %+v", put)
+		}
+		del := receive(t, changes)
+		if del.Key != "user:1" || del.Op != OpDelete || del.Version != put.Version+1 {
+			t.Errorf("Unexpected change %+v after %+v", del, put)
+		}
+
+		cancel()
+		select {
+		case _, ok := <-changes:
+			if ok {
+				t.Error("Expected no more changes")
+			}
+		case <-time.After(time.Second):
+			t.Error("Expected the channel to be closed after cancel")
+		}
+	})
+
+	t.Run("Omitted Values", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1<<20)
+		db.Put("small", "value")
+		db.Put("huge", strings.Repeat("x", feedValueLimit+1))
+		db.PutBytes([]byte("binary"), []byte{0xff, 0xfe})
+
+		// Replay the retained changes after the small put.
+		changes, err := db.Watch(context.Background(), "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"huge", "binary"} {
+			if c := receive(t, changes); c.Key != key || !c.ValueOmitted || c.Value != "" {
+				t.Errorf("Expected %s without the value, got %s with %d bytes", key, c.Key, len(c.Value))
+			}
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000, WithWatchWindow(3))
+		for i := 0; i < 5; i++ {
+			db.Put(fmt.Sprintf("key%d", i), "value")
+		}
+		last := db.seq
+
+		changes, err := db.Watch(context.Background(), "", last-2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"key3", "key4"} {
+			if c := receive(t, changes); c.Key != key {
+				t.Errorf("Expected %s to be replayed, got %+v", key, c)
+			}
+		}
+
+		if _, err := db.Watch(context.Background(), "", last-4); err != ErrWatchExpired {
+			t.Errorf("Expected ErrWatchExpired outside the window, got %v", err)
+		}
+		if _, err := db.Watch(context.Background(), "", last+1); err != ErrWatchExpired {
+			t.Errorf("Expected ErrWatchExpired for a future version, got %v", err)
+		}
+	})
+
+	t.Run("Versions After Restart", func(t *testing.T) {
+		fs := NewMemFS()
+		db := openMemDb(t, fs, 1000)
+		db.Put("key", "value1")
+		before := db.seq
+
+		db = crash(t, fs, db, 1000)
+		changes, _ := db.Watch(context.Background(), "", 0)
+		db.Put("key", "value2")
+		if c := receive(t, changes); c.Version <= before {
+			t.Errorf("Expected versions to keep growing after a restart, got %d after %d", c.Version, before)
+		}
+		if _, err := db.Watch(context.Background(), "", before); err != ErrWatchExpired {
+			t.Errorf("Expected versions from before the restart to be expired, got %v", err)
+		}
+	})
+
+	t.Run("Slow Reader", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000, WithWatchWindow(2))
+		changes, _ := db.Watch(context.Background(), "", 0)
+		for i := 0; i < 5; i++ {
+			db.Put("key", "value")
+		}
+		count := 0
+		for range changes {
+			count++
+		}
+		if count != 3 {
+			t.Errorf("Expected the buffered changes before the channel is closed, got %d", count)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000)
+		changes, _ := db.Watch(context.Background(), "", 0)
+		db.Close()
+		if _, ok := <-changes; ok {
+			t.Error("Expected the channel to be closed")
+		}
+		if _, err := db.Watch(context.Background(), "", 0); err != ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	})
+
+	t.Run("Snapshot And WatchAll", func(t *testing.T) {
+		db := openMemDb(t, NewMemFS(), 1000)
+		b, _ := db.Bucket("b")
+		b.Put("key", "bucket")
+
+		var keys []string
+		version, err := db.Snapshot(func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0] != "\x00b\x00key" {
+			t.Errorf("Expected the snapshot to hold bucket keys, got %q", keys)
+		}
+
+		db.Put("key", "after")
+		changes, err := db.WatchAll(context.Background(), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := receive(t, changes); c.Key != "key" || c.Version != version+1 {
+			t.Errorf("Expected the write after the snapshot, got %+v", c)
+		}
+	})
+
+	t.Run("Bucket", func(t *testing.T) {
+		store := NewMemStore()
+		b, _ := store.Bucket("b")
+		changes, _ := b.Watch(context.Background(), "", 0)
+		store.Put("key", "flat")
+		b.Put("key", "bucket")
+		if c := receive(t, changes); c.Key != "key" || c.Value != "bucket" {
+			t.Errorf("Unexpected change %+v", c)
+		}
+	})
+}
@@ -0,0 +1,362 @@
+// Package dbclient is a Go client of the /db/ API served by cmd/db and
+// cmd/dbrouter.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is matched by errors of requests for missing keys.
+	ErrNotFound = errors.New("key not found")
+	// ErrConflict is matched by errors of operations the current value does
+	// not allow, such as incrementing a value that is not an integer.
+	ErrConflict     = errors.New("conflict with the current value")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrWatchExpired = errors.New("watch position is outside the retained window")
+	ErrInvalidKey   = errors.New("invalid key")
+	// ErrInvalidBucket is returned by Bucket for names no /db/ path
+	// addresses.
+	ErrInvalidBucket = errors.New("invalid bucket name")
+)
+
+// Error is a response of the db service with an error status. Code is the
+// stable code of the error body, such as not_found, if the service sent one.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("db: %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("db: %d %s", e.Status, e.Message)
+}
+
+// Is matches the Err* values by status.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrConflict:
+		return e.Status == http.StatusConflict
+	case ErrUnauthorized:
+		return e.Status == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.Status == http.StatusForbidden
+	case ErrWatchExpired:
+		return e.Status == http.StatusGone
+	}
+	return false
+}
+
+// temporary reports whether a retry may succeed.
+func (e *Error) temporary() bool {
+	switch e.Status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Defaults of the Client retry policy.
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// Client calls the /db/ API of the service at a base URL, such as
+// http://db:8083. Idempotent calls are retried after network errors and
+// 502, 503 and 504 responses, waiting Backoff before the first retry and
+// twice as long before each next one, or as long as Retry-After asks.
+// Increment is never retried, it could apply twice.
+//
+// The fields must not be changed once the client is in use.
+type Client struct {
+	// HTTPClient sends the requests, http.DefaultClient if nil. Its Timeout
+	// also ends Watch streams, so prefer contexts for deadlines.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token if not empty.
+	Token   string
+	Retries int
+	Backoff time.Duration
+
+	base   string
+	bucket string
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
+		base:    strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Bucket returns a client of the keys in the named bucket. Like keys, bucket
+// names are path segments: they cannot be empty, hold a slash or a NUL byte
+// or be a dot segment.
+func (c *Client) Bucket(name string) (*Client, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidBucket, name)
+	}
+	b := *c
+	b.bucket = name
+	return &b, nil
+}
+
+// Entry is a key and its value.
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Get returns the value of key, or an error matching ErrNotFound. Values are
+// transferred raw, so they may hold any bytes.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	path, err := c.keyPath(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := c.call(ctx, http.MethodGet, path, "", nil, true)
+	return string(data), err
+}
+
+// Put stores value at key.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	path, err := c.keyPath(key)
+	if err != nil {
+		return err
+	}
+	_, err = c.call(ctx, http.MethodPut, path, octetStream, []byte(value), true)
+	return err
+}
+
+// Delete deletes key. Deleting a missing key succeeds.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	path, err := c.keyPath(key)
+	if err != nil {
+		return err
+	}
+	_, err = c.call(ctx, http.MethodDelete, path, "", nil, true)
+	return err
+}
+
+// Increment adds delta to the integer value of key, a missing key counts as
+// 0, and returns the result. Values that are not integers or would overflow
+// give an error matching ErrConflict.
+func (c *Client) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	path, err := c.keyPath(key)
+	if err != nil {
+		return 0, err
+	}
+	body, _ := json.Marshal(struct {
+		Delta int64 `json:"delta"`
+	}{delta})
+	data, err := c.call(ctx, http.MethodPost, path+":increment", "application/json", body, false)
+	if err != nil {
+		return 0, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(entry.Value, 10, 64)
+}
+
+// Scan lists keys with prefix in ascending order. It returns the keys after
+// after, at most limit of them unless limit is 0, so pages continue from the
+// last key of the previous one.
+func (c *Client) Scan(ctx context.Context, prefix, after string, limit int) ([]Entry, error) {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	data, err := c.call(ctx, http.MethodGet, c.bucketPath()+"_scan?"+query.Encode(), "", nil, true)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Entries []Entry `json:"entries"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Entries, nil
+}
+
+// GetMany returns the values of the keys that exist and the missing keys in
+// a single request.
+func (c *Client) GetMany(ctx context.Context, keys []string) (map[string]string, []string, error) {
+	data, err := c.many(ctx, "_mget", keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	var resp struct {
+		Values  map[string]string `json:"values"`
+		Missing []string          `json:"missing"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Values, resp.Missing, nil
+}
+
+// DeleteMany deletes keys in a single request.
+func (c *Client) DeleteMany(ctx context.Context, keys []string) error {
+	_, err := c.many(ctx, "_mdelete", keys)
+	return err
+}
+
+// many sends a batch request. Both batch operations are idempotent.
+func (c *Client) many(ctx context.Context, op string, keys []string) ([]byte, error) {
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	body, _ := json.Marshal(struct {
+		Keys []string `json:"keys"`
+	}{keys})
+	return c.call(ctx, http.MethodPost, c.bucketPath()+op, "application/json", body, true)
+}
+
+const octetStream = "application/octet-stream"
+
+// reservedKeys are the names the /db/ API gives to batch and listing
+// operations.
+var reservedKeys = map[string]bool{"_scan": true, "_watch": true, "_mget": true, "_mdelete": true}
+
+// checkKey rejects keys that no /db/ path addresses: slashes separate buckets
+// from keys, HTTP servers resolve . and .. segments and reserved keys name
+// operations.
+func checkKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: key is empty", ErrInvalidKey)
+	case strings.ContainsAny(key, "/\x00"):
+		return fmt.Errorf("%w: key %q contains a slash or a NUL byte", ErrInvalidKey, key)
+	case key == "." || key == "..":
+		return fmt.Errorf("%w: key %q is a dot segment", ErrInvalidKey, key)
+	case reservedKeys[key]:
+		return fmt.Errorf("%w: key %q is reserved", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+func (c *Client) bucketPath() string {
+	if c.bucket == "" {
+		return "/db/"
+	}
+	return "/db/" + url.PathEscape(c.bucket) + "/"
+}
+
+func (c *Client) keyPath(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return c.bucketPath() + url.PathEscape(key), nil
+}
+
+// call sends a request and returns the body of a successful response.
+func (c *Client) call(ctx context.Context, method, path, contentType string, body []byte, idempotent bool) ([]byte, error) {
+	resp, err := c.do(ctx, method, path, contentType, body, idempotent)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// do sends a request, retrying idempotent ones, and returns a response with
+// a success status. The caller closes its body.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body []byte, idempotent bool) (*http.Response, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Accept", octetStream)
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		// Network errors are retried unless ctx ended them.
+		retryable, wait := ctx.Err() == nil, backoff
+		if err == nil {
+			e := readError(resp)
+			err, retryable = e, e.temporary()
+			if after, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && time.Duration(after)*time.Second > wait {
+				wait = time.Duration(after) * time.Second
+			}
+		}
+		if !idempotent || !retryable || attempt >= c.Retries {
+			return nil, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// readError turns an error response into an *Error and closes its body.
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	e := &Error{Status: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		var body struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &body) == nil {
+			e.Code, e.Message = body.Code, body.Message
+		}
+	}
+	return e
+}
@@ -0,0 +1,169 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	c := New(server.URL + "/")
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls atomic.Int64
+	c := newTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.Method == http.MethodPost {
+			rw.WriteHeader(http.StatusOK)
+			_, _ = rw.Write([]byte(`{"key":"counter","value":"1"}`))
+			return
+		}
+		_, _ = rw.Write([]byte("value"))
+	})
+	ctx := context.Background()
+
+	t.Run("Idempotent", func(t *testing.T) {
+		calls.Store(0)
+		if value, err := c.Get(ctx, "key"); err != nil || value != "value" {
+			t.Errorf("Expected the value after retries, got %q, %v", value, err)
+		}
+		if n := calls.Load(); n != 3 {
+			t.Errorf("Expected 3 attempts, got %d", n)
+		}
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		// Far enough below 3 for every attempt to fail.
+		calls.Store(-10)
+		err := c.Put(ctx, "key", "value")
+		var e *Error
+		if !errors.As(err, &e) || e.Status != http.StatusServiceUnavailable {
+			t.Errorf("Expected a 503 error, got %v", err)
+		}
+		if n := calls.Load() + 10; n != 1+DefaultRetries {
+			t.Errorf("Expected %d attempts, got %d", 1+DefaultRetries, n)
+		}
+	})
+
+	t.Run("Not Idempotent", func(t *testing.T) {
+		calls.Store(0)
+		if _, err := c.Increment(ctx, "counter", 1); err == nil {
+			t.Error("Expected the first 503 to be returned")
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("Expected a single attempt, got %d", n)
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		calls.Store(-10)
+		slow := *c
+		slow.Backoff = time.Hour
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := slow.Get(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the deadline to end the backoff, got %v", err)
+		}
+	})
+}
+
+func TestClient_Paths(t *testing.T) {
+	var path string
+	c := newTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.EscapedPath()
+		if req.URL.RawQuery != "" {
+			path += "?" + req.URL.RawQuery
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"entries":[]}`))
+	})
+	ctx := context.Background()
+	team, err := c.Bucket("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		call func() error
+		path string
+	}{
+		{func() error { _, err := c.Get(ctx, "a b?c#d%e"); return err }, "/db/a%20b%3Fc%23d%25e"},
+		{func() error { _, err := c.Get(ctx, "user:1"); return err }, "/db/user:1"},
+		{func() error { return team.Delete(ctx, "k") }, "/db/team/k"},
+		{func() error { _, err := c.Scan(ctx, "a&b", "", 10); return err }, "/db/_scan?limit=10&prefix=a%26b"},
+		{func() error { _, err := team.Scan(ctx, "", "", 0); return err }, "/db/team/_scan?"},
+	} {
+		path = ""
+		if err := tc.call(); err != nil {
+			t.Errorf("%s: %s", tc.path, err)
+		}
+		if path != tc.path && path+"?" != tc.path {
+			t.Errorf("Expected a request to %s, got %s", tc.path, path)
+		}
+	}
+
+	for _, key := range []string{"", "a/b", "..", "_mget", "nul\x00"} {
+		path = ""
+		if err := c.Put(ctx, key, "v"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected key %q to be invalid, got %v", key, err)
+		}
+		if path != "" {
+			t.Errorf("Invalid key %q was sent to %s", key, path)
+		}
+	}
+	for _, name := range []string{"", "a/b", ".", "nul\x00"} {
+		if _, err := c.Bucket(name); !errors.Is(err, ErrInvalidBucket) {
+			t.Errorf("Expected bucket %q to be invalid, got %v", name, err)
+		}
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	c := newTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		status := map[string]int{
+			"/db/missing":             http.StatusNotFound,
+			"/db/text:increment":      http.StatusConflict,
+			"/db/secret":              http.StatusForbidden,
+			"/db/_watch":              http.StatusGone,
+			"/db/unauthenticated_key": http.StatusUnauthorized,
+		}[req.URL.Path]
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		_, _ = rw.Write([]byte(`{"code":"some_code","message":"some message"}`))
+	})
+	ctx := context.Background()
+
+	_, err := c.Get(ctx, "missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Code != "some_code" || e.Message != "some message" {
+		t.Errorf("Expected the error body in the error, got %#v", err)
+	}
+	if _, err := c.Increment(ctx, "text", 1); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if err := c.Delete(ctx, "secret"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected ErrForbidden, got %v", err)
+	}
+	if _, err := c.Get(ctx, "unauthenticated_key"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+	if _, err := c.Watch(ctx, "", 100); !errors.Is(err, ErrWatchExpired) {
+		t.Errorf("Expected ErrWatchExpired, got %v", err)
+	}
+}
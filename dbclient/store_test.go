@@ -0,0 +1,201 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// storeHandler serves the /db/ requests the client makes from a MemStore,
+// standing in for the handler of the db service.
+func storeHandler(store *datastore.MemStore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var s interface {
+			datastore.Store
+			datastore.Watcher
+		} = store
+		key := strings.TrimPrefix(req.URL.Path, "/db/")
+		if name, rest, ok := strings.Cut(key, "/"); ok {
+			bucket, err := store.Bucket(name)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s, key = bucket, rest
+		}
+
+		switch {
+		case key == "_scan":
+			query := req.URL.Query()
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			resp := struct {
+				Entries []Entry `json:"entries"`
+			}{[]Entry{}}
+			s.ScanAfter(query.Get("prefix"), query.Get("after"), func(key, value string) bool {
+				resp.Entries = append(resp.Entries, Entry{Key: key, Value: value})
+				return limit == 0 || len(resp.Entries) < limit
+			})
+			json.NewEncoder(rw).Encode(resp)
+		case key == "_mget" || key == "_mdelete":
+			var body struct {
+				Keys []string `json:"keys"`
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			if key == "_mdelete" {
+				s.DeleteMany(body.Keys)
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			}
+			values, missing, _ := s.GetMany(body.Keys)
+			json.NewEncoder(rw).Encode(map[string]interface{}{"values": values, "missing": missing})
+		case key == "_watch":
+			changes, err := s.Watch(req.Context(), req.URL.Query().Get("prefix"), 0)
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rw.Header().Set("Content-Type", "text/event-stream")
+			rw.WriteHeader(http.StatusOK)
+			rw.(http.Flusher).Flush()
+			for c := range changes {
+				data, _ := json.Marshal(c)
+				fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", c.Version, c.Op, data)
+				rw.(http.Flusher).Flush()
+			}
+		case req.Method == http.MethodPost && strings.HasSuffix(key, ":increment"):
+			var body struct {
+				Delta int64 `json:"delta"`
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			key = strings.TrimSuffix(key, ":increment")
+			n, err := s.Increment(key, body.Delta)
+			if err != nil {
+				rw.WriteHeader(http.StatusConflict)
+				return
+			}
+			json.NewEncoder(rw).Encode(Entry{Key: key, Value: strconv.FormatInt(n, 10)})
+		case req.Method == http.MethodPut:
+			value, _ := io.ReadAll(req.Body)
+			s.Put(key, string(value))
+			rw.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodDelete:
+			s.Delete(key)
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			value, err := s.Get(key)
+			if errors.Is(err, datastore.ErrNotFound) {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			rw.Header().Set("Content-Type", octetStream)
+			io.WriteString(rw, value)
+		}
+	}
+}
+
+func TestClient_Store(t *testing.T) {
+	store := datastore.NewMemStore()
+	server := httptest.NewServer(storeHandler(store))
+	defer server.Close()
+	c := New(server.URL)
+	ctx := context.Background()
+
+	t.Run("Get Put Delete", func(t *testing.T) {
+		for _, key := range []string{"plain", "with space", "a?b#c", "user:1", "50%", "ключ"} {
+			value := "\x00\xff binary " + key
+			if err := c.Put(ctx, key, value); err != nil {
+				t.Fatalf("Put %q: %s", key, err)
+			}
+			if stored, _ := store.Get(key); stored != value {
+				t.Errorf("Key %q stored %q", key, stored)
+			}
+			if got, err := c.Get(ctx, key); err != nil || got != value {
+				t.Errorf("Get %q: %q, %v", key, got, err)
+			}
+			if err := c.Delete(ctx, key); err != nil {
+				t.Errorf("Delete %q: %s", key, err)
+			}
+			if _, err := c.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected %q to be deleted, got %v", key, err)
+			}
+		}
+	})
+
+	t.Run("Increment", func(t *testing.T) {
+		if n, err := c.Increment(ctx, "counter", 5); err != nil || n != 5 {
+			t.Errorf("Unexpected increment result %d, %v", n, err)
+		}
+		store.Put("text", "abc")
+		if _, err := c.Increment(ctx, "text", 1); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Scan Many", func(t *testing.T) {
+		users, err := c.Bucket("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"u1", "u2", "u3"} {
+			if err := users.Put(ctx, key, "v-"+key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := users.Scan(ctx, "u", "u1", 1)
+		if err != nil || !reflect.DeepEqual(entries, []Entry{{Key: "u2", Value: "v-u2"}}) {
+			t.Errorf("Unexpected scan result %v, %v", entries, err)
+		}
+		values, missing, err := users.GetMany(ctx, []string{"u1", "u9"})
+		if err != nil || !reflect.DeepEqual(values, map[string]string{"u1": "v-u1"}) || !reflect.DeepEqual(missing, []string{"u9"}) {
+			t.Errorf("Unexpected GetMany result %v, %v, %v", values, missing, err)
+		}
+		if err := users.DeleteMany(ctx, []string{"u1", "u2"}); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := users.Scan(ctx, "", "", 0); len(entries) != 1 {
+			t.Errorf("Expected a single key left, got %v", entries)
+		}
+		if _, err := c.Get(ctx, "u3"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected the bucket keys to stay out of the default bucket, got %v", err)
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		changes, err := c.Watch(ctx, "w:", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Put(ctx, "other", "ignored")
+		c.Put(ctx, "w:1", "one")
+		c.Delete(ctx, "w:1")
+
+		var got []datastore.Change
+		for len(got) < 2 {
+			change, ok := <-changes
+			if !ok {
+				t.Fatalf("Stream ended after %v", got)
+			}
+			got = append(got, change)
+		}
+		if got[0].Key != "w:1" || got[0].Op != datastore.OpPut || got[0].Value != "one" || got[1].Op != datastore.OpDelete {
+			t.Errorf("Unexpected changes %+v", got)
+		}
+
+		cancel()
+		for range changes {
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// Client watches the service like a local store.
+var _ datastore.Watcher = (*Client)(nil)
+
+// Watch streams the changes to keys starting with prefix, replaying the ones
+// after since first if it is not zero. Opening the stream is retried like
+// other reads; a since the service no longer retains gives an error matching
+// ErrWatchExpired.
+//
+// The service sends puts of large or binary values without the value; Watch
+// gets it by key, so such a change can carry a newer value than its version.
+// A put of a key deleted in the meantime is skipped, the delete follows.
+//
+// The channel is closed once ctx is done or the stream ends, for example when
+// the service shuts down. The reader can then resume from the last version it
+// got.
+func (c *Client) Watch(ctx context.Context, prefix string, since uint64) (<-chan datastore.Change, error) {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if since != 0 {
+		query.Set("since", strconv.FormatUint(since, 10))
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.bucketPath()+"_watch?"+query.Encode(), "", nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan datastore.Change)
+	go func() {
+		defer close(changes)
+		defer resp.Body.Close()
+		events := bufio.NewScanner(resp.Body)
+		events.Buffer(nil, 64<<20)
+		var data string
+		for events.Scan() {
+			line := events.Text()
+			if line != "" {
+				// Only data fields matter, the id and event fields repeat
+				// the version and op of the change.
+				if field, value, _ := strings.Cut(line, ":"); field == "data" {
+					data = strings.TrimPrefix(value, " ")
+				}
+				continue
+			}
+			if data == "" {
+				continue
+			}
+			var change datastore.Change
+			err := json.Unmarshal([]byte(data), &change)
+			data = ""
+			if err != nil {
+				return
+			}
+			if change.ValueOmitted {
+				change.Value, err = c.Get(ctx, change.Key)
+				if errors.Is(err, ErrNotFound) {
+					continue
+				} else if err != nil {
+					return
+				}
+				change.ValueOmitted = false
+			}
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
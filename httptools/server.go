@@ -1,36 +1,167 @@
 package httptools
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
 type Server interface {
 	Start()
+	// Addr is the address the server listens on once started.
+	Addr() string
+	// Shutdown stops accepting connections and waits for the running requests
+	// to finish. Connections still busy when ctx is done are closed.
+	Shutdown(ctx context.Context) error
+	// RegisterOnShutdown registers f to be called when Shutdown starts, to end
+	// long-lived requests such as streams.
+	RegisterOnShutdown(f func())
 }
 
 type server struct {
 	httpServer *http.Server
+	listener   net.Listener
 }
 
-func (s server) Start() {
+// Start listens right away, so that Addr is known when it returns, and serves
+// in the background.
+func (s *server) Start() {
+	l, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		log.Fatalf("HTTP server cannot listen: %s. Finishing the process.", err)
+	}
+	s.listener = l
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
-		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+		err := s.httpServer.Serve(l)
+		if err != http.ErrServerClosed {
+			log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+		}
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+func (s *server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.httpServer.Close()
+	}
+	return err
+}
+
+func (s *server) RegisterOnShutdown(f func()) {
+	s.httpServer.RegisterOnShutdown(f)
+}
+
+func CreateServer(port int, handler http.Handler, opts ...Option) Server {
+	return CreateServerAddr(fmt.Sprintf(":%d", port), handler, opts...)
+}
+
+// CreateServerAddr creates a server listening on addr, such as
+// "localhost:8080".
+func CreateServerAddr(addr string, handler http.Handler, opts ...Option) Server {
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       DefaultIdleTimeout,
+		MaxHeaderBytes:    1 << 20,
+	}
+	for _, opt := range opts {
+		opt(httpServer)
+	}
+	return &server{httpServer: httpServer}
+}
+
+// Defaults of the timeouts that guard against slow clients. Request bodies
+// are not limited by default.
+const (
+	DefaultReadHeaderTimeout = 5 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+)
+
+// Option configures the HTTP server of CreateServer. A zero duration or size
+// disables the limit.
+type Option func(s *http.Server)
+
+// WithMaxBodySize limits the request bodies of every handler to n bytes, see
+// MaxBodySize.
+func WithMaxBodySize(n int64) Option {
+	return func(s *http.Server) { s.Handler = MaxBodySize(s.Handler, n) }
+}
+
+// WithReadHeaderTimeout bounds the time a client has to send the request
+// headers. Connections that take longer are closed.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *http.Server) { s.ReadHeaderTimeout = d }
+}
+
+// WithReadTimeout bounds the time a client has to send a whole request,
+// including its body.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *http.Server) { s.ReadTimeout = d }
+}
+
+// WithWriteTimeout bounds the time handlers have to write their responses,
+// unless they are wrapped by WriteTimeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *http.Server) { s.WriteTimeout = d }
+}
+
+// WithIdleTimeout bounds how long a keep-alive connection waits for the next
+// request.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *http.Server) { s.IdleTimeout = d }
+}
+
+// MaxBodySize limits the request bodies h reads to n bytes. Reads past the
+// limit fail with *http.MaxBytesError and the connection is closed after the
+// response; h answers such requests, see BodyErrorStatus.
+func MaxBodySize(h http.Handler, n int64) http.Handler {
+	if n <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(rw, r.Body, n)
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// WriteTimeout gives h d to write its response instead of the write timeout
+// of the server, for handlers that send large responses. Handlers that
+// stream for as long as the client listens clear the deadline themselves.
+func WriteTimeout(h http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if d > 0 {
+			deadline = time.Now().Add(d)
+		}
+		_ = http.NewResponseController(rw).SetWriteDeadline(deadline)
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// BodyErrorStatus returns the status of a response to a request whose body
+// could not be read because of err: 413 for a body over the MaxBodySize
+// limit and 408 for a body not sent within the read timeout. It returns 0
+// for other errors.
+func BodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return http.StatusRequestTimeout
 	}
+	return 0
 }
@@ -0,0 +1,86 @@
+package httptools
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateServer(t *testing.T) {
+	s := CreateServerAddr("localhost:0", http.NotFoundHandler(),
+		WithReadTimeout(time.Minute), WithIdleTimeout(0)).(*server)
+	if s.httpServer.ReadTimeout != time.Minute || s.httpServer.IdleTimeout != 0 {
+		t.Errorf("Options not applied: read %s, idle %s", s.httpServer.ReadTimeout, s.httpServer.IdleTimeout)
+	}
+	if s.httpServer.ReadHeaderTimeout != DefaultReadHeaderTimeout || s.httpServer.WriteTimeout == 0 {
+		t.Errorf("Defaults lost: read header %s, write %s", s.httpServer.ReadHeaderTimeout, s.httpServer.WriteTimeout)
+	}
+}
+
+func TestBodyErrorStatus(t *testing.T) {
+	status := make(chan int, 1)
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		status <- BodyErrorStatus(err)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		server := httptest.NewServer(MaxBodySize(h, 10))
+		defer server.Close()
+		for body, want := range map[string]int{"small": 0, strings.Repeat("x", 11): http.StatusRequestEntityTooLarge} {
+			resp, err := http.Post(server.URL, "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := <-status; got != want {
+				t.Errorf("Body of %d bytes: expected status %d, got %d", len(body), want, got)
+			}
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(h)
+		WithReadTimeout(100 * time.Millisecond)(server.Config)
+		server.Start()
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Promise a body and never send it.
+		_, _ = conn.Write([]byte("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc"))
+		if got := <-status; got != http.StatusRequestTimeout {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestTimeout, got)
+		}
+	})
+
+	if got := BodyErrorStatus(io.ErrUnexpectedEOF); got != 0 {
+		t.Errorf("Expected no status for other errors, got %d", got)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	server := httptest.NewUnstartedServer(WriteTimeout(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = rw.Write([]byte("done"))
+	}), time.Second))
+	WithWriteTimeout(50 * time.Millisecond)(server.Config)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the handler timeout to replace the server one, got %s", err)
+	}
+	defer resp.Body.Close()
+	if data, _ := io.ReadAll(resp.Body); string(data) != "done" {
+		t.Errorf("Unexpected response %q", data)
+	}
+}
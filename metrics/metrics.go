@@ -0,0 +1,280 @@
+// Package metrics exposes metrics in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram buckets, in seconds, suited to request
+// latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Registry is a set of metrics. It serves them over HTTP in the order they
+// were registered.
+type Registry struct {
+	lock    sync.Mutex
+	names   map[string]bool
+	writers []func(w *Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, write func(w *Writer)) {
+	if !namePattern.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.writers = append(r.writers, write)
+}
+
+// Collect registers fn to write metrics computed at scrape time, such as
+// values read from a stats snapshot.
+func (r *Registry) Collect(fn func(w *Writer)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.writers = append(r.writers, fn)
+}
+
+// Write writes every metric to out.
+func (r *Registry) Write(out io.Writer) error {
+	r.lock.Lock()
+	writers := append([]func(w *Writer){}, r.writers...)
+	r.lock.Unlock()
+
+	w := &Writer{w: bufio.NewWriter(out), described: make(map[string]bool)}
+	for _, write := range writers {
+		write(w)
+	}
+	return w.w.Flush()
+}
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", ContentType)
+	rw.WriteHeader(http.StatusOK)
+	_ = r.Write(rw)
+}
+
+// Writer writes samples. The HELP and TYPE lines of a metric are written
+// before its first sample, so all samples of a metric have to be written
+// together.
+type Writer struct {
+	w         *bufio.Writer
+	described map[string]bool
+}
+
+// Counter writes a sample of a counter. labels are name, value pairs.
+func (w *Writer) Counter(name, help string, value float64, labels ...string) {
+	w.describe(name, help, "counter")
+	w.sample(name, pairs(labels), value)
+}
+
+// Gauge writes a sample of a gauge. labels are name, value pairs.
+func (w *Writer) Gauge(name, help string, value float64, labels ...string) {
+	w.describe(name, help, "gauge")
+	w.sample(name, pairs(labels), value)
+}
+
+func (w *Writer) describe(name, help, kind string) {
+	if w.described[name] {
+		return
+	}
+	w.described[name] = true
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+type label struct {
+	name, value string
+}
+
+func pairs(labels []string) []label {
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be name, value pairs")
+	}
+	res := make([]label, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		res = append(res, label{labels[i], labels[i+1]})
+	}
+	return res
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (w *Writer) sample(name string, labels []label, value float64) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			fmt.Fprintf(w.w, `%s="%s"`, l.name, labelEscaper.Replace(l.value))
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatFloat(value))
+	w.w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec keeps one value per combination of label values.
+type vec struct {
+	labels []string
+	lock   sync.Mutex
+	values map[string]interface{}
+}
+
+// get returns the value for labelValues, creating it with create. It must be
+// called with lock held.
+func (v *vec) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	value, ok := v.values[key]
+	if !ok {
+		value = create()
+		v.values[key] = value
+	}
+	return value
+}
+
+// each calls fn for every value in a stable order. It must be called with
+// lock held.
+func (v *vec) each(fn func(labels []label, value interface{})) {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var labels []label
+		if len(v.labels) > 0 {
+			for i, value := range strings.Split(key, "\xff") {
+				labels = append(labels, label{v.labels[i], value})
+			}
+		}
+		fn(labels, v.values[key])
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec{labels: labels, values: make(map[string]interface{})}}
+	r.register(name, func(w *Writer) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.each(func(labels []label, value interface{}) {
+			w.describe(name, help, "counter")
+			w.sample(name, labels, *value.(*float64))
+		})
+	})
+	return c
+}
+
+// Add adds v, which must not be negative, to the counter with labelValues.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	*c.get(labelValues, func() interface{} { return new(float64) }).(*float64) += v
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bucket bounds,
+// which must be sorted. The +Inf bucket is added implicitly.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+	h := &HistogramVec{vec: vec{labels: labels, values: make(map[string]interface{})}, buckets: buckets}
+	r.register(name, func(w *Writer) {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.each(func(labels []label, value interface{}) {
+			hist := value.(*histogram)
+			w.describe(name, help, "histogram")
+			var cumulative uint64
+			for i, bound := range h.buckets {
+				cumulative += hist.counts[i]
+				w.sample(name+"_bucket", append(labels, label{"le", formatFloat(bound)}), float64(cumulative))
+			}
+			w.sample(name+"_bucket", append(labels, label{"le", "+Inf"}), float64(hist.count))
+			w.sample(name+"_sum", labels, hist.sum)
+			w.sample(name+"_count", labels, float64(hist.count))
+		})
+	})
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hist := h.get(labelValues, func() interface{} {
+		return &histogram{counts: make([]uint64, len(h.buckets))}
+	}).(*histogram)
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Requests.", "method", "status")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "method")
+	r.Collect(func(w *Writer) {
+		w.Gauge("keys", "Live keys.", 3)
+		w.Counter("gets_total", "Reads by\nresult.", 2, "result", "hit")
+		w.Counter("gets_total", "", 1, "result", `"mi\ss"`)
+	})
+
+	requests.Inc("GET", "200")
+	requests.Add(2, "GET", "200")
+	requests.Inc("DELETE", "404")
+	latency.Observe(0.05, "GET")
+	latency.Observe(0.1, "GET")
+	latency.Observe(5, "GET")
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{method="DELETE",status="404"} 1
+requests_total{method="GET",status="200"} 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="GET",le="0.1"} 2
+latency_seconds_bucket{method="GET",le="1"} 2
+latency_seconds_bucket{method="GET",le="+Inf"} 3
+latency_seconds_sum{method="GET"} 5.15
+latency_seconds_count{method="GET"} 3
+# HELP keys Live keys.
+# TYPE keys gauge
+keys 3
+# HELP gets_total Reads by\nresult.
+# TYPE gets_total counter
+gets_total{result="hit"} 2
+gets_total{result="\"mi\\ss\""} 1
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+
+	t.Run("HTTP", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != ContentType {
+			t.Errorf("Unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(rec.Body.String(), "keys 3\n") {
+			t.Errorf("Metrics missing from %q", rec.Body.String())
+		}
+
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405 for POST, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Misuse", func(t *testing.T) {
+		for name, f := range map[string]func(){
+			"duplicate":        func() { r.NewCounterVec("requests_total", "") },
+			"invalid name":     func() { r.NewCounterVec("requests-total", "") },
+			"unsorted buckets": func() { r.NewHistogramVec("h", "", []float64{1, 0.1}) },
+			"label count":      func() { requests.Inc("GET") },
+			"negative":         func() { requests.Add(-1, "GET", "200") },
+		} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("Expected %s to panic", name)
+					}
+				}()
+				f()
+			}()
+		}
+	})
+}
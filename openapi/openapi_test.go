@@ -0,0 +1,147 @@
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func testDocument() *Document {
+	one := 1.0
+	return &Document{
+		OpenAPI: Version,
+		Info:    Info{Title: "test", Version: "1"},
+		Paths: map[string]*PathItem{
+			"/items": {
+				Get: &Operation{
+					OperationID: "listItems",
+					Parameters: []Parameter{
+						{Name: "q", In: "query", Required: true, Schema: &Schema{Type: "string"}},
+						{Name: "limit", In: "query", Schema: &Schema{Type: "integer", Minimum: &one}},
+					},
+					Responses: map[string]*Response{"200": {Description: "Items."}},
+				},
+				Post: &Operation{
+					OperationID: "addItem",
+					RequestBody: &RequestBody{Required: true, Content: JSON(Ref("Item"))},
+					Responses:   map[string]*Response{"201": {Description: "Added."}},
+				},
+			},
+		},
+		Components: Components{Schemas: map[string]*Schema{
+			"Item": {
+				Type: "object",
+				Properties: map[string]*Schema{
+					"name":  {Type: "string"},
+					"count": {Type: "integer", Format: "int64", Minimum: &one},
+					"tags":  {Type: "array", Items: &Schema{Type: "string"}},
+					"attrs": {Type: "object", AdditionalProperties: &Schema{Type: "number"}},
+				},
+				Required: []string{"name"},
+				Closed:   true,
+			},
+		}},
+	}
+}
+
+func TestValidateBody(t *testing.T) {
+	d := testDocument()
+	op := d.Operation("addItem")
+	for body, expected := range map[string][]FieldError{
+		`{"name":"a","count":2,"tags":["x"],"attrs":{"w":1.5}}`: nil,
+		``:                         {{"body", "is required"}},
+		`{"name":`:                 {{"body", "invalid JSON: unexpected EOF"}},
+		`{"name":"a"} {}`:          {{"body", "unexpected data after the JSON value"}},
+		`[]`:                       {{"body", "expected an object, got an array"}},
+		`{}`:                       {{"name", "is required"}},
+		`{"name":1}`:               {{"name", "expected a string, got a number"}},
+		`{"name":"a","nmae":1}`:    {{"nmae", "is not a known field"}},
+		`{"name":"a","count":1.5}`: {{"count", "expected an integer, got 1.5"}},
+		`{"name":"a","count":0}`:   {{"count", "must be at least 1"}},
+		`{"name":"a","count":99999999999999999999}`: {{"count", "99999999999999999999 is out of range"}},
+		`{"name":"a","tags":["x",null,2]}`: {
+			{"tags[1]", "expected a string, got null"},
+			{"tags[2]", "expected a string, got a number"},
+		},
+		`{"name":"a","attrs":{"w":"heavy"}}`: {{"attrs.w", "expected a number, got a string"}},
+	} {
+		err := d.ValidateBody(op, []byte(body))
+		var invalid *ValidationError
+		if expected == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", body, err)
+			}
+		} else if !errors.As(err, &invalid) || !reflect.DeepEqual(invalid.Fields, expected) {
+			t.Errorf("%s: expected %v, got %v", body, expected, err)
+		}
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	d := testDocument()
+	op := d.Operation("listItems")
+	for query, expected := range map[string][]FieldError{
+		"q=a&limit=5&other=x": nil,
+		"limit=5":             {{"q", "is required"}},
+		"q=&limit=x":          {{"q", "must not be empty"}, {"limit", "expected an integer"}},
+		"q=a&limit=0":         {{"limit", "must be at least 1"}},
+	} {
+		values, _ := url.ParseQuery(query)
+		err := d.ValidateQuery(op, values)
+		var invalid *ValidationError
+		if expected == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", query, err)
+			}
+		} else if !errors.As(err, &invalid) || !reflect.DeepEqual(invalid.Fields, expected) {
+			t.Errorf("%s: expected %v, got %v", query, expected, err)
+		}
+	}
+}
+
+func TestDocument_ServeHTTP(t *testing.T) {
+	d := testDocument()
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var served struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			RequestBody *struct {
+				Content map[string]struct {
+					Schema struct {
+						Ref string `json:"$ref"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if served.OpenAPI != Version || served.Paths["/items"]["post"].OperationID != "addItem" {
+		t.Errorf("Unexpected document %+v", served)
+	}
+	if ref := served.Paths["/items"]["post"].RequestBody.Content["application/json"].Schema.Ref; ref != "#/components/schemas/Item" {
+		t.Errorf("Unexpected reference %q", ref)
+	}
+	if closed, ok := served.Components.Schemas["Item"]["additionalProperties"]; !ok || closed != false {
+		t.Errorf("Expected a closed Item schema, got %v", served.Components.Schemas["Item"])
+	}
+
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/openapi.json", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rec.Code)
+	}
+}
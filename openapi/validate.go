@@ -0,0 +1,222 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldError is a problem with one field of a request. Field is the name of a
+// query parameter or the path of a body field, such as value or keys[1]; it is
+// "body" for the body as a whole.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a request that does not match the
+// document.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Field + ": " + f.Message
+	}
+	return "invalid request: " + strings.Join(parts, "; ")
+}
+
+func result(errs []FieldError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: errs}
+}
+
+// ValidateBody checks a JSON request body of op. An empty body is only an
+// error if op requires one.
+func (d *Document) ValidateBody(op *Operation, body []byte) error {
+	if op.RequestBody == nil {
+		return nil
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return result([]FieldError{{"body", "is required"}})
+		}
+		return nil
+	}
+	return d.Validate(op.RequestBody.Content["application/json"].Schema, body)
+}
+
+// Validate checks that data is a single JSON value matching schema.
+func (d *Document) Validate(schema *Schema, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return result([]FieldError{{"body", "invalid JSON: " + err.Error()}})
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return result([]FieldError{{"body", "unexpected data after the JSON value"}})
+	}
+	var errs []FieldError
+	d.validate(schema, value, "", &errs)
+	return result(errs)
+}
+
+// ValidateQuery checks the query parameters of op. Parameters the operation
+// does not describe are ignored.
+func (d *Document) ValidateQuery(op *Operation, query url.Values) error {
+	var errs []FieldError
+	for _, p := range op.Parameters {
+		if p.In != "query" {
+			continue
+		}
+		if _, ok := query[p.Name]; !ok {
+			if p.Required {
+				errs = append(errs, FieldError{p.Name, "is required"})
+			}
+			continue
+		}
+		value := query.Get(p.Name)
+		s := d.resolve(p.Schema)
+		if s == nil {
+			continue
+		}
+		switch s.Type {
+		case "integer":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, FieldError{p.Name, "expected an integer"})
+			} else if s.Minimum != nil && float64(n) < *s.Minimum {
+				errs = append(errs, FieldError{p.Name, fmt.Sprintf("must be at least %v", *s.Minimum)})
+			}
+		case "string":
+			if p.Required && value == "" {
+				errs = append(errs, FieldError{p.Name, "must not be empty"})
+			}
+		}
+	}
+	return result(errs)
+}
+
+func (d *Document) validate(s *Schema, value interface{}, field string, errs *[]FieldError) {
+	s = d.resolve(s)
+	if s == nil {
+		return
+	}
+	name := field
+	if name == "" {
+		name = "body"
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{name, fmt.Sprintf(format, args...)})
+	}
+
+	switch s.Type {
+	case "string":
+		if _, ok := value.(string); !ok {
+			fail("expected a string, got %s", kind(value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("expected a boolean, got %s", kind(value))
+		}
+	case "number", "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			fail("expected %s, got %s", article(s.Type), kind(value))
+			return
+		}
+		var f float64
+		if s.Type == "integer" {
+			if strings.ContainsAny(n.String(), ".eE") {
+				fail("expected an integer, got %s", n)
+				return
+			}
+			i, err := n.Int64()
+			if err != nil {
+				fail("%s is out of range", n)
+				return
+			}
+			f = float64(i)
+		} else {
+			f, _ = n.Float64()
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			fail("expected an array, got %s", kind(value))
+			return
+		}
+		for i, item := range items {
+			d.validate(s.Items, item, fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			fail("expected an object, got %s", kind(value))
+			return
+		}
+		for _, r := range s.Required {
+			if _, ok := obj[r]; !ok {
+				*errs = append(*errs, FieldError{join(field, r), "is required"})
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for n := range obj {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if ps, ok := s.Properties[n]; ok {
+				d.validate(ps, obj[n], join(field, n), errs)
+			} else if s.Closed {
+				*errs = append(*errs, FieldError{join(field, n), "is not a known field"})
+			} else {
+				d.validate(s.AdditionalProperties, obj[n], join(field, n), errs)
+			}
+		}
+	}
+}
+
+func join(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func article(t string) string {
+	if t == "integer" {
+		return "an integer"
+	}
+	return "a " + t
+}
+
+// kind names the JSON type of a decoded value.
+func kind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	case []interface{}:
+		return "an array"
+	}
+	return "an object"
+}